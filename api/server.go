@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"github.com/labstack/echo/v4"
 	"net/http"
 	"strconv"
@@ -17,6 +18,64 @@ type TxResponse struct {
 	Hashes  []string
 }
 
+type NonceResponse struct {
+	Address string
+	Nonce   uint64
+}
+
+type Log struct {
+	Address string
+	Data    string
+}
+
+type Receipt struct {
+	TxHash          string
+	Status          uint8
+	GasUsed         uint64
+	Fee             uint64 // paid to the validator, the fee of the transaction plus the gas used at the gas price
+	ContractAddress string `json:",omitempty"` // only set by a DeployTx
+	Logs            []Log
+	Error           string `json:",omitempty"`
+}
+
+type DisasmResponse struct {
+	Hash     string
+	Contract string // set when the code belongs to a contract called by the transaction
+	Code     string
+	Assembly string
+}
+
+// CallRequest is the body of a read-only call. Code is hex encoded, if it is empty the code of the Contract runs.
+type CallRequest struct {
+	From     string
+	Contract string
+	Code     string
+	Value    uint64
+	Gas      uint64 // capped by the CallGasCap of the server, the cap is used if it is 0
+}
+
+// Value is a value of the VM stack, Type is either word or bytes. Words are decimal, bytes are hex encoded.
+type Value struct {
+	Type  string
+	Value string
+}
+
+type StorageRead struct {
+	Contract string
+	Key      string
+	Value    Value
+}
+
+type CallResponse struct {
+	Success     bool
+	Error       string `json:",omitempty"`
+	GasUsed     uint64
+	ReturnValue *Value `json:",omitempty"`
+	Stack       []Value
+	Reads       []StorageRead
+	Logs        []Log
+}
+
 type APIError struct {
 	Error string
 }
@@ -25,18 +84,26 @@ type Block struct {
 	Hash          string
 	Version       uint32
 	DataHash      string
+	StateRoot     string
+	ReceiptsRoot  string
 	PrevBlockHash string
 	Height        uint32
 	Timestamp     int64
 	Validator     string
 	Signature     string
+	Fees          uint64 // paid to the validator by the block transactions
+	Reward        uint64 // paid to the validator on top of the fees
 
 	TxResponse TxResponse
 }
 
+// defaultCallGasCap is the gas cap of read-only calls if the ServerConfig does not set one
+const defaultCallGasCap uint64 = 100_000
+
 type ServerConfig struct {
 	Logger     log.Logger
 	ListenAddr string
+	CallGasCap uint64 // the most gas a read-only call may use
 }
 
 type Server struct {
@@ -46,6 +113,10 @@ type Server struct {
 }
 
 func NewServer(cfg ServerConfig, bc *core.Blockchain, txChan chan *core.Transaction) *Server {
+	if cfg.CallGasCap == 0 {
+		cfg.CallGasCap = defaultCallGasCap
+	}
+
 	return &Server{
 		ServerConfig: cfg,
 		bc:           bc,
@@ -58,7 +129,11 @@ func (s *Server) Start() error {
 
 	e.GET("/block/:hashorid", s.handleGetBlock)
 	e.GET("/tx/:hash", s.handleGetTx)
+	e.GET("/tx/:hash/disasm", s.handleGetTxDisasm)
+	e.GET("/receipt/:hash", s.handleGetReceipt)
+	e.GET("/nonce/:address", s.handleGetNonce)
 	e.POST("/tx", s.handlePostTx)
+	e.POST("/call", s.handlePostCall)
 
 	return e.Start(s.ListenAddr)
 }
@@ -73,6 +148,46 @@ func (s *Server) handlePostTx(c echo.Context) error {
 	return nil
 }
 
+// handlePostCall executes code or a contract against the head state and returns the outcome
+// without persisting anything. A failing code is not an error of the request.
+func (s *Server) handlePostCall(c echo.Context) error {
+	request := CallRequest{}
+	if err := c.Bind(&request); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	call := &core.ReadOnlyCall{Value: request.Value, GasLimit: request.Gas}
+	if call.GasLimit == 0 || call.GasLimit > s.CallGasCap {
+		call.GasLimit = s.CallGasCap
+	}
+
+	var err error
+	if request.From != "" {
+		if call.From, err = parseAddress(request.From); err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+		}
+	}
+
+	if request.Contract != "" {
+		if call.Contract, err = parseAddress(request.Contract); err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+		}
+	}
+
+	if request.Code != "" {
+		if call.Code, err = hex.DecodeString(request.Code); err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+		}
+	}
+
+	result, err := s.bc.ReadOnlyCall(call)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, intoJSONCallResponse(result))
+}
+
 func (s *Server) handleGetTx(c echo.Context) error {
 	hash := c.Param("hash")
 
@@ -89,6 +204,70 @@ func (s *Server) handleGetTx(c echo.Context) error {
 	return c.JSON(http.StatusOK, tx)
 }
 
+func (s *Server) handleGetReceipt(c echo.Context) error {
+	b, err := hex.DecodeString(c.Param("hash"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	receipt, err := s.bc.GetReceipt(types.HashFromBytes(b))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, intoJSONReceipt(receipt))
+}
+
+// handleGetTxDisasm shows the code of a transaction as assembly. That is the code a DeployTx deploys,
+// the code of the contract a CallTx calls, or the Data of any other transaction.
+func (s *Server) handleGetTxDisasm(c echo.Context) error {
+	b, err := hex.DecodeString(c.Param("hash"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	tx, err := s.bc.GetTransactionByHash(types.HashFromBytes(b))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	response := DisasmResponse{Hash: tx.Hash(core.TransactionHasher{}).String()}
+	code := tx.Data
+
+	switch inner := tx.TxInner.(type) {
+	case core.DeployTx:
+		code = inner.Code
+	case core.CallTx:
+		if code, err = s.bc.GetContractCode(inner.Contract); err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+		}
+
+		response.Contract = inner.Contract.String()
+	}
+
+	assembly, err := core.Disassemble(code)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	response.Code = hex.EncodeToString(code)
+	response.Assembly = assembly
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func (s *Server) handleGetNonce(c echo.Context) error {
+	address, err := parseAddress(c.Param("address"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, NonceResponse{
+		Address: address.String(),
+		Nonce:   s.bc.NextNonce(address),
+	})
+}
+
 func (s *Server) handleGetBlock(c echo.Context) error {
 	hashOrID := c.Param("hashorid")
 
@@ -100,7 +279,7 @@ func (s *Server) handleGetBlock(c echo.Context) error {
 			return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
 		}
 
-		return c.JSON(http.StatusOK, intoJSONBlock(block))
+		return c.JSON(http.StatusOK, s.intoJSONBlock(block))
 	}
 
 	// otherwise assume its the hash
@@ -115,10 +294,10 @@ func (s *Server) handleGetBlock(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
 	}
 
-	return c.JSON(http.StatusOK, intoJSONBlock(block))
+	return c.JSON(http.StatusOK, s.intoJSONBlock(block))
 }
 
-func intoJSONBlock(block *core.Block) Block {
+func (s *Server) intoJSONBlock(block *core.Block) Block {
 	txResponse := TxResponse{
 		TxCount: uint(len(block.Transactions)),
 		Hashes:  make([]string, len(block.Transactions)),
@@ -128,15 +307,111 @@ func intoJSONBlock(block *core.Block) Block {
 		txResponse.Hashes[i] = block.Transactions[i].Hash(core.TransactionHasher{}).String()
 	}
 
+	// the fees are only known from the receipts, which every block of the chain has
+	fees, _ := s.bc.BlockFees(block)
+
 	return Block{
 		Hash:          block.Hash(core.BlockHasher{}).String(),
 		Version:       block.Header.Version,
 		Height:        block.Header.Height,
 		DataHash:      block.Header.DataHash.String(),
+		StateRoot:     block.Header.StateRoot.String(),
+		ReceiptsRoot:  block.Header.ReceiptsRoot.String(),
 		PrevBlockHash: block.Header.PreviousBlockHash.String(),
 		Timestamp:     block.Header.Timestamp,
 		Validator:     block.Validator.Address().String(),
 		Signature:     block.Signature.String(),
+		Fees:          fees,
+		Reward:        s.bc.BlockReward(block.Header.Height),
 		TxResponse:    txResponse,
 	}
 }
+
+func intoJSONReceipt(receipt *core.Receipt) Receipt {
+	response := Receipt{
+		TxHash:  receipt.TxHash.String(),
+		Status:  uint8(receipt.Status),
+		GasUsed: receipt.GasUsed,
+		Fee:     receipt.Fee,
+		Logs:    make([]Log, len(receipt.Logs)),
+		Error:   receipt.Error,
+	}
+
+	if receipt.ContractAddress != (types.Address{}) {
+		response.ContractAddress = receipt.ContractAddress.String()
+	}
+
+	for i, log := range receipt.Logs {
+		response.Logs[i] = Log{
+			Address: log.Address.String(),
+			Data:    hex.EncodeToString(log.Data),
+		}
+	}
+
+	return response
+}
+
+func intoJSONCallResponse(result *core.ReadOnlyResult) CallResponse {
+	response := CallResponse{
+		Success: result.Err == nil,
+		GasUsed: result.GasUsed,
+		Stack:   make([]Value, len(result.Stack)),
+		Reads:   make([]StorageRead, len(result.Reads)),
+		Logs:    make([]Log, len(result.Logs)),
+	}
+
+	if result.Err != nil {
+		response.Error = result.Err.Error()
+	}
+
+	if result.ReturnValue != nil {
+		value := intoJSONValue(result.ReturnValue)
+		response.ReturnValue = &value
+	}
+
+	for i, value := range result.Stack {
+		response.Stack[i] = intoJSONValue(value)
+	}
+
+	for i, read := range result.Reads {
+		response.Reads[i] = StorageRead{
+			Contract: read.Contract.String(),
+			Key:      hex.EncodeToString(read.Key),
+			Value:    intoJSONValue(read.Value),
+		}
+	}
+
+	for i, log := range result.Logs {
+		response.Logs[i] = Log{
+			Address: log.Address.String(),
+			Data:    hex.EncodeToString(log.Data),
+		}
+	}
+
+	return response
+}
+
+func intoJSONValue(value core.Value) Value {
+	switch v := value.(type) {
+	case core.Word:
+		return Value{Type: "word", Value: v.String()}
+	case core.Bytes:
+		return Value{Type: "bytes", Value: hex.EncodeToString(v)}
+	default:
+		return Value{}
+	}
+}
+
+// parseAddress decodes a hex encoded address
+func parseAddress(s string) (types.Address, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return types.Address{}, err
+	}
+
+	if len(b) != 20 {
+		return types.Address{}, errors.New("address should be 20 bytes long")
+	}
+
+	return types.AddressFromBytes(b), nil
+}
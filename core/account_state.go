@@ -10,11 +10,13 @@ import (
 var (
 	ErrAccountNotFound     = errors.New("account not found")
 	ErrInsufficientBalance = errors.New("insufficient account balance")
+	ErrInvalidNonce        = errors.New("invalid account nonce")
 )
 
 type Account struct {
 	Address types.Address
 	Balance uint64
+	Nonce   uint64 // number of transactions sent from the account, the next transaction has to use it as its nonce
 }
 
 func (a *Account) String() string {
@@ -24,11 +26,14 @@ func (a *Account) String() string {
 type AccountState struct {
 	mu       sync.RWMutex
 	accounts map[types.Address]*Account
+	deleted  map[types.Address]struct{} // accounts deleted from the parent state
+	parent   *AccountState              // If set the state is an overlay on top of the parent state
 }
 
 func NewAccountState() *AccountState {
 	return &AccountState{
 		accounts: make(map[types.Address]*Account),
+		deleted:  make(map[types.Address]struct{}),
 	}
 }
 
@@ -38,29 +43,43 @@ func (s *AccountState) CreateAccount(address types.Address) *Account {
 
 	acc := &Account{Address: address}
 	s.accounts[address] = acc
+	delete(s.deleted, address)
 
 	return acc
 }
 
 func (s *AccountState) GetAccount(address types.Address) (*Account, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	return s.getAccountWithoutLock(address)
 }
 
+// getAccountWithoutLock returns an account of the state. An overlay copies the account of the parent
+// state on first access, so changes of the account stay inside the overlay until it is committed.
 func (s *AccountState) getAccountWithoutLock(address types.Address) (*Account, error) {
-	account, ok := s.accounts[address]
-	if !ok {
+	if account, ok := s.accounts[address]; ok {
+		return account, nil
+	}
+
+	if _, deleted := s.deleted[address]; deleted || s.parent == nil {
 		return nil, ErrAccountNotFound
 	}
 
-	return account, nil
+	account, err := s.parent.GetAccount(address)
+	if err != nil {
+		return nil, err
+	}
+
+	acc := *account
+	s.accounts[address] = &acc
+
+	return &acc, nil
 }
 
 func (s *AccountState) GetBalance(address types.Address) (uint64, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	account, err := s.getAccountWithoutLock(address)
 	if err != nil {
@@ -89,13 +108,184 @@ func (s *AccountState) Transfer(from, to types.Address, amount uint64) error {
 		fromAccount.Balance -= amount
 	}
 
-	if s.accounts[to] == nil {
-		s.accounts[to] = &Account{
+	toAccount, err := s.getAccountWithoutLock(to)
+	if errors.Is(err, ErrAccountNotFound) {
+		toAccount = &Account{
 			Address: to,
 		}
+		s.accounts[to] = toAccount
+		delete(s.deleted, to)
 	}
 
-	s.accounts[to].Balance += amount
+	toAccount.Balance += amount
 
 	return nil
 }
+
+// AddBalance adds the amount to the balance of the account. A missing account is created.
+func (s *AccountState) AddBalance(address types.Address, amount uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.getAccountWithoutLock(address)
+	if errors.Is(err, ErrAccountNotFound) {
+		account = &Account{
+			Address: address,
+		}
+		s.accounts[address] = account
+		delete(s.deleted, address)
+	}
+
+	account.Balance += amount
+}
+
+// SubBalance subtracts the amount from the balance of the account
+func (s *AccountState) SubBalance(address types.Address, amount uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.getAccountWithoutLock(address)
+	if err != nil {
+		return err
+	}
+
+	if account.Balance < amount {
+		return fmt.Errorf("%w: account %s has %d, needs %d", ErrInsufficientBalance, address, account.Balance, amount)
+	}
+
+	account.Balance -= amount
+
+	return nil
+}
+
+// IncrementNonce checks that the nonce is the next nonce of the account and increments the account nonce.
+// An account which does not exist yet expects the nonce 0 and is created.
+func (s *AccountState) IncrementNonce(address types.Address, nonce uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.getAccountWithoutLock(address)
+	if errors.Is(err, ErrAccountNotFound) {
+		account = &Account{
+			Address: address,
+		}
+		s.accounts[address] = account
+		delete(s.deleted, address)
+	}
+
+	if account.Nonce != nonce {
+		return fmt.Errorf("%w: account %s expects nonce %d, got %d", ErrInvalidNonce, address, account.Nonce, nonce)
+	}
+
+	account.Nonce++
+
+	return nil
+}
+
+// overlay returns an empty state on top of this one. Reads fall through to this state,
+// changes are kept inside the overlay until commit is called.
+func (s *AccountState) overlay() *AccountState {
+	state := NewAccountState()
+	state.parent = s
+
+	return state
+}
+
+// commit applies the changes of the overlay to its parent state and clears the overlay
+func (s *AccountState) commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.parent.mu.Lock()
+	defer s.parent.mu.Unlock()
+
+	for address := range s.deleted {
+		s.parent.deleteWithoutLock(address)
+	}
+
+	for address, account := range s.accounts {
+		delete(s.parent.deleted, address)
+
+		// keep the parent accounts in place, they can be referenced from outside
+		if parentAccount, ok := s.parent.accounts[address]; ok {
+			*parentAccount = *account
+			continue
+		}
+
+		acc := *account
+		s.parent.accounts[address] = &acc
+	}
+
+	s.accounts = make(map[types.Address]*Account)
+	s.deleted = make(map[types.Address]struct{})
+}
+
+// all returns every account visible in the state, including the accounts of the parent states
+func (s *AccountState) all() map[types.Address]*Account {
+	accounts := make(map[types.Address]*Account)
+
+	if s.parent != nil {
+		accounts = s.parent.all()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for address := range s.deleted {
+		delete(accounts, address)
+	}
+
+	for address, account := range s.accounts {
+		accounts[address] = account
+	}
+
+	return accounts
+}
+
+// deleteWithoutLock removes the account from the state
+func (s *AccountState) deleteWithoutLock(address types.Address) {
+	delete(s.accounts, address)
+
+	if s.parent != nil {
+		s.deleted[address] = struct{}{}
+	}
+}
+
+// undo returns the accounts of the parent state which are overwritten when the overlay is committed
+func (s *AccountState) undo() map[types.Address]undoEntry[Account] {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make(map[types.Address]undoEntry[Account])
+
+	for _, addresses := range []map[types.Address]struct{}{keySet(s.accounts), s.deleted} {
+		for address := range addresses {
+			entry := undoEntry[Account]{}
+
+			if account, err := s.parent.GetAccount(address); err == nil {
+				entry.value, entry.exists = *account, true
+			}
+
+			entries[address] = entry
+		}
+	}
+
+	return entries
+}
+
+// revert puts the accounts of the undo entries back into the state
+func (s *AccountState) revert(entries map[types.Address]undoEntry[Account]) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for address, entry := range entries {
+		if !entry.exists {
+			s.deleteWithoutLock(address)
+			continue
+		}
+
+		account := entry.value
+		s.accounts[address] = &account
+		delete(s.deleted, address)
+	}
+}
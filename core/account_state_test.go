@@ -51,3 +51,46 @@ func TestTransferSuccessEmpyToAccount(t *testing.T) {
 	assert.Nil(t, state.Transfer(addressBob, addressAlice, amount))
 	assert.Equal(t, accountAlice.Balance, amount)
 }
+
+func TestAccountStateOverlay(t *testing.T) {
+	state := NewAccountState()
+
+	addressBob := crypto.GeneratePrivateKey().PublicKey().Address()
+	addressAlice := crypto.GeneratePrivateKey().PublicKey().Address()
+
+	accountBob := state.CreateAccount(addressBob)
+	accountBob.Balance = 100
+
+	overlay := state.overlay()
+	assert.Nil(t, overlay.Transfer(addressBob, addressAlice, 40))
+
+	balance, err := overlay.GetBalance(addressAlice)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(40), balance)
+
+	// nothing reaches the parent state before the overlay is committed
+	assert.Equal(t, uint64(100), accountBob.Balance)
+	_, err = state.GetAccount(addressAlice)
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+
+	overlay.commit()
+
+	assert.Equal(t, uint64(60), accountBob.Balance)
+	balance, err = state.GetBalance(addressAlice)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(40), balance)
+}
+
+func TestAccountState_IncrementNonce(t *testing.T) {
+	state := NewAccountState()
+	address := crypto.GeneratePrivateKey().PublicKey().Address()
+
+	assert.ErrorIs(t, state.IncrementNonce(address, 1), ErrInvalidNonce)
+	assert.Nil(t, state.IncrementNonce(address, 0))
+	assert.Nil(t, state.IncrementNonce(address, 1))
+	assert.ErrorIs(t, state.IncrementNonce(address, 1), ErrInvalidNonce)
+
+	account, err := state.GetAccount(address)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), account.Nonce)
+}
@@ -0,0 +1,266 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidAssembly = errors.New("invalid assembly")
+
+// mnemonics are the names of the instructions in the assembly language
+var mnemonics = map[Instruction]string{
+	InstructionPushInt:     "PUSH",
+	InstructionPushByte:    "PUSHB",
+	InstructionPack:        "PACK",
+	InstructionAdd:         "ADD",
+	InstructionSub:         "SUB",
+	InstructionMul:         "MUL",
+	InstructionDiv:         "DIV",
+	InstructionStore:       "STORE",
+	InstructionGet:         "GET",
+	InstructionStop:        "STOP",
+	InstructionReturn:      "RETURN",
+	InstructionLt:          "LT",
+	InstructionGt:          "GT",
+	InstructionEq:          "EQ",
+	InstructionNot:         "NOT",
+	InstructionAnd:         "AND",
+	InstructionOr:          "OR",
+	InstructionPop:         "POP",
+	InstructionDup:         "DUP",
+	InstructionSwap:        "SWAP",
+	InstructionJump:        "JUMP",
+	InstructionJumpI:       "JUMPI",
+	InstructionAddress:     "ADDRESS",
+	InstructionBalance:     "BALANCE",
+	InstructionCaller:      "CALLER",
+	InstructionCallValue:   "CALLVALUE",
+	InstructionTimestamp:   "TIMESTAMP",
+	InstructionBlockHeight: "BLOCKHEIGHT",
+	InstructionTxHash:      "TXHASH",
+	InstructionLog:         "LOG",
+	InstructionCall:        "CALL",
+	InstructionStaticCall:  "STATICCALL",
+}
+
+// instructionsByMnemonic is the reverse of mnemonics
+var instructionsByMnemonic = make(map[string]Instruction)
+
+func init() {
+	for instruction, mnemonic := range mnemonics {
+		instructionsByMnemonic[mnemonic] = instruction
+	}
+}
+
+// String returns the mnemonic of the instruction
+func (i Instruction) String() string {
+	if mnemonic, ok := mnemonics[i]; ok {
+		return mnemonic
+	}
+
+	return fmt.Sprintf("INVALID(%#02x)", byte(i))
+}
+
+// asmLine is a single instruction of the assembly source
+type asmLine struct {
+	number      int
+	instruction Instruction
+	operand     string
+}
+
+// Assemble turns assembly source into code for the VirtualMachine. Every line holds at most one
+// instruction, mnemonics are case-insensitive and everything after a ';' is a comment:
+//
+//	.const SIZE 3       ; defines a constant
+//	start:              ; defines a label, which is the address of the next instruction
+//	    PUSH SIZE       ; PUSH and PUSHB take a number, a 'c' character, a constant or a label
+//	    PUSHB 'F'
+//	    PUSH start
+//	    JUMP
+//
+// The operand of a push instruction is placed before the instruction in the code.
+func Assemble(source string) ([]byte, error) {
+	var (
+		lines     []asmLine
+		constants = make(map[string]string)
+		labels    = make(map[string]int)
+		pending   []string // labels waiting for the next instruction
+		size      = 0
+	)
+
+	scanner := bufio.NewScanner(strings.NewReader(source))
+
+	for number := 1; scanner.Scan(); number++ {
+		text, _, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(text)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if strings.HasSuffix(fields[0], ":") {
+			label := strings.TrimSuffix(fields[0], ":")
+
+			if err := defineName(label, labels, constants); err != nil {
+				return nil, fmt.Errorf("%w: line %d: %s", ErrInvalidAssembly, number, err)
+			}
+
+			labels[label] = -1
+			pending = append(pending, label)
+
+			fields = fields[1:]
+			if len(fields) == 0 {
+				continue
+			}
+		}
+
+		if fields[0] == ".const" {
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("%w: line %d: .const needs a name and a value", ErrInvalidAssembly, number)
+			}
+
+			if err := defineName(fields[1], labels, constants); err != nil {
+				return nil, fmt.Errorf("%w: line %d: %s", ErrInvalidAssembly, number, err)
+			}
+
+			constants[fields[1]] = fields[2]
+
+			continue
+		}
+
+		instruction, ok := instructionsByMnemonic[strings.ToUpper(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("%w: line %d: unknown instruction %s", ErrInvalidAssembly, number, fields[0])
+		}
+
+		line := asmLine{number: number, instruction: instruction}
+
+		if isPush(instruction) {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%w: line %d: %s needs one operand", ErrInvalidAssembly, number, instruction)
+			}
+
+			line.operand = fields[1]
+			size++
+		} else if len(fields) != 1 {
+			return nil, fmt.Errorf("%w: line %d: %s takes no operand", ErrInvalidAssembly, number, instruction)
+		}
+
+		// a push starts with its operand, but a jump has to land on the instruction itself
+		for _, label := range pending {
+			labels[label] = size
+		}
+
+		pending = nil
+
+		lines = append(lines, line)
+		size++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// labels at the end point behind the code
+	for _, label := range pending {
+		labels[label] = size
+	}
+
+	code := make([]byte, 0, size)
+
+	for _, line := range lines {
+		if isPush(line.instruction) {
+			operand, err := resolveOperand(line.operand, constants, labels)
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: %s", ErrInvalidAssembly, line.number, err)
+			}
+
+			code = append(code, operand)
+		}
+
+		code = append(code, byte(line.instruction))
+	}
+
+	return code, nil
+}
+
+// Disassemble turns code of the VirtualMachine into assembly source. Every line is commented
+// with the address of the instruction, assembling the result gives the same code again.
+func Disassemble(code []byte) (string, error) {
+	operands, err := analyzeCode(code)
+	if err != nil {
+		return "", err
+	}
+
+	builder := &strings.Builder{}
+
+	for address, b := range code {
+		if operands[address] {
+			continue
+		}
+
+		instruction := Instruction(b)
+		text := instruction.String()
+
+		if isPush(instruction) {
+			text = fmt.Sprintf("%s %d", text, code[address-1])
+		}
+
+		fmt.Fprintf(builder, "%-16s ; %04d\n", text, address)
+	}
+
+	return builder.String(), nil
+}
+
+func isPush(instruction Instruction) bool {
+	return instruction == InstructionPushInt || instruction == InstructionPushByte
+}
+
+// defineName checks that a label or constant name is valid and not defined yet
+func defineName(name string, labels map[string]int, constants map[string]string) error {
+	if len(name) == 0 {
+		return errors.New("empty name")
+	}
+
+	if _, err := strconv.Atoi(name); err == nil {
+		return fmt.Errorf("name %s is a number", name)
+	}
+
+	_, isLabel := labels[name]
+	_, isConstant := constants[name]
+
+	if isLabel || isConstant {
+		return fmt.Errorf("%s is defined twice", name)
+	}
+
+	return nil
+}
+
+// resolveOperand returns the byte of a number, character, constant or label operand
+func resolveOperand(operand string, constants map[string]string, labels map[string]int) (byte, error) {
+	if address, ok := labels[operand]; ok {
+		if address > 0xff {
+			return 0, fmt.Errorf("label %s at %d does not fit into an operand", operand, address)
+		}
+
+		return byte(address), nil
+	}
+
+	if value, ok := constants[operand]; ok {
+		operand = value
+	}
+
+	if len(operand) == 3 && operand[0] == '\'' && operand[2] == '\'' {
+		return operand[1], nil
+	}
+
+	value, err := strconv.ParseUint(operand, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid operand %s", operand)
+	}
+
+	return byte(value), nil
+}
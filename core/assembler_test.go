@@ -0,0 +1,79 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAssemble(t *testing.T) {
+	source := `
+		; stores FOO = 5 in the contract storage
+		.const SIZE 3
+
+		PUSH 5
+		pushb 'F'
+		PUSHB 'O'
+		PUSHB 0x4f  ; the same as 'O'
+		PUSH SIZE
+		PACK
+		STORE
+	`
+
+	code, err := Assemble(source)
+	assert.Nil(t, err)
+	assert.Equal(t, storeFooCode, code)
+}
+
+func TestAssemble_Labels(t *testing.T) {
+	source := `
+		PUSH target     ; a forward reference
+		JUMP
+		STOP
+	target:
+		PUSH 7
+	end: RETURN
+	`
+
+	code, err := Assemble(source)
+	assert.Nil(t, err)
+	// labels point to the instruction, not to the operand of a push
+	assert.Equal(t, []byte{0x05, 0x0a, 0x56, 0x00, 0x07, 0x0a, 0xf3}, code)
+
+	vm := NewVirtualMachine(code, NewState(), 1000)
+	assert.Nil(t, vm.Run())
+	assert.Equal(t, NewWord(7), vm.ReturnValue())
+}
+
+func TestAssemble_Errors(t *testing.T) {
+	tests := map[string]string{
+		"unknown instruction":  "PUSH 1\nFOO",
+		"missing operand":      "PUSH",
+		"unexpected operand":   "ADD 1",
+		"operand too large":    "PUSH 256",
+		"undefined name":       "PUSH foo",
+		"label defined twice":  "a: STOP\na: STOP",
+		"constant and label":   ".const a 1\na: STOP",
+		"numeric name":         "1: STOP",
+		"incomplete constant":  ".const a",
+		"invalid char operand": "PUSHB 'ab'",
+	}
+
+	for name, source := range tests {
+		_, err := Assemble(source)
+		assert.ErrorIs(t, err, ErrInvalidAssembly, name)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	source, err := Disassemble(storeFooCode)
+	assert.Nil(t, err)
+	assert.Contains(t, source, "PUSHB 70")
+	assert.Contains(t, source, "STORE")
+
+	code, err := Assemble(source)
+	assert.Nil(t, err)
+	assert.Equal(t, storeFooCode, code)
+
+	_, err = Disassemble([]byte{0xff})
+	assert.ErrorIs(t, err, ErrInvalidOpcode)
+}
@@ -1,9 +1,6 @@
 package core
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/gob"
 	"fmt"
 	"github.com/evgeniy-dammer/blockchain/crypto"
 	"github.com/evgeniy-dammer/blockchain/types"
@@ -14,20 +11,16 @@ import (
 type Header struct {
 	Version           uint32
 	DataHash          types.Hash
+	StateRoot         types.Hash // Root of the state trie after the block transactions were executed
+	ReceiptsRoot      types.Hash // Root of the trie of the block transaction receipts
 	PreviousBlockHash types.Hash
 	Timestamp         int64
 	Height            uint32
 }
 
-// Bytes returns a block's Header as a slice of bytes
+// Bytes returns the canonical encoding of a block's Header
 func (h *Header) Bytes() []byte {
-	buf := &bytes.Buffer{}
-	enc := gob.NewEncoder(buf)
-	if err := enc.Encode(h); err != nil {
-		return nil
-	}
-
-	return buf.Bytes()
+	return encodeHeader(h)
 }
 
 // Block is a block of transactions
@@ -72,9 +65,11 @@ func (b *Block) AddTransaction(tx *Transaction) {
 	b.Header.DataHash = hash
 }
 
-// Sign signs a Block data
+// Sign signs a Block data. The signature covers the hash of the whole Header.
 func (b *Block) Sign(privateKey crypto.PrivateKey) error {
-	signature, err := privateKey.Sign(b.Header.Bytes())
+	hash := BlockHasher{}.Hash(b.Header)
+
+	signature, err := privateKey.Sign(hash.ToSlice())
 	if err != nil {
 		return err
 	}
@@ -91,7 +86,9 @@ func (b *Block) Verify() error {
 		return fmt.Errorf("block has no signature")
 	}
 
-	if !b.Signature.Verify(b.Validator, b.Header.Bytes()) {
+	hash := BlockHasher{}.Hash(b.Header)
+
+	if !b.Signature.Verify(b.Validator, hash.ToSlice()) {
 		return fmt.Errorf("invalid block signature")
 	}
 
@@ -114,6 +111,24 @@ func (b *Block) Verify() error {
 	return nil
 }
 
+// checkGasLimits checks that every transaction of the block has a gas limit of at most MaxTxGas
+// and that the gas the transactions take up of the block adds up to at most MaxBlockGas
+func (b *Block) checkGasLimits() error {
+	gas := uint64(0)
+
+	for _, tx := range b.Transactions {
+		if err := tx.checkGasLimit(); err != nil {
+			return err
+		}
+
+		if gas += tx.blockGas(); gas > MaxBlockGas {
+			return fmt.Errorf("%w: block %s needs more than %d gas", ErrGasLimitExceeded, b.Hash(BlockHasher{}), MaxBlockGas)
+		}
+	}
+
+	return nil
+}
+
 // Decode decodes a Block
 func (b *Block) Decode(decoder Decoder[*Block]) error {
 	return decoder.Decode(b)
@@ -133,17 +148,35 @@ func (b *Block) Hash(hasher Hasher[*Header]) types.Hash {
 	return b.hash
 }
 
-// CalculateDataHash calculates hash of given transactions
-func CalculateDataHash(transactions []*Transaction) (hash types.Hash, err error) {
-	buf := &bytes.Buffer{}
+// TransactionProof returns a proof that the transaction with the given hash is included in the block
+func (b *Block) TransactionProof(hash types.Hash) (*MerkleProof, error) {
+	hashes := transactionHashes(b.Transactions)
 
-	for _, transaction := range transactions {
-		if err = transaction.Encode(NewGobTransactionEncoder(buf)); err != nil {
-			return
+	for i, txHash := range hashes {
+		if txHash == hash {
+			return NewMerkleProof(hashes, i)
 		}
 	}
 
-	hash = sha256.Sum256(buf.Bytes())
+	return nil, fmt.Errorf("transaction %s is not included in block %s", hash, b.Hash(BlockHasher{}))
+}
+
+// VerifyTransactionProof checks that the transaction with the given hash is included in the block with the given header
+func VerifyTransactionProof(header *Header, hash types.Hash, proof *MerkleProof) bool {
+	return proof.Verify(header.DataHash, hash)
+}
+
+// CalculateDataHash calculates hash of given transactions as the root of the Merkle tree over their hashes
+func CalculateDataHash(transactions []*Transaction) (hash types.Hash, err error) {
+	return MerkleRoot(transactionHashes(transactions)), nil
+}
+
+func transactionHashes(transactions []*Transaction) []types.Hash {
+	hashes := make([]types.Hash, len(transactions))
+
+	for i, transaction := range transactions {
+		hashes[i] = TransactionHasher{}.Hash(transaction)
+	}
 
-	return
+	return hashes
 }
@@ -0,0 +1,268 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/types"
+)
+
+// maxReorgDepth is the number of blocks below the head which can be reverted by a reorganisation
+const maxReorgDepth = 128
+
+var (
+	ErrUnknownParent = errors.New("parent block not known")
+	ErrReorgTooDeep  = errors.New("reorganisation too deep")
+)
+
+// blockNode is a block inside the block tree. The tree keeps every known block, the canonical
+// chain is the branch from the genesis block to the head chosen by the fork choice rule.
+type blockNode struct {
+	block    *Block
+	hash     types.Hash
+	parent   *blockNode
+	weight   uint64     // accumulated weight of the branch ending with this block
+	undo     *stateUndo // reverts the state changes of the block, kept while the block is near the canonical head
+	receipts []*Receipt // receipts of the block transactions, set once the block is executed
+}
+
+// newBlockNode is a constructor for the blockNode
+func (bc *Blockchain) newBlockNode(block *Block, parent *blockNode) *blockNode {
+	node := &blockNode{
+		block:  block,
+		hash:   block.Hash(BlockHasher{}),
+		parent: parent,
+		weight: bc.forkChoice.Weight(block),
+	}
+
+	if parent != nil {
+		node.weight += parent.weight
+	}
+
+	return node
+}
+
+// tip describes the branch ending with the node
+func (n *blockNode) tip() ChainTip {
+	return ChainTip{
+		Hash:   n.hash,
+		Height: n.block.Header.Height,
+		Weight: n.weight,
+	}
+}
+
+// isCanonical checks if the node is part of the canonical chain. Must be called with lock held.
+func (bc *Blockchain) isCanonical(node *blockNode) bool {
+	height := node.block.Header.Height
+
+	return int(height) < len(bc.blocks) && bc.blocks[height] == node.block
+}
+
+// forkPoint returns the block of the canonical chain the branch of the node forks off. Must be called with lock held.
+func (bc *Blockchain) forkPoint(node *blockNode) *blockNode {
+	for !bc.isCanonical(node) {
+		node = node.parent
+	}
+
+	return node
+}
+
+// checkForkDepth checks that a block on top of the given parent forks off the canonical chain at most
+// maxReorgDepth blocks below the head, and above the oldest block which still has its undo data.
+// The chain can never switch to a branch which forks off deeper.
+func (bc *Blockchain) checkForkDepth(parentHash types.Hash) error {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	parent, ok := bc.tree[parentHash]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownParent, parentHash)
+	}
+
+	fork := bc.forkPoint(parent)
+	if depth := bc.head.block.Header.Height - fork.block.Header.Height; depth > maxReorgDepth {
+		return fmt.Errorf("%w: branch forks off %d blocks below the head", ErrReorgTooDeep, depth)
+	}
+
+	// After a restart the blocks up to the state snapshot have no undo data, so they cannot be reverted
+	for node := bc.head; node != fork; node = node.parent {
+		if node.undo == nil {
+			return fmt.Errorf("%w: block %s at height %d cannot be reverted", ErrReorgTooDeep, node.hash, node.block.Header.Height)
+		}
+	}
+
+	return nil
+}
+
+// pruneSideBranches drops the blocks of side branches which fork off the canonical chain more than
+// maxReorgDepth blocks below the head, the chain cannot switch to them anymore. Must be called with lock held.
+func (bc *Blockchain) pruneSideBranches() {
+	height := bc.head.block.Header.Height
+	if height <= maxReorgDepth {
+		return
+	}
+
+	for hash, node := range bc.sideNodes {
+		if bc.forkPoint(node).block.Header.Height < height-maxReorgDepth {
+			delete(bc.tree, hash)
+			delete(bc.sideNodes, hash)
+		}
+	}
+}
+
+// reorganize switches the canonical chain to the branch ending with the given block. The blocks of the
+// current chain down to the fork point are reverted with their undo data, then the blocks of the new branch
+// are executed and their state roots checked. Everything happens on an overlay of the state, so if a block
+// of the new branch is invalid the current chain stays untouched and the invalid blocks are dropped.
+func (bc *Blockchain) reorganize(tip *blockNode) error {
+	bc.lock.RLock()
+
+	var (
+		head     = bc.head
+		fork     = tip
+		branch   []*blockNode
+		reverted []*blockNode
+	)
+
+	for ; !bc.isCanonical(fork); fork = fork.parent {
+		branch = append([]*blockNode{fork}, branch...)
+	}
+
+	bc.lock.RUnlock()
+
+	for node := head; node != fork; node = node.parent {
+		if node.undo == nil {
+			return fmt.Errorf("%w: cannot revert block %s", ErrReorgTooDeep, node.hash)
+		}
+
+		reverted = append(reverted, node)
+	}
+
+	orphaned, err := bc.switchBranch(fork, branch, reverted)
+	if err != nil {
+		return err
+	}
+
+	bc.logger.Log(
+		"msg", "chain reorganised",
+		"fork", fork.block.Header.Height,
+		"reverted", len(reverted),
+		"applied", len(branch),
+		"height", tip.block.Header.Height,
+		"hash", tip.hash,
+		"orphaned", len(orphaned),
+	)
+
+	bc.lock.RLock()
+	handler := bc.reorgHandler
+	bc.lock.RUnlock()
+
+	if handler != nil && len(orphaned) > 0 {
+		handler(orphaned)
+	}
+
+	return nil
+}
+
+// switchBranch reverts the blocks down to the fork point and applies the new branch on top of it.
+// It returns the transactions of the reverted blocks which are not part of the new branch.
+func (bc *Blockchain) switchBranch(fork *blockNode, branch, reverted []*blockNode) ([]*Transaction, error) {
+	bc.stateLock.Lock()
+	defer bc.stateLock.Unlock()
+
+	state := bc.state().overlay()
+	for _, node := range reverted {
+		state.revert(node.undo)
+	}
+
+	undos := make([]*stateUndo, len(branch))
+	receipts := make([][]*Receipt, len(branch))
+
+	for i, node := range branch {
+		blockState := state.overlay()
+
+		var err error
+
+		receipts[i], err = bc.executeTransactions(blockState, node.block)
+		if err == nil && blockState.root() != node.block.Header.StateRoot {
+			err = fmt.Errorf("block %s has invalid state root %s, expected %s", node.hash, node.block.Header.StateRoot, blockState.root())
+		}
+
+		if err == nil && ReceiptsRoot(receipts[i]) != node.block.Header.ReceiptsRoot {
+			err = fmt.Errorf("block %s has invalid receipts root %s, expected %s", node.hash, node.block.Header.ReceiptsRoot, ReceiptsRoot(receipts[i]))
+		}
+
+		if err != nil {
+			bc.discardBlock(node)
+			return nil, err
+		}
+
+		undos[i] = blockState.undo()
+		blockState.commit()
+	}
+
+	for i, node := range branch {
+		if err := bc.store.Put(node.block, receipts[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Snapshots are only taken for blocks added on top of the head, the next one covers the new branch.
+	state.commit()
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	bc.headers = bc.headers[:fork.block.Header.Height+1]
+	bc.blocks = bc.blocks[:fork.block.Header.Height+1]
+
+	for _, node := range reverted {
+		node.undo = nil
+		node.receipts = nil
+		bc.sideNodes[node.hash] = node
+
+		for _, tx := range node.block.Transactions {
+			delete(bc.txStore, tx.Hash(TransactionHasher{}))
+			delete(bc.receiptStore, tx.Hash(TransactionHasher{}))
+		}
+	}
+
+	for i, node := range branch {
+		node.undo = undos[i]
+		node.receipts = receipts[i]
+		delete(bc.sideNodes, node.hash)
+		bc.appendBlockWithoutLock(node)
+	}
+
+	// Transactions of the reverted blocks which are not part of the new branch go back to the pool
+	orphaned := []*Transaction{}
+
+	for _, node := range reverted {
+		for _, tx := range node.block.Transactions {
+			if _, ok := bc.txStore[tx.Hash(TransactionHasher{})]; !ok {
+				orphaned = append(orphaned, tx)
+			}
+		}
+	}
+
+	return orphaned, nil
+}
+
+// discardBlock removes an invalid block and all blocks built on top of it from the block tree
+func (bc *Blockchain) discardBlock(invalid *blockNode) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	height := invalid.block.Header.Height
+
+	for hash, node := range bc.tree {
+		for ancestor := node; ancestor != nil && ancestor.block.Header.Height >= height; ancestor = ancestor.parent {
+			if ancestor == invalid {
+				delete(bc.tree, hash)
+				delete(bc.sideNodes, hash)
+				break
+			}
+		}
+	}
+
+	bc.logger.Log("msg", "discarded invalid block", "height", height, "hash", invalid.hash)
+}
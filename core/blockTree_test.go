@@ -0,0 +1,257 @@
+package core
+
+import (
+	"github.com/evgeniy-dammer/blockchain/crypto"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// newForkedBlockchains returns two blockchains with the same genesis block and the same funded account,
+// so each of them can build its own branch
+func newForkedBlockchains(t *testing.T, options BlockchainOptions) (*Blockchain, *Blockchain, crypto.PrivateKey) {
+	genesis := randomBlock(t, 0, types.Hash{})
+	privateKey := crypto.GeneratePrivateKey()
+
+	a, err := NewBlockchainWithOptions(genesis, options)
+	assert.Nil(t, err)
+
+	b, err := NewBlockchainWithOptions(genesis, BlockchainOptions{Logger: log.NewNopLogger(), ForkChoice: options.ForkChoice})
+	assert.Nil(t, err)
+
+	for _, bc := range []*Blockchain{a, b} {
+		fundAccount(bc, privateKey.PublicKey().Address(), 100)
+	}
+
+	return a, b, privateKey
+}
+
+// transferBlock returns a block on top of the blockchain head which transfers the value to the given key
+func transferBlock(t *testing.T, bc *Blockchain, from crypto.PrivateKey, to crypto.PublicKey, value uint64) *Block {
+	block := randomBlock(t, bc.Height()+1, getPreviousBlockHash(t, bc, bc.Height()+1))
+
+	tx := NewTransaction(nil)
+	tx.To = to
+	tx.Value = value
+	tx.Nonce = bc.NextNonce(from.PublicKey().Address())
+	assert.Nil(t, tx.Sign(from))
+
+	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
+
+	return block
+}
+
+func TestBlockchain_ReorgToLongerBranch(t *testing.T) {
+	a, b, privKeyBob := newForkedBlockchains(t, BlockchainOptions{Logger: log.NewNopLogger()})
+
+	orphaned := []*Transaction{}
+	a.SetReorgHandler(func(transactions []*Transaction) {
+		orphaned = append(orphaned, transactions...)
+	})
+
+	alice := crypto.GeneratePrivateKey().PublicKey()
+	carol := crypto.GeneratePrivateKey().PublicKey()
+
+	blockA1 := transferBlock(t, a, privKeyBob, alice, 10)
+	assert.Nil(t, a.AddBlock(blockA1))
+
+	blockB1 := transferBlock(t, b, privKeyBob, carol, 20)
+	assert.Nil(t, b.AddBlock(blockB1))
+	blockB2 := randomChainBlock(t, b, 2)
+	assert.Nil(t, b.AddBlock(blockB2))
+
+	// a competing block at the same height is kept on a side branch
+	assert.Nil(t, a.AddBlock(blockB1))
+	assert.ErrorIs(t, a.AddBlock(blockB1), ErrBlockKnown)
+	assert.Equal(t, uint32(1), a.Height())
+	assert.Equal(t, blockA1.Hash(BlockHasher{}), a.HeadHash())
+
+	sideBlock, err := a.GetBlockByHash(blockB1.Hash(BlockHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, blockB1, sideBlock)
+
+	// the side branch becomes longer, so the chain switches over
+	assert.Nil(t, a.AddBlock(blockB2))
+	assert.Equal(t, uint32(2), a.Height())
+	assert.Equal(t, blockB2.Hash(BlockHasher{}), a.HeadHash())
+	assert.Equal(t, b.StateRoot(), a.StateRoot())
+
+	block, err := a.GetBlock(1)
+	assert.Nil(t, err)
+	assert.Equal(t, blockB1, block)
+
+	_, err = a.accountState.GetAccount(alice.Address())
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+
+	balance, err := a.accountState.GetBalance(carol.Address())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(20), balance)
+
+	// the transactions of the reverted block are handed back
+	assert.Equal(t, blockA1.Transactions, orphaned)
+
+	_, err = a.GetTransactionByHash(blockA1.Transactions[0].Hash(TransactionHasher{}))
+	assert.NotNil(t, err)
+}
+
+func TestBlockchain_RestoreBlockTree(t *testing.T) {
+	store, err := NewDiskStore(t.TempDir())
+	assert.Nil(t, err)
+	defer store.Close()
+
+	options := BlockchainOptions{Logger: log.NewNopLogger(), Storage: store}
+	a, b, _ := newForkedBlockchains(t, options)
+
+	blockA1 := randomChainBlock(t, a, 1)
+	assert.Nil(t, a.AddBlock(blockA1))
+
+	for i := uint32(1); i <= 2; i++ {
+		block := randomChainBlock(t, b, i)
+		assert.Nil(t, b.AddBlock(block))
+		assert.Nil(t, a.AddBlock(block))
+	}
+
+	genesis, err := a.GetBlock(0)
+	assert.Nil(t, err)
+
+	// the stored block tree leads to the same head and keeps the reverted block
+	restored, err := NewBlockchainWithOptions(genesis, options)
+	assert.Nil(t, err)
+	assert.Equal(t, b.HeadHash(), restored.HeadHash())
+	assert.Equal(t, uint32(2), restored.Height())
+	assert.True(t, restored.HasBlockWithHash(blockA1.Hash(BlockHasher{})))
+}
+
+func TestBlockchain_ReorgToInvalidBranch(t *testing.T) {
+	a, b, privKeyBob := newForkedBlockchains(t, BlockchainOptions{Logger: log.NewNopLogger()})
+
+	blockA1 := transferBlock(t, a, privKeyBob, crypto.GeneratePrivateKey().PublicKey(), 10)
+	assert.Nil(t, a.AddBlock(blockA1))
+	root := a.StateRoot()
+
+	blockB1 := transferBlock(t, b, privKeyBob, crypto.GeneratePrivateKey().PublicKey(), 20)
+	assert.Nil(t, b.AddBlock(blockB1))
+
+	blockB2 := transferBlock(t, b, privKeyBob, crypto.GeneratePrivateKey().PublicKey(), 30)
+	blockB2.Header.StateRoot = types.Hash{0x01}
+	assert.Nil(t, blockB2.Sign(crypto.GeneratePrivateKey()))
+
+	assert.Nil(t, a.AddBlock(blockB1))
+	assert.NotNil(t, a.AddBlock(blockB2))
+
+	assert.Equal(t, uint32(1), a.Height())
+	assert.Equal(t, blockA1.Hash(BlockHasher{}), a.HeadHash())
+	assert.Equal(t, root, a.StateRoot())
+
+	// the invalid block is dropped, its valid parent stays on the side branch
+	assert.False(t, a.HasBlockWithHash(blockB2.Hash(BlockHasher{})))
+	assert.True(t, a.HasBlockWithHash(blockB1.Hash(BlockHasher{})))
+
+	assert.ErrorIs(t, a.AddBlock(randomBlock(t, 3, blockB2.Hash(BlockHasher{}))), ErrUnknownParent)
+}
+
+func TestBlockchain_ForkTooDeep(t *testing.T) {
+	a, b, _ := newForkedBlockchains(t, BlockchainOptions{Logger: log.NewNopLogger()})
+
+	blockB1 := randomChainBlock(t, b, 1)
+	assert.Nil(t, b.AddBlock(blockB1))
+
+	assert.Nil(t, a.AddBlock(randomChainBlock(t, a, 1)))
+	assert.Nil(t, a.AddBlock(blockB1))
+
+	// the side branch is kept while the chain may still switch to it
+	for i := uint32(2); i <= maxReorgDepth; i++ {
+		assert.Nil(t, a.AddBlock(randomChainBlock(t, a, i)))
+	}
+
+	assert.True(t, a.HasBlockWithHash(blockB1.Hash(BlockHasher{})))
+
+	// once it forks off too deep it is dropped and not accepted again
+	assert.Nil(t, a.AddBlock(randomChainBlock(t, a, maxReorgDepth+1)))
+	assert.False(t, a.HasBlockWithHash(blockB1.Hash(BlockHasher{})))
+	assert.ErrorIs(t, a.AddBlock(blockB1), ErrReorgTooDeep)
+}
+
+func TestBlockchain_ForkBelowSnapshot(t *testing.T) {
+	snapshots, err := NewDiskSnapshotStore(t.TempDir(), 0)
+	assert.Nil(t, err)
+
+	options := BlockchainOptions{Logger: log.NewNopLogger(), Storage: NewMemoryStore(), Snapshots: snapshots, SnapshotInterval: 5}
+	genesis := randomBlock(t, 0, types.Hash{})
+
+	bc, err := NewBlockchainWithOptions(genesis, options)
+	assert.Nil(t, err)
+
+	for i := uint32(1); i <= 7; i++ {
+		assert.Nil(t, bc.AddBlock(randomChainBlock(t, bc, i)))
+	}
+
+	restored, err := NewBlockchainWithOptions(genesis, options)
+	assert.Nil(t, err)
+	assert.Equal(t, bc.HeadHash(), restored.HeadHash())
+
+	// only the blocks replayed on top of the snapshot can be reverted
+	fork := randomBlock(t, 5, getPreviousBlockHash(t, restored, 5))
+	assert.Nil(t, fork.Sign(crypto.GeneratePrivateKey()))
+	assert.ErrorIs(t, restored.AddBlock(fork), ErrReorgTooDeep)
+
+	fork = randomBlock(t, 6, getPreviousBlockHash(t, restored, 6))
+	assert.Nil(t, fork.Sign(crypto.GeneratePrivateKey()))
+	assert.Nil(t, restored.AddBlock(fork))
+}
+
+func TestBlockchain_RestoreTrimsUndo(t *testing.T) {
+	options := BlockchainOptions{Logger: log.NewNopLogger(), Storage: NewMemoryStore()}
+	genesis := randomBlock(t, 0, types.Hash{})
+
+	bc, err := NewBlockchainWithOptions(genesis, options)
+	assert.Nil(t, err)
+
+	for i := uint32(1); i <= maxReorgDepth+10; i++ {
+		assert.Nil(t, bc.AddBlock(randomChainBlock(t, bc, i)))
+	}
+
+	// the replayed blocks keep their undo data only as long as a reorganisation can revert them
+	restored, err := NewBlockchainWithOptions(genesis, options)
+	assert.Nil(t, err)
+
+	withUndo := 0
+	for _, node := range restored.tree {
+		if node.undo != nil {
+			withUndo++
+		}
+	}
+
+	assert.Equal(t, maxReorgDepth, withUndo)
+	assert.NotNil(t, restored.head.undo)
+}
+
+func TestBlockchain_HeaviestChain(t *testing.T) {
+	a, b, _ := newForkedBlockchains(t, BlockchainOptions{Logger: log.NewNopLogger(), ForkChoice: HeaviestChain{}})
+
+	for i := uint32(1); i <= 2; i++ {
+		assert.Nil(t, a.AddBlock(randomChainBlock(t, a, i)))
+	}
+
+	// a single block with many transactions outweighs the longer branch
+	block := randomBlock(t, 1, getPreviousBlockHash(t, b, 1))
+	for i := 0; i < 4; i++ {
+		block.AddTransaction(randomTransactionWithSignature(t))
+	}
+
+	sealBlock(t, b, block)
+	assert.Nil(t, b.AddBlock(block))
+
+	assert.Nil(t, a.AddBlock(block))
+	assert.Equal(t, uint32(1), a.Height())
+	assert.Equal(t, block.Hash(BlockHasher{}), a.HeadHash())
+}
+
+func TestLongestChain_Better(t *testing.T) {
+	current := ChainTip{Height: 2, Weight: 10}
+
+	assert.True(t, LongestChain{}.Better(ChainTip{Height: 3, Weight: 1}, current))
+	assert.False(t, LongestChain{}.Better(ChainTip{Height: 2, Weight: 20}, current))
+}
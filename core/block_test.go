@@ -65,3 +65,11 @@ func TestBlock_EncodeDecode(t *testing.T) {
 	assert.Nil(t, bDecode.Decode(NewGobBlockDecoder(buf)))
 	assert.Equal(t, b, bDecode)
 }
+
+func TestBlock_VerifyHeaderTamper(t *testing.T) {
+	block := randomBlock(t, 0, types.Hash{})
+	assert.Nil(t, block.Verify())
+
+	block.Header.StateRoot = types.Hash{0x01}
+	assert.NotNil(t, block.Verify())
+}
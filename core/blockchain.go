@@ -1,35 +1,89 @@
 package core
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/evgeniy-dammer/blockchain/crypto"
 	"github.com/evgeniy-dammer/blockchain/types"
 	"github.com/go-kit/log"
+	"sort"
 	"sync"
 )
 
+// defaultGasPrice is the price of a unit of gas if the options do not set one
+const defaultGasPrice = 1
+
 // Blockchain
 type Blockchain struct {
 	logger          log.Logger
 	store           Storage
 	lock            sync.RWMutex
+	addLock         sync.Mutex // serialises adding blocks, the head must not change while a block is validated
 	headers         []*Header
 	blocks          []*Block
+	tree            map[types.Hash]*blockNode
+	sideNodes       map[types.Hash]*blockNode // blocks of the tree which are not part of the canonical chain
+	head            *blockNode
+	forkChoice      ForkChoice
+	chainID         uint32
+	reorgHandler    func(orphaned []*Transaction)
 	txStore         map[types.Hash]*Transaction
-	blockStore      map[types.Hash]*Block
+	receiptStore    map[types.Hash]*Receipt
 	accountState    *AccountState
 	stateLock       sync.RWMutex
-	collectionState map[types.Hash]*CollectionTx
-	mintState       map[types.Hash]*MintTx
+	collectionState *overlayMap[types.Hash, *CollectionTx]
+	mintState       *overlayMap[types.Hash, *MintTx]
 	validator       Validator
 	contractState   *State
+	stateTrie       *Trie // the trie of the current state, updated whenever an overlay is committed to the state
+	snapshots       SnapshotStore
+	snapshotEvery   uint32
+	blockReward     uint64
+	gasPrice        uint64
+}
+
+// BlockchainOptions
+type BlockchainOptions struct {
+	Logger           log.Logger
+	Storage          Storage
+	Snapshots        SnapshotStore // If set the state is saved every SnapshotInterval blocks and restored on startup
+	SnapshotInterval uint32
+	ForkChoice       ForkChoice // Decides which branch is the canonical chain, defaults to LongestChain
+	ChainID          uint32     // Only transactions signed for this chain are accepted
+	BlockReward      uint64     // Paid to the validator of every block after the genesis block on top of the transaction fees
+	GasPrice         uint64     // Paid by the sender for every unit of gas its transaction uses, defaults to defaultGasPrice
 }
 
-// NewBlockchain is a constructor for the Blockchain
+// NewBlockchain is a constructor for the Blockchain which keeps blocks in memory
 func NewBlockchain(logger log.Logger, genesis *Block) (*Blockchain, error) {
-	// We should create all states inside the scope of the new blockchain.
+	return NewBlockchainWithOptions(genesis, BlockchainOptions{Logger: logger})
+}
+
+// NewBlockchainWithOptions is a constructor for the Blockchain. If the storage already contains blocks
+// the chain is restored from it, otherwise the chain starts from the given genesis block.
+func NewBlockchainWithOptions(genesis *Block, options BlockchainOptions) (*Blockchain, error) {
+	if options.Logger == nil {
+		options.Logger = log.NewNopLogger()
+	}
+
+	if options.Storage == nil {
+		options.Storage = NewMemoryStore()
+	}
 
-	// TODO: read this from disk later on
+	if options.SnapshotInterval == 0 {
+		options.SnapshotInterval = defaultSnapshotInterval
+	}
+
+	if options.ForkChoice == nil {
+		options.ForkChoice = LongestChain{}
+	}
+
+	if options.GasPrice == 0 {
+		options.GasPrice = defaultGasPrice
+	}
+
+	// We should create all states inside the scope of the new blockchain.
+	// They are replaced by the latest state snapshot when the chain is restored from storage.
 	accountState := NewAccountState()
 
 	coinbase := crypto.PublicKey{}
@@ -38,33 +92,316 @@ func NewBlockchain(logger log.Logger, genesis *Block) (*Blockchain, error) {
 
 	blockchain := &Blockchain{
 		headers:         []*Header{},
-		store:           NewMemoryStore(),
-		logger:          logger,
+		store:           options.Storage,
+		logger:          options.Logger,
 		accountState:    accountState,
-		blockStore:      make(map[types.Hash]*Block),
+		tree:            make(map[types.Hash]*blockNode),
+		sideNodes:       make(map[types.Hash]*blockNode),
+		forkChoice:      options.ForkChoice,
+		chainID:         options.ChainID,
 		txStore:         make(map[types.Hash]*Transaction),
-		collectionState: make(map[types.Hash]*CollectionTx),
-		mintState:       make(map[types.Hash]*MintTx),
+		receiptStore:    make(map[types.Hash]*Receipt),
+		collectionState: newOverlayMap[types.Hash, *CollectionTx](),
+		mintState:       newOverlayMap[types.Hash, *MintTx](),
 		contractState:   NewState(),
+		snapshots:       options.Snapshots,
+		snapshotEvery:   options.SnapshotInterval,
+		blockReward:     options.BlockReward,
+		gasPrice:        options.GasPrice,
 	}
 
+	blockchain.stateTrie = blockchain.state().buildTrie()
 	blockchain.validator = NewBlockValidator(blockchain)
 
-	err := blockchain.addBlockWithoutValidation(genesis)
+	if err := blockchain.load(genesis); err != nil {
+		return nil, err
+	}
+
+	return blockchain, nil
+}
+
+// load restores the blockchain from its storage. An empty storage is initialised with the genesis block.
+// The stored blocks form the block tree, the fork choice rule picks the canonical chain among its branches.
+// The state is restored from the latest snapshot which belongs to the canonical chain, only blocks after
+// that snapshot are executed again.
+func (bc *Blockchain) load(genesis *Block) error {
+	var nodes []*blockNode
+
+	err := bc.store.Iterate(func(block *Block) error {
+		hash := block.Hash(BlockHasher{})
+
+		if len(nodes) == 0 {
+			if genesisHash := genesis.Hash(BlockHasher{}); hash != genesisHash {
+				return fmt.Errorf("stored genesis block %s does not match genesis block %s", hash, genesisHash)
+			}
+
+			nodes = append(nodes, bc.newBlockNode(block, nil))
+			bc.tree[hash] = nodes[0]
+
+			return nil
+		}
+
+		parent, ok := bc.tree[block.Header.PreviousBlockHash]
+		if !ok || block.Header.Height != parent.block.Header.Height+1 {
+			return fmt.Errorf("%w: block %s does not extend a stored block", ErrCorruptedStore, hash)
+		}
+
+		node := bc.newBlockNode(block, parent)
+		nodes = append(nodes, node)
+		bc.tree[hash] = node
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(nodes) == 0 {
+		return bc.addBlockWithoutValidation(genesis)
+	}
+
+	// Blocks are iterated in the order they were stored, so on a tie the branch seen first wins
+	head := nodes[0]
+	for _, node := range nodes {
+		if bc.forkChoice.Better(node.tip(), head.tip()) {
+			head = node
+		}
+	}
+
+	chain := []*blockNode{}
+	for node := head; node != nil; node = node.parent {
+		chain = append([]*blockNode{node}, chain...)
+	}
+
+	for _, node := range chain {
+		bc.appendBlock(node)
+	}
+
+	bc.lock.Lock()
+	for _, node := range nodes {
+		if !bc.isCanonical(node) {
+			bc.sideNodes[node.hash] = node
+		}
+	}
+
+	bc.pruneSideBranches()
+	bc.lock.Unlock()
+
+	from, err := bc.restoreSnapshot()
+	if err != nil {
+		return err
+	}
+
+	// The blocks up to the snapshot are not executed again, their receipts were stored with them
+	for _, node := range chain[:from] {
+		if node.receipts, err = bc.store.GetReceipts(node.hash); err != nil {
+			return err
+		}
+
+		bc.lock.Lock()
+		bc.storeReceipts(node)
+		bc.lock.Unlock()
+	}
+
+	for _, node := range chain[from:] {
+		if err = bc.executeBlock(node, nil); err != nil {
+			return err
+		}
+
+		bc.lock.Lock()
+		bc.storeReceipts(node)
+		bc.lock.Unlock()
+	}
+
+	// The blocks were appended before they were executed, so their undo data is trimmed only now
+	if len(chain) > maxReorgDepth {
+		bc.lock.Lock()
+		for _, node := range chain[:len(chain)-maxReorgDepth] {
+			node.undo = nil
+		}
+		bc.lock.Unlock()
+	}
+
+	bc.logger.Log("msg", "blockchain restored from storage", "height", bc.Height(), "replayed", len(chain)-int(from))
+
+	return nil
+}
+
+// restoreSnapshot loads the latest snapshot which matches the stored chain and returns
+// the height of the first block that has to be executed on top of it.
+func (bc *Blockchain) restoreSnapshot() (uint32, error) {
+	if bc.snapshots == nil {
+		return 0, nil
+	}
+
+	heights, err := bc.snapshots.Heights()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := len(heights) - 1; i >= 0; i-- {
+		height := heights[i]
+		if height > bc.Height() {
+			continue
+		}
+
+		snapshot, err := bc.snapshots.Get(height)
+		if err != nil {
+			bc.logger.Log("msg", "skipping state snapshot", "height", height, "err", err)
+			continue
+		}
 
-	return blockchain, err
+		if snapshot.BlockHash != bc.blocks[height].Hash(BlockHasher{}) {
+			bc.logger.Log("msg", "skipping state snapshot of another chain", "height", height, "hash", snapshot.BlockHash)
+			continue
+		}
+
+		if err = bc.restoreState(snapshot, bc.blocks[height].Header.StateRoot); err != nil {
+			bc.logger.Log("msg", "skipping state snapshot", "height", height, "err", err)
+			continue
+		}
+
+		return height + 1, nil
+	}
+
+	return 0, nil
+}
+
+// restoreState replaces the whole state with the content of the snapshot. The state is left
+// untouched if the snapshot does not match the given state root.
+func (bc *Blockchain) restoreState(snapshot *StateSnapshot, stateRoot types.Hash) error {
+	state := &worldState{
+		accountState:    NewAccountState(),
+		contractState:   NewState(),
+		collectionState: newOverlayMap[types.Hash, *CollectionTx](),
+		mintState:       newOverlayMap[types.Hash, *MintTx](),
+	}
+
+	for i := range snapshot.Accounts {
+		account := snapshot.Accounts[i]
+		state.accountState.accounts[account.Address] = &account
+	}
+
+	for key, value := range snapshot.Contract {
+		state.contractState.put(key, value)
+	}
+
+	for hash, collection := range snapshot.Collections {
+		state.collectionState.put(hash, collection)
+	}
+
+	for hash, mint := range snapshot.Mints {
+		state.mintState.put(hash, mint)
+	}
+
+	trie := state.buildTrie()
+	if trie.Hash() != stateRoot {
+		return fmt.Errorf("snapshot has state root %s, expected %s", trie.Hash(), stateRoot)
+	}
+
+	bc.stateLock.Lock()
+	defer bc.stateLock.Unlock()
+
+	bc.accountState = state.accountState
+	bc.contractState = state.contractState
+	bc.collectionState = state.collectionState
+	bc.mintState = state.mintState
+	bc.stateTrie = trie
+
+	return nil
+}
+
+// takeSnapshot copies the whole state after the given block was executed. Must be called with stateLock held.
+func (bc *Blockchain) takeSnapshot(block *Block) *StateSnapshot {
+	snapshot := &StateSnapshot{
+		Height:      block.Header.Height,
+		BlockHash:   block.Hash(BlockHasher{}),
+		Contract:    bc.contractState.all(),
+		Collections: bc.collectionState.all(),
+		Mints:       bc.mintState.all(),
+	}
+
+	for _, account := range bc.accountState.all() {
+		snapshot.Accounts = append(snapshot.Accounts, *account)
+	}
+
+	sort.Slice(snapshot.Accounts, func(i, j int) bool {
+		return bytes.Compare(snapshot.Accounts[i].Address.ToSlice(), snapshot.Accounts[j].Address.ToSlice()) < 0
+	})
+
+	return snapshot
 }
 
 func (bc *Blockchain) GetBlockByHash(hash types.Hash) (*Block, error) {
 	bc.lock.Lock()
 	defer bc.lock.Unlock()
 
-	block, ok := bc.blockStore[hash]
+	node, ok := bc.tree[hash]
+	if !ok {
+		return nil, fmt.Errorf("block with hash (%s) not found", hash)
+	}
+
+	return node.block, nil
+}
+
+// GetHeaderByHash returns the header of a known block, including blocks of side branches
+func (bc *Blockchain) GetHeaderByHash(hash types.Hash) (*Header, error) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	node, ok := bc.tree[hash]
 	if !ok {
 		return nil, fmt.Errorf("block with hash (%s) not found", hash)
 	}
 
-	return block, nil
+	return node.block.Header, nil
+}
+
+// HasBlockWithHash checks if the block is known, either on the canonical chain or on a side branch
+func (bc *Blockchain) HasBlockWithHash(hash types.Hash) bool {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	_, ok := bc.tree[hash]
+
+	return ok
+}
+
+// HeadHash returns the hash of the last block of the canonical chain
+func (bc *Blockchain) HeadHash() types.Hash {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	return bc.head.hash
+}
+
+// GetReceipt returns the receipt of a transaction of the canonical chain
+func (bc *Blockchain) GetReceipt(hash types.Hash) (*Receipt, error) {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+
+	receipt, ok := bc.receiptStore[hash]
+	if !ok {
+		return nil, fmt.Errorf("could not find receipt of tx with hash (%s)", hash)
+	}
+
+	return receipt, nil
+}
+
+// BlockFees returns the sum of the fees the transactions of a block of the canonical chain paid to its validator
+func (bc *Blockchain) BlockFees(block *Block) (uint64, error) {
+	fees := uint64(0)
+
+	for _, tx := range block.Transactions {
+		receipt, err := bc.GetReceipt(tx.Hash(TransactionHasher{}))
+		if err != nil {
+			return 0, err
+		}
+
+		fees += receipt.Fee
+	}
+
+	return fees, nil
 }
 
 func (bc *Blockchain) GetTransactionByHash(hash types.Hash) (*Transaction, error) {
@@ -84,8 +421,19 @@ func (bc *Blockchain) SetValidator(validator Validator) {
 	bc.validator = validator
 }
 
+// SetReorgHandler sets the function which receives the transactions dropped from the canonical chain by a reorganisation
+func (bc *Blockchain) SetReorgHandler(handler func(orphaned []*Transaction)) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	bc.reorgHandler = handler
+}
+
 // AddBlock  validates a block and adds it into blockchain
 func (bc *Blockchain) AddBlock(block *Block) error {
+	bc.addLock.Lock()
+	defer bc.addLock.Unlock()
+
 	if err := bc.validator.ValidateBlock(block); err != nil {
 		return err
 	}
@@ -97,30 +445,129 @@ func (bc *Blockchain) AddBlock(block *Block) error {
 	return nil
 }
 
-func (bc *Blockchain) handleNativeTransfer(tx *Transaction) error {
+// StateRoot returns the root hash of the current state
+func (bc *Blockchain) StateRoot() types.Hash {
+	bc.stateLock.RLock()
+	defer bc.stateLock.RUnlock()
+
+	return bc.state().root()
+}
+
+// CalculateRoots executes the block on top of the current state without changing it and returns
+// the state root and the receipts root the block has to commit to. The block Validator has to be set already,
+// because it receives the fees and the block reward.
+func (bc *Blockchain) CalculateRoots(block *Block) (stateRoot types.Hash, receiptsRoot types.Hash, err error) {
+	bc.stateLock.RLock()
+	defer bc.stateLock.RUnlock()
+
+	state := bc.state().overlay()
+
+	receipts, err := bc.executeTransactions(state, block)
+	if err != nil {
+		return types.Hash{}, types.Hash{}, err
+	}
+
+	return state.root(), ReceiptsRoot(receipts), nil
+}
+
+// ChainID returns the id of the network the blockchain belongs to
+func (bc *Blockchain) ChainID() uint32 {
+	return bc.chainID
+}
+
+// BlockReward returns the reward which is paid to the validator of the block with the given height
+func (bc *Blockchain) BlockReward(height uint32) uint64 {
+	if height == 0 {
+		return 0
+	}
+
+	return bc.blockReward
+}
+
+// GasPrice returns the price of a unit of gas
+func (bc *Blockchain) GasPrice() uint64 {
+	return bc.gasPrice
+}
+
+// NextNonce returns the nonce the next transaction of the account has to use
+func (bc *Blockchain) NextNonce(address types.Address) uint64 {
+	bc.stateLock.RLock()
+	defer bc.stateLock.RUnlock()
+
+	account, err := bc.accountState.GetAccount(address)
+	if err != nil {
+		return 0
+	}
+
+	return account.Nonce
+}
+
+// Balance returns the balance of the account, an account which does not exist has nothing
+func (bc *Blockchain) Balance(address types.Address) uint64 {
+	bc.stateLock.RLock()
+	defer bc.stateLock.RUnlock()
+
+	balance, err := bc.accountState.GetBalance(address)
+	if err != nil {
+		return 0
+	}
+
+	return balance
+}
+
+// GetContractCode returns the code of a deployed contract
+func (bc *Blockchain) GetContractCode(contract types.Address) ([]byte, error) {
+	bc.stateLock.RLock()
+	defer bc.stateLock.RUnlock()
+
+	return getContractCode(bc.contractState, contract)
+}
+
+// state returns the current state. Must be called with stateLock held.
+func (bc *Blockchain) state() *worldState {
+	return &worldState{
+		accountState:    bc.accountState,
+		contractState:   bc.contractState,
+		collectionState: bc.collectionState,
+		mintState:       bc.mintState,
+		trie:            bc.stateTrie,
+	}
+}
+
+// handleNativeTransfer transfers the value of the transaction to its recipient, which is the contract for contract transactions
+func (bc *Blockchain) handleNativeTransfer(state *worldState, tx *Transaction) error {
+	to := tx.To.Address()
+
+	switch inner := tx.TxInner.(type) {
+	case DeployTx:
+		to = ContractAddress(tx.From.Address(), tx.Nonce)
+	case CallTx:
+		to = inner.Contract
+	}
+
 	bc.logger.Log(
 		"msg", "handle native token transfer",
 		"from", tx.From,
-		"to", tx.To,
+		"to", to,
 		"value", tx.Value)
 
-	return bc.accountState.Transfer(tx.From.Address(), tx.To.Address(), tx.Value)
+	return state.accountState.Transfer(tx.From.Address(), to, tx.Value)
 }
 
-func (bc *Blockchain) handleNativeNFT(tx *Transaction) error {
+func (bc *Blockchain) handleNativeNFT(state *worldState, tx *Transaction) error {
 	hash := tx.Hash(TransactionHasher{})
 
 	switch t := tx.TxInner.(type) {
 	case CollectionTx:
-		bc.collectionState[hash] = &t
+		state.collectionState.put(hash, &t)
 		bc.logger.Log("msg", "created new NFT collection", "hash", hash)
 	case MintTx:
-		_, ok := bc.collectionState[t.Collection]
+		_, ok := state.collectionState.get(t.Collection)
 		if !ok {
 			return fmt.Errorf("collection (%s) does not exist on the blockchain", t.Collection)
 		}
 
-		bc.mintState[hash] = &t
+		state.mintState.put(hash, &t)
 
 		bc.logger.Log("msg", "created new NFT mint", "NFT", t.NFT, "collection", t.Collection)
 	default:
@@ -166,60 +613,255 @@ func (bc *Blockchain) Height() uint32 {
 	return uint32(len(bc.headers) - 1)
 }
 
-// addBlockWithoutValidation adds a block into blockchain without validation
+// addBlockWithoutValidation adds a block into the block tree without validation. A block on top of the head
+// is executed and persisted right away. A block of a side branch is kept in memory until the fork choice
+// rule prefers its branch, then the chain is reorganised.
 func (bc *Blockchain) addBlockWithoutValidation(block *Block) error {
+	bc.lock.RLock()
+	parent := bc.tree[block.Header.PreviousBlockHash]
+	head := bc.head
+	bc.lock.RUnlock()
+
+	if head != nil && parent == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownParent, block.Header.PreviousBlockHash)
+	}
+
+	node := bc.newBlockNode(block, parent)
+
+	if parent == head {
+		if err := bc.executeBlock(node, bc.store.Put); err != nil {
+			return err
+		}
+
+		bc.appendBlock(node)
+
+		bc.logger.Log(
+			"msg", "adding new block",
+			"height", block.Header.Height,
+			"hash", node.hash,
+			"transactions", len(block.Transactions),
+		)
+
+		return nil
+	}
+
+	bc.lock.Lock()
+	bc.tree[node.hash] = node
+	bc.sideNodes[node.hash] = node
+	bc.lock.Unlock()
+
+	bc.logger.Log(
+		"msg", "adding block to side branch",
+		"height", block.Header.Height,
+		"hash", node.hash,
+		"parent", block.Header.PreviousBlockHash,
+	)
+
+	if !bc.forkChoice.Better(node.tip(), head.tip()) {
+		return nil
+	}
+
+	return bc.reorganize(node)
+}
+
+// executeBlock executes the block transactions on an overlay of the current state. The overlay is committed
+// only if every transaction succeeds and beforeCommit, if given, does not fail. Otherwise it is discarded
+// and the state stays exactly as it was before the block. The node keeps the undo which reverts the block
+// and the receipts of its transactions.
+func (bc *Blockchain) executeBlock(node *blockNode, beforeCommit func(*Block, []*Receipt) error) error {
 	bc.stateLock.Lock()
+	defer bc.stateLock.Unlock()
+
+	block := node.block
+
+	state := bc.state().overlay()
+
+	receipts, err := bc.executeTransactions(state, block)
+	if err != nil {
+		return err
+	}
+
+	if beforeCommit != nil {
+		if err := beforeCommit(block, receipts); err != nil {
+			return err
+		}
+	}
+
+	node.undo = state.undo()
+	node.receipts = receipts
+	state.commit()
+
+	if bc.snapshots != nil && block.Header.Height%bc.snapshotEvery == 0 {
+		// The block is already applied, a failed snapshot only means a longer replay on the next start.
+		if err := bc.snapshots.Put(bc.takeSnapshot(block)); err != nil {
+			bc.logger.Log("msg", "failed to save state snapshot", "height", block.Header.Height, "err", err)
+		}
+	}
+
+	fmt.Println("========ACCOUNT STATE==============")
+	fmt.Printf("%+v\n", bc.accountState.accounts)
+	fmt.Println("========ACCOUNT STATE==============")
+
+	return nil
+}
+
+// executeTransactions executes the block transactions against the given state and returns their receipts.
+// The fees of the transactions and the block reward are paid to the block validator.
+func (bc *Blockchain) executeTransactions(state *worldState, block *Block) ([]*Receipt, error) {
+	// A block of a side branch is only executed when the blockchain switches to it
+	if err := block.checkGasLimits(); err != nil {
+		return nil, err
+	}
+
+	fees := uint64(0)
+	receipts := make([]*Receipt, 0, len(block.Transactions))
+
 	for _, tx := range block.Transactions {
-		// If we have data inside execute that data on the VM.
-		if len(tx.Data) > 0 {
-			bc.logger.Log("msg", "executing code", "len", len(tx.Data), "hash", tx.Hash(&TransactionHasher{}))
+		receipt, fee, err := bc.executeTransaction(state, block.Header, tx)
+		if err != nil {
+			return nil, err
+		}
+
+		fees += fee
+		receipts = append(receipts, receipt)
+	}
+
+	// The fees of an unsigned block are burned
+	if reward := fees + bc.BlockReward(block.Header.Height); reward > 0 && len(block.Validator) > 0 {
+		state.accountState.AddBalance(block.Validator.Address(), reward)
+	}
+
+	return receipts, nil
+}
+
+// executeTransaction executes a transaction of the block with the given header against the state.
+// It returns the receipt of the transaction and the fee the sender paid. The whole gas limit is paid
+// up front, after the execution the gas the transaction did not use is refunded.
+func (bc *Blockchain) executeTransaction(state *worldState, header *Header, tx *Transaction) (*Receipt, uint64, error) {
+	receipt := &Receipt{TxHash: tx.Hash(TransactionHasher{}), Status: ReceiptStatusSuccess}
+
+	if tx.ChainID != bc.chainID {
+		return nil, 0, fmt.Errorf("%w: transaction %s is signed for chain %d", ErrInvalidChainID, tx.Hash(TransactionHasher{}), tx.ChainID)
+	}
+
+	if err := tx.checkGasLimit(); err != nil {
+		return nil, 0, err
+	}
+
+	// Every transaction uses up the next nonce of its sender, so it cannot be replayed.
+	if err := state.accountState.IncrementNonce(tx.From.Address(), tx.Nonce); err != nil {
+		return nil, 0, err
+	}
+
+	maxFee, err := tx.MaxFee(bc.gasPrice)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := state.accountState.SubBalance(tx.From.Address(), maxFee); err != nil {
+		return nil, 0, err
+	}
 
-			vm := NewVirtualMachine(tx.Data, bc.contractState)
-			if err := vm.Run(); err != nil {
-				return err
+	switch tx.TxInner.(type) {
+	case DeployTx, CallTx:
+		if err := bc.executeContract(state, header, tx, receipt); err != nil {
+			return nil, 0, err
+		}
+	default:
+		// Handle the native transaction here.
+		if tx.Value > 0 {
+			if err := bc.handleNativeTransfer(state, tx); err != nil {
+				return nil, 0, err
 			}
 		}
 
 		// If the txInner of the transaction is not nil we need to handle
 		// the native NFT implementation.
 		if tx.TxInner != nil {
-			if err := bc.handleNativeNFT(tx); err != nil {
-				return err
+			if err := bc.handleNativeNFT(state, tx); err != nil {
+				return nil, 0, err
 			}
 		}
+	}
 
-		// Handle the native transaction here
-		if tx.Value > 0 {
-			if err := bc.handleNativeTransfer(tx); err != nil {
-				return err
-			}
+	receipt.Fee = maxFee
+
+	// A transaction cannot use more than its gas limit, so the refund is part of maxFee
+	if refund := (tx.GasLimit - receipt.GasUsed) * bc.gasPrice; tx.paysGas() && refund > 0 {
+		receipt.Fee -= refund
+		state.accountState.AddBalance(tx.From.Address(), refund)
+	}
+
+	return receipt, receipt.Fee, nil
+}
+
+// SelectTransactions executes the transactions one after another on top of the current state, as transactions
+// of a block with the given header, and splits them into the ones the block can include and the ones which fail.
+// Every transaction runs on its own overlay, so a failed one does not change the state the next ones see.
+// A transaction which does not fit into the MaxBlockGas of the block any more is in neither of them.
+func (bc *Blockchain) SelectTransactions(header *Header, transactions []*Transaction) (included, failed []*Transaction) {
+	bc.stateLock.RLock()
+	defer bc.stateLock.RUnlock()
+
+	state := bc.state().overlay()
+	gas := uint64(0)
+
+	for _, tx := range transactions {
+		// A transaction which does not fit into the block any more may fit into the next one,
+		// one over MaxTxGas never fits and fails below
+		if tx.GasLimit <= MaxTxGas && gas+tx.blockGas() > MaxBlockGas {
+			continue
+		}
+
+		txState := state.overlay()
+
+		if _, _, err := bc.executeTransaction(txState, header, tx); err != nil {
+			bc.logger.Log("msg", "skipping transaction", "hash", tx.Hash(TransactionHasher{}), "err", err)
+
+			failed = append(failed, tx)
+
+			continue
 		}
+
+		txState.commit()
+		included = append(included, tx)
+		gas += tx.blockGas()
 	}
 
-	bc.stateLock.Unlock()
+	return included, failed
+}
 
-	fmt.Println("========ACCOUNT STATE==============")
-	fmt.Printf("%+v\n", bc.accountState.accounts)
-	fmt.Println("========ACCOUNT STATE==============")
+// appendBlock appends an executed block to the canonical chain and makes it the head
+func (bc *Blockchain) appendBlock(node *blockNode) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
 
-	bc.lock.RLock()
+	bc.appendBlockWithoutLock(node)
+}
 
-	bc.headers = append(bc.headers, block.Header)
-	bc.blocks = append(bc.blocks, block)
-	bc.blockStore[block.Hash(BlockHasher{})] = block
+func (bc *Blockchain) appendBlockWithoutLock(node *blockNode) {
+	bc.headers = append(bc.headers, node.block.Header)
+	bc.blocks = append(bc.blocks, node.block)
+	bc.tree[node.hash] = node
+	bc.head = node
 
-	for _, tx := range block.Transactions {
+	for _, tx := range node.block.Transactions {
 		bc.txStore[tx.Hash(TransactionHasher{})] = tx
 	}
 
-	bc.lock.RUnlock()
+	bc.storeReceipts(node)
 
-	bc.logger.Log(
-		"msg", "adding new block",
-		"height", block.Header.Height,
-		"hash", block.Hash(BlockHasher{}),
-		"transactions", len(block.Transactions),
-	)
+	// Undo data is only kept for the blocks a reorganisation is allowed to revert
+	if len(bc.blocks) > maxReorgDepth {
+		bc.tree[bc.blocks[len(bc.blocks)-1-maxReorgDepth].Hash(BlockHasher{})].undo = nil
+	}
+
+	bc.pruneSideBranches()
+}
 
-	return bc.store.Put(block)
+// storeReceipts makes the receipts of an executed canonical block available. Must be called with lock held.
+func (bc *Blockchain) storeReceipts(node *blockNode) {
+	for _, receipt := range node.receipts {
+		bc.receiptStore[receipt.TxHash] = receipt
+	}
 }
@@ -1,11 +1,11 @@
 package core
 
 import (
-	"fmt"
 	"github.com/evgeniy-dammer/blockchain/crypto"
 	"github.com/evgeniy-dammer/blockchain/types"
 	"github.com/go-kit/log"
 	"github.com/stretchr/testify/assert"
+	"math"
 	"testing"
 )
 
@@ -17,6 +17,21 @@ func newBlockchainWithGenesis(t *testing.T) *Blockchain {
 	return blockchain
 }
 
+// fundAccount gives the account the balance. The change is committed to the state of the blockchain through
+// an overlay like the changes of a block, so the state trie follows it.
+func fundAccount(bc *Blockchain, address types.Address, balance uint64) *Account {
+	bc.stateLock.Lock()
+	defer bc.stateLock.Unlock()
+
+	state := bc.state().overlay()
+	state.accountState.AddBalance(address, balance)
+	state.commit()
+
+	account, _ := bc.accountState.GetAccount(address)
+
+	return account
+}
+
 func TestNewBlockchain(t *testing.T) {
 	blockchain := newBlockchainWithGenesis(t)
 
@@ -35,7 +50,7 @@ func TestBlockchain_GetBlock(t *testing.T) {
 	lenBlocks := 100
 
 	for i := 0; i < lenBlocks; i++ {
-		block := randomBlock(t, uint32(i+1), getPreviousBlockHash(t, bc, uint32(i+1)))
+		block := randomChainBlock(t, bc, uint32(i+1))
 		assert.Nil(t, bc.AddBlock(block))
 
 		fetchedBlock, err := bc.GetBlock(block.Header.Height)
@@ -46,11 +61,40 @@ func TestBlockchain_GetBlock(t *testing.T) {
 
 func TestBlockchain_AddBlock(t *testing.T) {
 	blockchain := newBlockchainWithGenesis(t)
-	block := randomBlock(t, uint32(1), getPreviousBlockHash(t, blockchain, uint32(1)))
+	block := randomChainBlock(t, blockchain, uint32(1))
 
 	assert.Nil(t, blockchain.AddBlock(block))
 }
 
+func TestBlockchain_AddBlockInvalidStateRoot(t *testing.T) {
+	blockchain := newBlockchainWithGenesis(t)
+	block := randomChainBlock(t, blockchain, uint32(1))
+
+	block.Header.StateRoot = types.Hash{0x01}
+	assert.Nil(t, block.Sign(crypto.GeneratePrivateKey()))
+
+	assert.NotNil(t, blockchain.AddBlock(block))
+	assert.Equal(t, uint32(0), blockchain.Height())
+}
+
+func TestBlockchain_AddBlockInvalidReceiptsRoot(t *testing.T) {
+	blockchain := newBlockchainWithGenesis(t)
+	block := randomChainBlock(t, blockchain, uint32(1))
+
+	privateKey := crypto.GeneratePrivateKey()
+	block.Validator = privateKey.PublicKey()
+
+	stateRoot, _, err := blockchain.CalculateRoots(block)
+	assert.Nil(t, err)
+
+	block.Header.StateRoot = stateRoot
+	block.Header.ReceiptsRoot = types.Hash{0x01}
+	assert.Nil(t, block.Sign(privateKey))
+
+	assert.NotNil(t, blockchain.AddBlock(block))
+	assert.Equal(t, uint32(0), blockchain.Height())
+}
+
 func TestBlockchain_GetHeader(t *testing.T) {
 	blockchain := newBlockchainWithGenesis(t)
 
@@ -60,7 +104,7 @@ func TestBlockchain_GetHeader(t *testing.T) {
 func TestBlockchain_AddBlockTooHigh(t *testing.T) {
 	blockchain := newBlockchainWithGenesis(t)
 
-	block := randomBlock(t, uint32(1), getPreviousBlockHash(t, blockchain, uint32(1)))
+	block := randomChainBlock(t, blockchain, uint32(1))
 	assert.Nil(t, blockchain.AddBlock(block))
 
 	header, err := blockchain.GetHeader(block.Header.Height)
@@ -77,6 +121,30 @@ func getPreviousBlockHash(t *testing.T, blockchain *Blockchain, height uint32) t
 	return BlockHasher{}.Hash(prevHeader)
 }
 
+// randomChainBlock returns a random block with the given height on top of the blockchain
+func randomChainBlock(t *testing.T, blockchain *Blockchain, height uint32) *Block {
+	block := randomBlock(t, height, getPreviousBlockHash(t, blockchain, height))
+	sealBlock(t, blockchain, block)
+
+	return block
+}
+
+// sealBlock sets the state and receipts roots the block produces on top of the blockchain and signs the block.
+// If the block cannot be executed the state root is left empty, so the blockchain rejects it.
+func sealBlock(t *testing.T, blockchain *Blockchain, block *Block) {
+	privateKey := crypto.GeneratePrivateKey()
+
+	// the validator receives the fees, so it has to be known before the state root is calculated
+	block.Validator = privateKey.PublicKey()
+
+	if stateRoot, receiptsRoot, err := blockchain.CalculateRoots(block); err == nil {
+		block.Header.StateRoot = stateRoot
+		block.Header.ReceiptsRoot = receiptsRoot
+	}
+
+	assert.Nil(t, block.Sign(privateKey))
+}
+
 func TestSendNativeTransferTamper(t *testing.T) {
 	bc := newBlockchainWithGenesis(t)
 
@@ -89,8 +157,7 @@ func TestSendNativeTransferTamper(t *testing.T) {
 	privKeyAlice := crypto.GeneratePrivateKey()
 	amount := uint64(100)
 
-	accountBob := bc.accountState.CreateAccount(privKeyBob.PublicKey().Address())
-	accountBob.Balance = amount
+	accountBob := fundAccount(bc, privKeyBob.PublicKey().Address(), amount)
 
 	tx := NewTransaction([]byte{})
 	tx.From = privKeyBob.PublicKey()
@@ -102,18 +169,16 @@ func TestSendNativeTransferTamper(t *testing.T) {
 	tx.To = hackerPrivKey.PublicKey()
 
 	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
 
-	assert.Nil(t, bc.AddBlock(block)) // this should fail
-
-	//fmt.Printf("%+v\n", hackerPrivKey.PublicKey().Address())
-	fmt.Printf("%+v\n", bc.accountState.accounts)
-	fmt.Printf("%+v\n", privKeyAlice.PublicKey().Address())
+	// the signature covers the receiver, so the changed transaction is rejected
+	assert.NotNil(t, tx.Verify())
+	assert.NotNil(t, bc.AddBlock(block))
 
 	accountHacker, err := bc.accountState.GetAccount(hackerPrivKey.PublicKey().Address())
-	fmt.Printf("%s\n", err)
-	assert.NotNil(t, err)
-
-	assert.Equal(t, uint64(0), accountHacker.Balance)
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+	assert.Nil(t, accountHacker)
+	assert.Equal(t, amount, accountBob.Balance)
 
 	_, err = bc.accountState.GetAccount(privKeyAlice.PublicKey().Address())
 	assert.NotNil(t, err)
@@ -132,8 +197,7 @@ func TestSendNativeTransferInsuffientBalance(t *testing.T) {
 	privKeyAlice := crypto.GeneratePrivateKey()
 	amount := uint64(100)
 
-	accountBob := bc.accountState.CreateAccount(privKeyBob.PublicKey().Address())
-	accountBob.Balance = uint64(99)
+	fundAccount(bc, privKeyBob.PublicKey().Address(), 99)
 
 	tx := NewTransaction([]byte{})
 	tx.From = privKeyBob.PublicKey()
@@ -141,6 +205,7 @@ func TestSendNativeTransferInsuffientBalance(t *testing.T) {
 	tx.Value = amount
 	tx.Sign(privKeyBob)
 	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
 	assert.NotNil(t, bc.AddBlock(block))
 
 	_, err := bc.accountState.GetAccount(privKeyAlice.PublicKey().Address())
@@ -159,8 +224,7 @@ func TestSendNativeTransferSuccess(t *testing.T) {
 	privKeyAlice := crypto.GeneratePrivateKey()
 	amount := uint64(100)
 
-	accountBob := bc.accountState.CreateAccount(privKeyBob.PublicKey().Address())
-	accountBob.Balance = amount
+	fundAccount(bc, privKeyBob.PublicKey().Address(), amount)
 
 	tx := NewTransaction([]byte{})
 	tx.From = privKeyBob.PublicKey()
@@ -168,9 +232,339 @@ func TestSendNativeTransferSuccess(t *testing.T) {
 	tx.Value = amount
 	tx.Sign(privKeyBob)
 	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
 	assert.Nil(t, bc.AddBlock(block))
 
 	accountAlice, err := bc.accountState.GetAccount(privKeyAlice.PublicKey().Address())
 	assert.Nil(t, err)
 	assert.Equal(t, amount, accountAlice.Balance)
 }
+
+func TestBlockchain_RestoreFromStorage(t *testing.T) {
+	store, err := NewDiskStore(t.TempDir())
+	assert.Nil(t, err)
+	defer store.Close()
+
+	genesis := randomBlock(t, 0, types.Hash{})
+	options := BlockchainOptions{Logger: log.NewNopLogger(), Storage: store}
+
+	bc, err := NewBlockchainWithOptions(genesis, options)
+	assert.Nil(t, err)
+
+	for i := 1; i <= 10; i++ {
+		assert.Nil(t, bc.AddBlock(randomChainBlock(t, bc, uint32(i))))
+	}
+
+	restored, err := NewBlockchainWithOptions(genesis, options)
+	assert.Nil(t, err)
+	assert.Equal(t, bc.Height(), restored.Height())
+
+	for i := uint32(0); i <= bc.Height(); i++ {
+		block, err := bc.GetBlock(i)
+		assert.Nil(t, err)
+
+		restoredBlock, err := restored.GetBlockByHash(block.Hash(BlockHasher{}))
+		assert.Nil(t, err)
+		assert.Equal(t, block.Header, restoredBlock.Header)
+
+		for _, tx := range block.Transactions {
+			_, err = restored.GetTransactionByHash(tx.Hash(TransactionHasher{}))
+			assert.Nil(t, err)
+		}
+	}
+
+	_, err = NewBlockchainWithOptions(randomBlock(t, 0, types.Hash{}), options)
+	assert.NotNil(t, err)
+}
+
+func TestBlockchain_FailedBlockLeavesStateUntouched(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+
+	privKeyBob := crypto.GeneratePrivateKey()
+	privKeyAlice := crypto.GeneratePrivateKey()
+
+	accountBob := fundAccount(bc, privKeyBob.PublicKey().Address(), 100)
+	root := bc.StateRoot()
+
+	block := randomBlock(t, uint32(1), getPreviousBlockHash(t, bc, uint32(1)))
+
+	// the first transfer succeeds, the second one exceeds the remaining balance
+	for nonce, value := range []uint64{60, 60} {
+		tx := NewTransaction(nil)
+		tx.To = privKeyAlice.PublicKey()
+		tx.Value = value
+		tx.Nonce = uint64(nonce)
+		assert.Nil(t, tx.Sign(privKeyBob))
+		block.AddTransaction(tx)
+	}
+
+	assert.NotNil(t, bc.addBlockWithoutValidation(block))
+	assert.Equal(t, uint32(0), bc.Height())
+	assert.Equal(t, root, bc.StateRoot())
+	assert.Equal(t, uint64(100), accountBob.Balance)
+	assert.Equal(t, uint64(0), accountBob.Nonce)
+
+	_, err := bc.accountState.GetAccount(privKeyAlice.PublicKey().Address())
+	assert.ErrorIs(t, err, ErrAccountNotFound)
+
+	// the state lock has been released, so the chain keeps accepting blocks
+	assert.Nil(t, bc.AddBlock(randomChainBlock(t, bc, uint32(1))))
+}
+
+func TestBlockchain_ReplayedTransactionRejected(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+
+	privKeyBob := crypto.GeneratePrivateKey()
+	fundAccount(bc, privKeyBob.PublicKey().Address(), 100)
+
+	tx := NewTransaction(nil)
+	tx.To = crypto.GeneratePrivateKey().PublicKey()
+	tx.Value = 10
+	assert.Nil(t, tx.Sign(privKeyBob))
+
+	block := randomBlock(t, 1, getPreviousBlockHash(t, bc, 1))
+	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+	assert.Equal(t, uint64(1), bc.NextNonce(privKeyBob.PublicKey().Address()))
+
+	// the same signed transaction cannot be mined a second time
+	replay := randomBlock(t, 2, getPreviousBlockHash(t, bc, 2))
+	replay.AddTransaction(tx)
+	sealBlock(t, bc, replay)
+	assert.ErrorIs(t, bc.AddBlock(replay), ErrInvalidNonce)
+
+	balance, err := bc.accountState.GetBalance(privKeyBob.PublicKey().Address())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(90), balance)
+}
+
+func TestBlockchain_AddBlockInvalidChainID(t *testing.T) {
+	genesis := randomBlock(t, 0, types.Hash{})
+	genesis.Transactions = nil
+
+	bc, err := NewBlockchainWithOptions(genesis, BlockchainOptions{ChainID: 7})
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(7), bc.ChainID())
+
+	// randomBlock signs its transaction for chain 0
+	block := randomBlock(t, 1, getPreviousBlockHash(t, bc, 1))
+	sealBlock(t, bc, block)
+	assert.ErrorIs(t, bc.AddBlock(block), ErrInvalidChainID)
+
+	tx := NewTransaction(nil)
+	tx.ChainID = 7
+	assert.Nil(t, tx.Sign(crypto.GeneratePrivateKey()))
+
+	block = randomBlock(t, 1, getPreviousBlockHash(t, bc, 1))
+	block.Transactions = nil
+	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+}
+
+func TestBlockchain_FeesAndReward(t *testing.T) {
+	bc, err := NewBlockchainWithOptions(randomBlock(t, 0, types.Hash{}), BlockchainOptions{BlockReward: 50})
+	assert.Nil(t, err)
+
+	privKeyBob := crypto.GeneratePrivateKey()
+	addressBob := privKeyBob.PublicKey().Address()
+	fundAccount(bc, addressBob, 300)
+
+	transfer := NewTransaction(nil)
+	transfer.To = crypto.GeneratePrivateKey().PublicKey()
+	transfer.Value = 20
+	transfer.Fee = 10
+	assert.Nil(t, transfer.Sign(privKeyBob))
+
+	collection := &Transaction{Type: TxTypeCollection, TxInner: CollectionTx{Fee: 200}, Nonce: 1, Fee: 5}
+	assert.Nil(t, collection.Sign(privKeyBob))
+
+	block := randomBlock(t, 1, getPreviousBlockHash(t, bc, 1))
+	block.Transactions = nil
+	block.AddTransaction(transfer)
+	block.AddTransaction(collection)
+	sealBlock(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+
+	fees, err := bc.BlockFees(block)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(215), fees)
+	assert.Equal(t, uint64(0), bc.BlockReward(0))
+	assert.Equal(t, uint64(50), bc.BlockReward(1))
+
+	balance, err := bc.accountState.GetBalance(addressBob)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(300-20-215), balance)
+
+	balance, err = bc.accountState.GetBalance(block.Validator.Address())
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(215+50), balance)
+}
+
+func TestBlockchain_FeeInsufficientBalance(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+
+	privKeyBob := crypto.GeneratePrivateKey()
+	fundAccount(bc, privKeyBob.PublicKey().Address(), 5)
+
+	tx := NewTransaction(nil)
+	tx.Fee = 10
+	assert.Nil(t, tx.Sign(privKeyBob))
+
+	block := randomBlock(t, 1, getPreviousBlockHash(t, bc, 1))
+	block.Transactions = nil
+	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
+	assert.ErrorIs(t, bc.AddBlock(block), ErrInsufficientBalance)
+}
+
+func TestBlockchain_SelectTransactions(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+
+	privKeyBob := crypto.GeneratePrivateKey()
+	fundAccount(bc, privKeyBob.PublicKey().Address(), 100)
+
+	transfer := func(nonce, value uint64) *Transaction {
+		tx := &Transaction{To: crypto.GeneratePrivateKey().PublicKey(), Value: value, Nonce: nonce}
+		assert.Nil(t, tx.Sign(privKeyBob))
+
+		return tx
+	}
+
+	// the second transfer exceeds the remaining balance, the third one takes its nonce
+	transactions := []*Transaction{transfer(0, 60), transfer(1, 60), transfer(1, 30)}
+
+	block := randomBlock(t, 1, getPreviousBlockHash(t, bc, 1))
+	included, failed := bc.SelectTransactions(block.Header, transactions)
+	assert.Equal(t, []*Transaction{transactions[0], transactions[2]}, included)
+	assert.Equal(t, []*Transaction{transactions[1]}, failed)
+
+	block.Transactions = nil
+	for _, tx := range included {
+		block.AddTransaction(tx)
+	}
+
+	sealBlock(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+	assert.Equal(t, uint64(10), bc.Balance(privKeyBob.PublicKey().Address()))
+}
+
+func TestBlockchain_GasLimit(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	contract := ContractAddress(privateKey.PublicKey().Address(), 0)
+	fundAccount(bc, privateKey.PublicKey().Address(), 50)
+
+	assert.Nil(t, bc.AddBlock(contractBlock(t, bc, privateKey, DeployTx{Code: storeFooCode})))
+
+	tx := &Transaction{TxInner: CallTx{Contract: contract}, Nonce: 1, GasLimit: 50}
+	assert.Nil(t, tx.Sign(privateKey))
+
+	block := randomBlock(t, 2, getPreviousBlockHash(t, bc, 2))
+	block.Transactions = nil
+	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
+
+	// the failed call is included, it only leaves its receipt and uses up the nonce
+	assert.Nil(t, bc.AddBlock(block))
+
+	receipt, err := bc.GetReceipt(tx.Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+	assert.False(t, receipt.Succeeded())
+	assert.Contains(t, receipt.Error, ErrOutOfGas.Error())
+	assert.Equal(t, uint64(50), receipt.GasUsed)
+	assert.Equal(t, uint64(2), bc.NextNonce(privateKey.PublicKey().Address()))
+
+	_, err = newContractStorage(bc.contractState, contract).Get([]byte("FOO"))
+	assert.NotNil(t, err)
+}
+
+func TestBlockchain_MaxGas(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+	contract := ContractAddress(sender, 0)
+
+	assert.Nil(t, bc.AddBlock(contractBlock(t, bc, privateKey, DeployTx{Code: mustAssemble(t, "loop:\nPUSH loop\nJUMP")})))
+	fundAccount(bc, sender, 2*MaxBlockGas)
+
+	call := func(nonce, gasLimit uint64) *Transaction {
+		tx := &Transaction{TxInner: CallTx{Contract: contract}, Nonce: nonce, GasLimit: gasLimit}
+		assert.Nil(t, tx.Sign(privateKey))
+
+		return tx
+	}
+
+	addBlock := func(transactions ...*Transaction) error {
+		block := randomBlock(t, 2, getPreviousBlockHash(t, bc, 2))
+		block.Transactions = nil
+		for _, tx := range transactions {
+			block.AddTransaction(tx)
+		}
+
+		sealBlock(t, bc, block)
+
+		return bc.AddBlock(block)
+	}
+
+	// a transaction above MaxTxGas is rejected, so is a block whose transactions need more than MaxBlockGas
+	assert.ErrorIs(t, addBlock(call(1, math.MaxUint64)), ErrGasLimitExceeded)
+
+	tooMuch := make([]*Transaction, MaxBlockGas/MaxTxGas+1)
+	for i := range tooMuch {
+		tooMuch[i] = call(uint64(1+i), MaxTxGas)
+	}
+
+	assert.ErrorIs(t, addBlock(tooMuch...), ErrGasLimitExceeded)
+
+	// the transactions which do not fit into the block are left for the next one
+	block := randomBlock(t, 2, getPreviousBlockHash(t, bc, 2))
+	included, failed := bc.SelectTransactions(block.Header, append(tooMuch, call(uint64(1+len(tooMuch)), math.MaxUint64)))
+	assert.Equal(t, tooMuch[:len(tooMuch)-1], included)
+	assert.Equal(t, 1, len(failed))
+
+	// the endless loop runs out of gas
+	tx := call(1, MaxTxGas)
+	assert.Nil(t, addBlock(tx))
+
+	receipt, err := bc.GetReceipt(tx.Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+	assert.Contains(t, receipt.Error, ErrOutOfGas.Error())
+	assert.Equal(t, uint64(MaxTxGas), receipt.GasUsed)
+}
+
+func TestBlockchain_GasLimitWithoutCode(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+	contract := ContractAddress(sender, 0)
+
+	assert.Nil(t, bc.AddBlock(contractBlock(t, bc, privateKey, DeployTx{Code: storeFooCode})))
+	fundAccount(bc, sender, MaxBlockGas)
+
+	// the transfers do not pay for their gas limits, so they leave the whole block gas to the calls
+	transactions := []*Transaction{}
+	for i := 0; i < 2*MaxBlockGas/MaxTxGas; i++ {
+		tx := &Transaction{To: crypto.GeneratePrivateKey().PublicKey(), Nonce: uint64(1 + i), GasLimit: MaxTxGas}
+		if i%2 == 1 {
+			tx = &Transaction{TxInner: CallTx{Contract: contract}, Nonce: uint64(1 + i), GasLimit: MaxTxGas}
+		}
+
+		assert.Nil(t, tx.Sign(privateKey))
+		transactions = append(transactions, tx)
+	}
+
+	block := randomBlock(t, 2, getPreviousBlockHash(t, bc, 2))
+	included, failed := bc.SelectTransactions(block.Header, transactions)
+	assert.Equal(t, transactions, included)
+	assert.Empty(t, failed)
+
+	block.Transactions = nil
+	for _, tx := range included {
+		block.AddTransaction(tx)
+	}
+
+	sealBlock(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+}
@@ -0,0 +1,495 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/crypto"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"io"
+	"math/big"
+)
+
+// codecVersion is the first byte of every encoded header, transaction and block.
+// It has to be increased whenever the layout below changes.
+const codecVersion byte = 0x05
+
+// maxCodecBytes limits the length of a single variable length field, so a broken length prefix
+// cannot make the decoder allocate an arbitrary amount of memory
+const maxCodecBytes = 16 << 20
+
+var ErrInvalidEncoding = errors.New("invalid canonical encoding")
+
+// The canonical encoding is a fixed layout binary format. All integers are big endian, hashes are written
+// as their 32 bytes and every variable length field is prefixed with its length as uint32:
+//
+//	header      = version u8 | Version u32 | DataHash | StateRoot | ReceiptsRoot | PreviousBlockHash | Timestamp i64 | Height u32
+//	transaction = version u8 | payload | signature
+//	payload     = ChainID u32 | Type u8 | Nonce u64 | From bytes | To bytes | Value u64 | Fee u64 | GasLimit u64 | Data bytes | inner
+//	inner       = 0x00 | 0x01 Fee i64 MetaData bytes | 0x02 Fee i64 NFT Collection MetaData bytes CollectionOwner bytes signature |
+//	              0x03 Code bytes | 0x04 Contract address
+//	signature   = 0x00 | 0x01 R bytes S bytes
+//	block       = version u8 | header without version | count u32 | count * (payload signature) | Validator bytes | signature
+//	receipt     = TxHash | Status u8 | GasUsed u64 | Fee u64 | ContractAddress | count u32 | count * (Address Data bytes)
+//	receipts    = version u8 | count u32 | count * (receipt Error bytes)
+
+// BinaryTransactionEncoder writes transactions in the canonical encoding
+type BinaryTransactionEncoder struct {
+	w io.Writer
+}
+
+// NewBinaryTransactionEncoder is a constructor for the BinaryTransactionEncoder
+func NewBinaryTransactionEncoder(w io.Writer) *BinaryTransactionEncoder {
+	return &BinaryTransactionEncoder{w: w}
+}
+
+// Encode encodes the transaction
+func (e *BinaryTransactionEncoder) Encode(transaction *Transaction) error {
+	_, err := e.w.Write(encodeTransaction(transaction, true))
+
+	return err
+}
+
+// BinaryTransactionDecoder reads transactions in the canonical encoding
+type BinaryTransactionDecoder struct {
+	r io.Reader
+}
+
+// NewBinaryTransactionDecoder is a constructor for the BinaryTransactionDecoder
+func NewBinaryTransactionDecoder(r io.Reader) *BinaryTransactionDecoder {
+	return &BinaryTransactionDecoder{r: r}
+}
+
+// Decode decodes the transaction
+func (d *BinaryTransactionDecoder) Decode(transaction *Transaction) error {
+	r := &codecReader{r: d.r}
+	r.version()
+
+	*transaction = *r.transaction()
+
+	return r.err
+}
+
+// BinaryBlockEncoder writes blocks in the canonical encoding
+type BinaryBlockEncoder struct {
+	w io.Writer
+}
+
+// NewBinaryBlockEncoder is a constructor for the BinaryBlockEncoder
+func NewBinaryBlockEncoder(w io.Writer) *BinaryBlockEncoder {
+	return &BinaryBlockEncoder{w: w}
+}
+
+// Encode encodes the block
+func (e *BinaryBlockEncoder) Encode(b *Block) error {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(codecVersion)
+	writeHeader(buf, b.Header)
+	binary.Write(buf, binary.BigEndian, uint32(len(b.Transactions)))
+
+	for _, tx := range b.Transactions {
+		writeTransaction(buf, tx, true)
+	}
+
+	writeLengthPrefixed(buf, b.Validator)
+	writeSignature(buf, b.Signature)
+
+	_, err := e.w.Write(buf.Bytes())
+
+	return err
+}
+
+// BinaryBlockDecoder reads blocks in the canonical encoding
+type BinaryBlockDecoder struct {
+	r io.Reader
+}
+
+// NewBinaryBlockDecoder is a constructor for the BinaryBlockDecoder
+func NewBinaryBlockDecoder(r io.Reader) *BinaryBlockDecoder {
+	return &BinaryBlockDecoder{r: r}
+}
+
+// Decode decodes the block
+func (d *BinaryBlockDecoder) Decode(b *Block) error {
+	r := &codecReader{r: d.r}
+	r.version()
+
+	block := &Block{Header: r.header()}
+
+	count := r.uint32()
+	if r.err == nil && count > maxCodecBytes {
+		r.fail("transaction count %d too large", count)
+	}
+
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		block.Transactions = append(block.Transactions, r.transaction())
+	}
+
+	block.Validator = r.bytes()
+	block.Signature = r.signature()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	*b = *block
+
+	return nil
+}
+
+// BinaryReceiptsEncoder writes the receipts of a block in the canonical encoding
+type BinaryReceiptsEncoder struct {
+	w io.Writer
+}
+
+// NewBinaryReceiptsEncoder is a constructor for the BinaryReceiptsEncoder
+func NewBinaryReceiptsEncoder(w io.Writer) *BinaryReceiptsEncoder {
+	return &BinaryReceiptsEncoder{w: w}
+}
+
+// Encode encodes the receipts together with their errors, which are not part of the receipts root
+func (e *BinaryReceiptsEncoder) Encode(receipts []*Receipt) error {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(codecVersion)
+	binary.Write(buf, binary.BigEndian, uint32(len(receipts)))
+
+	for _, receipt := range receipts {
+		writeReceipt(buf, receipt)
+		writeLengthPrefixed(buf, []byte(receipt.Error))
+	}
+
+	_, err := e.w.Write(buf.Bytes())
+
+	return err
+}
+
+// BinaryReceiptsDecoder reads the receipts of a block in the canonical encoding
+type BinaryReceiptsDecoder struct {
+	r io.Reader
+}
+
+// NewBinaryReceiptsDecoder is a constructor for the BinaryReceiptsDecoder
+func NewBinaryReceiptsDecoder(r io.Reader) *BinaryReceiptsDecoder {
+	return &BinaryReceiptsDecoder{r: r}
+}
+
+// Decode decodes the receipts
+func (d *BinaryReceiptsDecoder) Decode(receipts *[]*Receipt) error {
+	r := &codecReader{r: d.r}
+	r.version()
+
+	count := r.uint32()
+	if r.err == nil && count > maxCodecBytes {
+		r.fail("receipt count %d too large", count)
+	}
+
+	decoded := []*Receipt{}
+
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		receipt := r.receipt()
+		receipt.Error = string(r.bytes())
+		decoded = append(decoded, receipt)
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+
+	*receipts = decoded
+
+	return nil
+}
+
+// encodeHeader returns the canonical encoding of the header
+func encodeHeader(h *Header) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(codecVersion)
+	writeHeader(buf, h)
+
+	return buf.Bytes()
+}
+
+// encodeTransaction returns the canonical encoding of the transaction
+func encodeTransaction(tx *Transaction, withSignature bool) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(codecVersion)
+	writeTransaction(buf, tx, withSignature)
+
+	return buf.Bytes()
+}
+
+func writeHeader(buf *bytes.Buffer, h *Header) {
+	binary.Write(buf, binary.BigEndian, h.Version)
+	buf.Write(h.DataHash.ToSlice())
+	buf.Write(h.StateRoot.ToSlice())
+	buf.Write(h.ReceiptsRoot.ToSlice())
+	buf.Write(h.PreviousBlockHash.ToSlice())
+	binary.Write(buf, binary.BigEndian, h.Timestamp)
+	binary.Write(buf, binary.BigEndian, h.Height)
+}
+
+func writeTransaction(buf *bytes.Buffer, tx *Transaction, withSignature bool) {
+	binary.Write(buf, binary.BigEndian, tx.ChainID)
+	buf.WriteByte(byte(tx.Type))
+	binary.Write(buf, binary.BigEndian, tx.Nonce)
+	writeLengthPrefixed(buf, tx.From)
+	writeLengthPrefixed(buf, tx.To)
+	binary.Write(buf, binary.BigEndian, tx.Value)
+	binary.Write(buf, binary.BigEndian, tx.Fee)
+	binary.Write(buf, binary.BigEndian, tx.GasLimit)
+	writeLengthPrefixed(buf, tx.Data)
+
+	switch inner := tx.TxInner.(type) {
+	case nil:
+		buf.WriteByte(txInnerNone)
+	case CollectionTx:
+		buf.WriteByte(txInnerCollection)
+		writeCollection(buf, &inner)
+	case MintTx:
+		buf.WriteByte(txInnerMint)
+		writeMint(buf, &inner)
+	case DeployTx:
+		buf.WriteByte(txInnerDeploy)
+		writeLengthPrefixed(buf, inner.Code)
+	case CallTx:
+		buf.WriteByte(txInnerCall)
+		buf.Write(inner.Contract.ToSlice())
+	default:
+		// unsupported inner transactions cannot be decoded and are rejected on execution
+		buf.WriteByte(txInnerUnsupported)
+	}
+
+	if withSignature {
+		writeSignature(buf, tx.Signature)
+	}
+}
+
+func writeCollection(buf *bytes.Buffer, collection *CollectionTx) {
+	binary.Write(buf, binary.BigEndian, collection.Fee)
+	writeLengthPrefixed(buf, collection.MetaData)
+}
+
+func writeMint(buf *bytes.Buffer, mint *MintTx) {
+	binary.Write(buf, binary.BigEndian, mint.Fee)
+	buf.Write(mint.NFT.ToSlice())
+	buf.Write(mint.Collection.ToSlice())
+	writeLengthPrefixed(buf, mint.MetaData)
+	writeLengthPrefixed(buf, mint.CollectionOwner)
+
+	if mint.Signature.R == nil || mint.Signature.S == nil {
+		buf.WriteByte(0)
+		return
+	}
+
+	writeSignature(buf, &mint.Signature)
+}
+
+func writeReceipt(buf *bytes.Buffer, receipt *Receipt) {
+	buf.Write(receipt.TxHash.ToSlice())
+	buf.WriteByte(byte(receipt.Status))
+	binary.Write(buf, binary.BigEndian, receipt.GasUsed)
+	binary.Write(buf, binary.BigEndian, receipt.Fee)
+	buf.Write(receipt.ContractAddress.ToSlice())
+	binary.Write(buf, binary.BigEndian, uint32(len(receipt.Logs)))
+
+	for _, log := range receipt.Logs {
+		buf.Write(log.Address.ToSlice())
+		writeLengthPrefixed(buf, log.Data)
+	}
+}
+
+func writeSignature(buf *bytes.Buffer, signature *crypto.Signature) {
+	if signature == nil || signature.R == nil || signature.S == nil {
+		buf.WriteByte(0)
+		return
+	}
+
+	buf.WriteByte(1)
+	writeLengthPrefixed(buf, signature.R.Bytes())
+	writeLengthPrefixed(buf, signature.S.Bytes())
+}
+
+func writeLengthPrefixed(buf *bytes.Buffer, b []byte) {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(b)))
+	buf.Write(length)
+	buf.Write(b)
+}
+
+// codecReader reads the fields of the canonical encoding. After the first error every read
+// returns a zero value, so the error only has to be checked once at the end.
+type codecReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *codecReader) fail(format string, args ...any) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: %s", ErrInvalidEncoding, fmt.Sprintf(format, args...))
+	}
+}
+
+func (r *codecReader) read(b []byte) {
+	if r.err != nil {
+		return
+	}
+
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		r.err = err
+	}
+}
+
+func (r *codecReader) byte() byte {
+	b := make([]byte, 1)
+	r.read(b)
+
+	return b[0]
+}
+
+func (r *codecReader) uint32() uint32 {
+	b := make([]byte, 4)
+	r.read(b)
+
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *codecReader) uint64() uint64 {
+	b := make([]byte, 8)
+	r.read(b)
+
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *codecReader) hash() types.Hash {
+	hash := types.Hash{}
+	r.read(hash[:])
+
+	return hash
+}
+
+func (r *codecReader) address() types.Address {
+	address := types.Address{}
+	r.read(address[:])
+
+	return address
+}
+
+// bytes reads a length prefixed field. An empty field is decoded as nil.
+func (r *codecReader) bytes() []byte {
+	length := r.uint32()
+	if r.err != nil || length == 0 {
+		return nil
+	}
+
+	if length > maxCodecBytes {
+		r.fail("field length %d too large", length)
+		return nil
+	}
+
+	b := make([]byte, length)
+	r.read(b)
+
+	return b
+}
+
+func (r *codecReader) version() {
+	if version := r.byte(); r.err == nil && version != codecVersion {
+		r.fail("unsupported version %d", version)
+	}
+}
+
+func (r *codecReader) header() *Header {
+	return &Header{
+		Version:           r.uint32(),
+		DataHash:          r.hash(),
+		StateRoot:         r.hash(),
+		ReceiptsRoot:      r.hash(),
+		PreviousBlockHash: r.hash(),
+		Timestamp:         int64(r.uint64()),
+		Height:            r.uint32(),
+	}
+}
+
+func (r *codecReader) transaction() *Transaction {
+	tx := &Transaction{
+		ChainID:  r.uint32(),
+		Type:     TxType(r.byte()),
+		Nonce:    r.uint64(),
+		From:     r.bytes(),
+		To:       r.bytes(),
+		Value:    r.uint64(),
+		Fee:      r.uint64(),
+		GasLimit: r.uint64(),
+		Data:     r.bytes(),
+	}
+
+	switch tag := r.byte(); tag {
+	case txInnerNone:
+	case txInnerCollection:
+		tx.TxInner = CollectionTx{
+			Fee:      int64(r.uint64()),
+			MetaData: r.bytes(),
+		}
+	case txInnerMint:
+		mint := MintTx{
+			Fee:             int64(r.uint64()),
+			NFT:             r.hash(),
+			Collection:      r.hash(),
+			MetaData:        r.bytes(),
+			CollectionOwner: r.bytes(),
+		}
+
+		if signature := r.signature(); signature != nil {
+			mint.Signature = *signature
+		}
+
+		tx.TxInner = mint
+	case txInnerDeploy:
+		tx.TxInner = DeployTx{Code: r.bytes()}
+	case txInnerCall:
+		tx.TxInner = CallTx{Contract: r.address()}
+	default:
+		r.fail("unknown tx inner type %d", tag)
+	}
+
+	tx.Signature = r.signature()
+
+	return tx
+}
+
+func (r *codecReader) receipt() *Receipt {
+	receipt := &Receipt{
+		TxHash:          r.hash(),
+		Status:          ReceiptStatus(r.byte()),
+		GasUsed:         r.uint64(),
+		Fee:             r.uint64(),
+		ContractAddress: r.address(),
+	}
+
+	count := r.uint32()
+	if r.err == nil && count > maxCodecBytes {
+		r.fail("log count %d too large", count)
+	}
+
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		receipt.Logs = append(receipt.Logs, &Log{Address: r.address(), Data: r.bytes()})
+	}
+
+	return receipt
+}
+
+func (r *codecReader) signature() *crypto.Signature {
+	switch flag := r.byte(); flag {
+	case 0:
+		return nil
+	case 1:
+		return &crypto.Signature{
+			R: new(big.Int).SetBytes(r.bytes()),
+			S: new(big.Int).SetBytes(r.bytes()),
+		}
+	default:
+		r.fail("invalid signature flag %d", flag)
+		return nil
+	}
+}
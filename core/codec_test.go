@@ -0,0 +1,132 @@
+package core
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/evgeniy-dammer/blockchain/crypto"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+)
+
+// goldenHeader and goldenTransaction only use fixed values, so their encoding never changes
+// unless the layout of the canonical encoding changes
+func goldenHeader() *Header {
+	return &Header{
+		Version:           1,
+		DataHash:          types.Hash{0x01},
+		StateRoot:         types.Hash{0x02},
+		ReceiptsRoot:      types.Hash{0x05},
+		PreviousBlockHash: types.Hash{0x03},
+		Timestamp:         1700000000,
+		Height:            7,
+	}
+}
+
+func goldenTransaction() *Transaction {
+	return &Transaction{
+		ChainID:   5,
+		Type:      TxTypeMint,
+		Nonce:     3,
+		From:      crypto.PublicKey{0xaa, 0xbb},
+		To:        crypto.PublicKey{0xcc},
+		Value:     100,
+		Fee:       9,
+		GasLimit:  21,
+		Data:      []byte("foo"),
+		Signature: &crypto.Signature{R: big.NewInt(0x1234), S: big.NewInt(0x56)},
+	}
+}
+
+func TestCodec_GoldenHeader(t *testing.T) {
+	header := goldenHeader()
+
+	assert.Equal(t, "05000000010100000000000000000000000000000000000000000000000000000000000000020000000000000000000000000000000000000000000000000000000000000005000000000000000000000000000000000000000000000000000000000000000300000000000000000000000000000000000000000000000000000000000000000000006553f10000000007", hex.EncodeToString(header.Bytes()))
+	assert.Equal(t, "73f6242c88aa30036ed594b44c2680c25e1fadfd07e2fa02119763f292cd8b3f", BlockHasher{}.Hash(header).String())
+}
+
+func TestCodec_GoldenTransaction(t *testing.T) {
+	tx := goldenTransaction()
+
+	assert.Equal(t, "050000000501000000000000000300000002aabb00000001cc00000000000000640000000000000009000000000000001500000003666f6f00010000000212340000000156", hex.EncodeToString(encodeTransaction(tx, true)))
+	assert.Equal(t, "13b9aaf28c37009aa90d16ea71b28f3ab80d10355660f58a2d8ce13794b44962", TransactionHasher{}.Hash(tx).String())
+}
+
+func TestCodec_TransactionRoundTrip(t *testing.T) {
+	privateKey := crypto.GeneratePrivateKey()
+
+	transactions := []*Transaction{
+		goldenTransaction(),
+		{Data: []byte("foo")},
+		{Type: TxTypeCollection, TxInner: CollectionTx{Fee: 200, MetaData: []byte("collection")}},
+		{Type: TxTypeMint, TxInner: MintTx{
+			Fee:             100,
+			NFT:             types.Hash{0x04},
+			Collection:      types.Hash{0x05},
+			MetaData:        []byte("mint"),
+			CollectionOwner: privateKey.PublicKey(),
+			Signature:       crypto.Signature{R: big.NewInt(1), S: big.NewInt(2)},
+		}},
+		{TxInner: DeployTx{Code: []byte{0x01, 0x0a}}, GasLimit: 10},
+		{TxInner: CallTx{Contract: types.Address{0x06}}},
+	}
+
+	assert.Nil(t, transactions[1].Sign(privateKey))
+
+	for _, tx := range transactions {
+		buf := &bytes.Buffer{}
+		assert.Nil(t, tx.Encode(NewBinaryTransactionEncoder(buf)))
+
+		decoded := new(Transaction)
+		assert.Nil(t, decoded.Decode(NewBinaryTransactionDecoder(buf)))
+		assert.Equal(t, tx, decoded)
+		assert.Equal(t, 0, buf.Len())
+	}
+}
+
+func TestCodec_BlockRoundTrip(t *testing.T) {
+	block := randomBlock(t, 1, types.Hash{0x01})
+	block.AddTransaction(randomTransactionWithSignature(t))
+
+	collectionTx := &Transaction{ChainID: 5, Type: TxTypeCollection, TxInner: CollectionTx{Fee: 200, MetaData: []byte("collection")}}
+	assert.Nil(t, collectionTx.Sign(crypto.GeneratePrivateKey()))
+	block.AddTransaction(collectionTx)
+
+	assert.Nil(t, block.Sign(crypto.GeneratePrivateKey()))
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, block.Encode(NewBinaryBlockEncoder(buf)))
+	encoded := buf.Bytes()
+
+	decoded := new(Block)
+	assert.Nil(t, decoded.Decode(NewBinaryBlockDecoder(bytes.NewReader(encoded))))
+	assert.Equal(t, block.Hash(BlockHasher{}), decoded.Hash(BlockHasher{}))
+	assert.Equal(t, block.Header, decoded.Header)
+	assert.Equal(t, block.Transactions, decoded.Transactions)
+	assert.Equal(t, block.Validator, decoded.Validator)
+	assert.Equal(t, block.Signature, decoded.Signature)
+	assert.Nil(t, decoded.Verify())
+
+	// the encoding is deterministic
+	again := &bytes.Buffer{}
+	assert.Nil(t, decoded.Encode(NewBinaryBlockEncoder(again)))
+	assert.Equal(t, encoded, again.Bytes())
+}
+
+func TestCodec_DecodeInvalid(t *testing.T) {
+	encoded := encodeTransaction(goldenTransaction(), true)
+
+	// unknown version
+	invalid := append([]byte{0x02}, encoded[1:]...)
+	assert.ErrorIs(t, new(Transaction).Decode(NewBinaryTransactionDecoder(bytes.NewReader(invalid))), ErrInvalidEncoding)
+
+	// truncated input
+	for _, length := range []int{0, 1, 10, len(encoded) - 1} {
+		assert.NotNil(t, new(Transaction).Decode(NewBinaryTransactionDecoder(bytes.NewReader(encoded[:length]))))
+	}
+
+	// unsupported inner transaction
+	unsupported := encodeTransaction(&Transaction{TxInner: "foo"}, false)
+	assert.ErrorIs(t, new(Transaction).Decode(NewBinaryTransactionDecoder(bytes.NewReader(unsupported))), ErrInvalidEncoding)
+}
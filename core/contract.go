@@ -0,0 +1,291 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/types"
+)
+
+// Prefixes which separate the code and the storage of the contracts inside the contract state
+const (
+	contractKeyCode    byte = 'c'
+	contractKeyStorage byte = 's'
+)
+
+var (
+	ErrContractNotFound = errors.New("contract not found")
+	ErrContractExists   = errors.New("contract already exists")
+)
+
+// DeployTx creates a contract with the given code. The contract address is derived from the sender and the transaction nonce.
+type DeployTx struct {
+	Code []byte
+}
+
+// CallTx runs the code of a deployed contract against the storage of that contract
+type CallTx struct {
+	Contract types.Address
+}
+
+// ContractStorage is the key value storage the code of a contract works with
+type ContractStorage interface {
+	Put(key, value []byte) error
+	Get(key []byte) ([]byte, error)
+}
+
+// ContractAddress returns the address of the contract deployed by the sender with the given nonce
+func ContractAddress(sender types.Address, nonce uint64) types.Address {
+	buf := make([]byte, 0, len(sender)+8)
+	buf = append(buf, sender.ToSlice()...)
+	buf = binary.BigEndian.AppendUint64(buf, nonce)
+
+	hash := sha256.Sum256(buf)
+
+	return types.AddressFromBytes(hash[len(hash)-20:])
+}
+
+// contractStorage is the part of the contract state which belongs to a single contract.
+// Every key is prefixed with the contract address, so contracts cannot see each other's storage.
+type contractStorage struct {
+	state  *State
+	prefix []byte
+}
+
+// newContractStorage is a constructor for the contractStorage
+func newContractStorage(state *State, contract types.Address) *contractStorage {
+	return &contractStorage{
+		state:  state,
+		prefix: contractKey(contractKeyStorage, contract),
+	}
+}
+
+// Put
+func (s *contractStorage) Put(key, value []byte) error {
+	return s.state.Put(s.key(key), value)
+}
+
+// Get
+func (s *contractStorage) Get(key []byte) ([]byte, error) {
+	value, err := s.state.Get(s.key(key))
+	if err != nil {
+		return nil, fmt.Errorf("given key %s not found", key)
+	}
+
+	return value, nil
+}
+
+func (s *contractStorage) key(key []byte) []byte {
+	return append(append([]byte{}, s.prefix...), key...)
+}
+
+func contractKey(prefix byte, contract types.Address) []byte {
+	return append([]byte{prefix}, contract.ToSlice()...)
+}
+
+// getContractCode returns the code of a deployed contract
+func getContractCode(state *State, contract types.Address) ([]byte, error) {
+	code, err := state.Get(contractKey(contractKeyCode, contract))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrContractNotFound, contract)
+	}
+
+	return code, nil
+}
+
+// deployContract stores the code of a new contract and creates its account. It returns the gas used,
+// which is GasCodeByte for every byte of the code.
+func (bc *Blockchain) deployContract(state *worldState, tx *Transaction, deploy DeployTx) (uint64, error) {
+	contract := ContractAddress(tx.From.Address(), tx.Nonce)
+
+	gas := uint64(len(deploy.Code)) * GasCodeByte
+	if gas > tx.GasLimit {
+		return tx.GasLimit, fmt.Errorf("%w: deploying %d bytes of code needs %d gas", ErrOutOfGas, len(deploy.Code), gas)
+	}
+
+	if _, err := getContractCode(state.contractState, contract); err == nil {
+		return gas, fmt.Errorf("%w: %s", ErrContractExists, contract)
+	}
+
+	if len(deploy.Code) == 0 {
+		return gas, fmt.Errorf("%w: contract %s has no code", ErrInvalidOpcode, contract)
+	}
+
+	// the code is checked once, so a deployed contract always consists of valid instructions
+	if _, err := analyzeCode(deploy.Code); err != nil {
+		return gas, err
+	}
+
+	if err := state.contractState.Put(contractKey(contractKeyCode, contract), deploy.Code); err != nil {
+		return gas, err
+	}
+
+	state.accountState.AddBalance(contract, 0)
+
+	bc.logger.Log("msg", "deployed contract", "address", contract, "len", len(deploy.Code))
+
+	return gas, nil
+}
+
+// executeContract deploys or calls the contract of the transaction on an overlay of the state and fills in the receipt.
+// If the contract fails, the overlay is dropped and only the receipt records the failure, the transaction
+// still pays its fee. A value the sender cannot pay makes the whole block invalid, like for native transfers.
+func (bc *Blockchain) executeContract(state *worldState, header *Header, tx *Transaction, receipt *Receipt) error {
+	contractState := state.overlay()
+
+	// The value is transferred first, so a called contract already owns it
+	if tx.Value > 0 {
+		if err := bc.handleNativeTransfer(contractState, tx); err != nil {
+			return err
+		}
+	}
+
+	var err error
+
+	switch inner := tx.TxInner.(type) {
+	case DeployTx:
+		receipt.GasUsed, err = bc.deployContract(contractState, tx, inner)
+		if err == nil {
+			receipt.ContractAddress = ContractAddress(tx.From.Address(), tx.Nonce)
+		}
+	case CallTx:
+		receipt.GasUsed, receipt.Logs, err = bc.callContract(contractState, header, tx, inner)
+	default:
+		return fmt.Errorf("unsupported contract tx type %v", inner)
+	}
+
+	if err != nil {
+		bc.logger.Log("msg", "contract transaction failed", "hash", receipt.TxHash, "err", err)
+
+		receipt.Status = ReceiptStatusFailed
+		receipt.Logs = nil
+		receipt.Error = err.Error()
+
+		return nil
+	}
+
+	contractState.commit()
+
+	return nil
+}
+
+// callEnv is the environment shared by all the calls a transaction makes
+type callEnv struct {
+	header *Header
+	txHash types.Hash
+	reads  *[]StorageRead // records the reads of the contract storage, if set
+}
+
+// callContract runs the code of the contract against the contract storage and returns the gas it used
+// and the logs it emitted, including the ones of the contracts it called.
+func (bc *Blockchain) callContract(state *worldState, header *Header, tx *Transaction, call CallTx) (uint64, []*Log, error) {
+	bc.logger.Log("msg", "executing contract", "address", call.Contract, "hash", tx.Hash(TransactionHasher{}))
+
+	env := &callEnv{header: header, txHash: tx.Hash(TransactionHasher{})}
+
+	result := bc.runContract(state, env, tx.From.Address(), &ContractCall{
+		Contract: call.Contract,
+		Value:    tx.Value,
+		GasLimit: tx.GasLimit,
+	}, 0)
+
+	if result.Err != nil {
+		return result.GasUsed, nil, fmt.Errorf("contract %s failed after using %d gas: %w", call.Contract, result.GasUsed, result.Err)
+	}
+
+	return result.GasUsed, result.Logs, nil
+}
+
+// runContract runs the code of the called contract
+func (bc *Blockchain) runContract(state *worldState, env *callEnv, caller types.Address, call *ContractCall, depth int) *CallResult {
+	code, err := getContractCode(state.contractState, call.Contract)
+	if err != nil {
+		return &CallResult{Err: err}
+	}
+
+	result, _ := bc.runCode(state, env, code, caller, call, depth)
+
+	return result
+}
+
+// runCode runs the code against the storage of the called contract and returns the result and the virtual machine
+// it ran in. The code sees the environment of the call, and it may call other contracts with innerCall.
+func (bc *Blockchain) runCode(state *worldState, env *callEnv, code []byte, caller types.Address, call *ContractCall, depth int) (*CallResult, *VirtualMachine) {
+	var storage ContractStorage = newContractStorage(state.contractState, call.Contract)
+	if env.reads != nil {
+		storage = &recordingStorage{ContractStorage: storage, contract: call.Contract, reads: env.reads}
+	}
+
+	vm := NewVirtualMachine(code, storage, call.GasLimit)
+	vm.SetContext(&ExecutionContext{
+		Caller:      caller,
+		Value:       call.Value,
+		Address:     call.Contract,
+		BlockHeight: env.header.Height,
+		Timestamp:   env.header.Timestamp,
+		TxHash:      env.txHash,
+		Balance: func(address types.Address) uint64 {
+			balance, _ := state.accountState.GetBalance(address)
+			return balance
+		},
+		Depth:  depth,
+		Static: call.Static,
+		Call: func(inner *ContractCall) *CallResult {
+			return bc.innerCall(state, env, call.Contract, inner, depth+1)
+		},
+	})
+
+	err := vm.Run()
+
+	return &CallResult{
+		ReturnValue: vm.ReturnValue(),
+		GasUsed:     vm.GasUsed(),
+		Logs:        vm.Logs(),
+		Err:         err,
+	}, vm
+}
+
+// innerCall runs a call of one contract to another on an overlay of the state. The value transfer
+// and the changes of the called code are committed only if the called code succeeds.
+func (bc *Blockchain) innerCall(state *worldState, env *callEnv, caller types.Address, call *ContractCall, depth int) *CallResult {
+	callState := state.overlay()
+
+	if call.Value > 0 {
+		if err := callState.accountState.Transfer(caller, call.Contract, call.Value); err != nil {
+			return &CallResult{Err: err}
+		}
+	}
+
+	result := bc.runContract(callState, env, caller, call, depth)
+	if result.Err == nil {
+		callState.commit()
+	}
+
+	return result
+}
+
+// recordingStorage records every value read from the wrapped storage
+type recordingStorage struct {
+	ContractStorage
+	contract types.Address
+	reads    *[]StorageRead
+}
+
+// Get
+func (s *recordingStorage) Get(key []byte) ([]byte, error) {
+	b, err := s.ContractStorage.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if value, err := decodeValue(b); err == nil {
+		*s.reads = append(*s.reads, StorageRead{
+			Contract: s.contract,
+			Key:      append([]byte{}, key...),
+			Value:    value,
+		})
+	}
+
+	return b, nil
+}
@@ -0,0 +1,539 @@
+package core
+
+import (
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/crypto"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// storeFooCode stores FOO = 5 in the contract storage
+var storeFooCode = []byte{0x05, 0x0a, 0x46, 0x0c, 0x4f, 0x0c, 0x4f, 0x0c, 0x03, 0x0a, 0x0d, 0x0f}
+
+// contractBlock returns a sealed block on top of the blockchain head with the given transactions signed by the key.
+// The signer is given the gas its deploys and calls pay up front, a deploy gets exactly the gas its code needs.
+func contractBlock(t *testing.T, bc *Blockchain, privateKey crypto.PrivateKey, inners ...any) *Block {
+	block := randomBlock(t, bc.Height()+1, getPreviousBlockHash(t, bc, bc.Height()+1))
+	block.Transactions = nil
+
+	nonce := bc.NextNonce(privateKey.PublicKey().Address())
+
+	for i, inner := range inners {
+		tx := &Transaction{TxInner: inner, Nonce: nonce + uint64(i), GasLimit: 1000}
+		if deploy, ok := inner.(DeployTx); ok {
+			tx.GasLimit = uint64(len(deploy.Code)) * GasCodeByte
+		}
+
+		assert.Nil(t, tx.Sign(privateKey))
+		block.AddTransaction(tx)
+
+		if tx.paysGas() {
+			fundAccount(bc, privateKey.PublicKey().Address(), tx.GasLimit*bc.GasPrice())
+		}
+	}
+
+	sealBlock(t, bc, block)
+
+	return block
+}
+
+func TestBlockchain_DeployAndCallContract(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+
+	contractA := ContractAddress(sender, 0)
+	contractB := ContractAddress(sender, 1)
+	assert.NotEqual(t, contractA, contractB)
+
+	block := contractBlock(t, bc, privateKey, DeployTx{Code: storeFooCode}, DeployTx{Code: storeFooCode}, CallTx{Contract: contractA})
+	assert.Nil(t, bc.AddBlock(block))
+
+	code, err := getContractCode(bc.contractState, contractA)
+	assert.Nil(t, err)
+	assert.Equal(t, storeFooCode, code)
+
+	_, err = bc.accountState.GetAccount(contractA)
+	assert.Nil(t, err)
+
+	// the call only changed the storage of the called contract
+	value, err := newContractStorage(bc.contractState, contractA).Get([]byte("FOO"))
+	assert.Nil(t, err)
+	assert.Equal(t, NewWord(5), mustDecodeValue(t, value))
+
+	_, err = newContractStorage(bc.contractState, contractB).Get([]byte("FOO"))
+	assert.NotNil(t, err)
+
+	_, err = bc.contractState.Get([]byte("FOO"))
+	assert.NotNil(t, err)
+
+	receipt, err := bc.GetReceipt(block.Transactions[2].Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, 6*GasFastStep+3*GasPackByte+GasStore, receipt.GasUsed)
+}
+
+func TestBlockchain_CallUnknownContract(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+
+	block := contractBlock(t, bc, crypto.GeneratePrivateKey(), CallTx{Contract: types.Address{0x01}})
+	assert.Nil(t, bc.AddBlock(block))
+
+	receipt, err := bc.GetReceipt(block.Transactions[0].Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptStatusFailed, receipt.Status)
+	assert.Contains(t, receipt.Error, ErrContractNotFound.Error())
+}
+
+func TestBlockchain_DeployInvalidCode(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+
+	block := contractBlock(t, bc, privateKey, DeployTx{Code: []byte{0x01}})
+	assert.Nil(t, bc.AddBlock(block))
+
+	receipt, err := bc.GetReceipt(block.Transactions[0].Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptStatusFailed, receipt.Status)
+	assert.Contains(t, receipt.Error, ErrInvalidOpcode.Error())
+	assert.Equal(t, types.Address{}, receipt.ContractAddress)
+
+	_, err = getContractCode(bc.contractState, ContractAddress(privateKey.PublicKey().Address(), 0))
+	assert.ErrorIs(t, err, ErrContractNotFound)
+}
+
+func TestBlockchain_DeployPaysGas(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+	gas := uint64(len(storeFooCode)) * GasCodeByte
+
+	deploy := func(nonce, gasLimit uint64) *Block {
+		tx := &Transaction{TxInner: DeployTx{Code: storeFooCode}, Nonce: nonce, GasLimit: gasLimit, Fee: 5}
+		assert.Nil(t, tx.Sign(privateKey))
+
+		block := randomBlock(t, bc.Height()+1, getPreviousBlockHash(t, bc, bc.Height()+1))
+		block.Transactions = nil
+		block.AddTransaction(tx)
+		sealBlock(t, bc, block)
+
+		return block
+	}
+
+	// the code is not stored for free
+	assert.ErrorIs(t, bc.AddBlock(deploy(0, gas)), ErrInsufficientBalance)
+
+	// a gas limit below the size of the code uses up the whole limit
+	fundAccount(bc, sender, 5+gas-1+5+gas+100)
+
+	block := deploy(0, gas-1)
+	assert.Nil(t, bc.AddBlock(block))
+
+	receipt, err := bc.GetReceipt(block.Transactions[0].Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptStatusFailed, receipt.Status)
+	assert.Contains(t, receipt.Error, ErrOutOfGas.Error())
+	assert.Equal(t, gas-1, receipt.GasUsed)
+	assert.Equal(t, 5+gas-1, receipt.Fee)
+
+	_, err = getContractCode(bc.contractState, ContractAddress(sender, 0))
+	assert.ErrorIs(t, err, ErrContractNotFound)
+
+	// the gas the code does not need is refunded
+	block = deploy(1, gas+100)
+	assert.Nil(t, bc.AddBlock(block))
+
+	receipt, err = bc.GetReceipt(block.Transactions[0].Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+	assert.True(t, receipt.Succeeded(), receipt.Error)
+	assert.Equal(t, gas, receipt.GasUsed)
+	assert.Equal(t, 5+gas, receipt.Fee)
+
+	balance, err := bc.accountState.GetBalance(sender)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), balance)
+}
+
+func TestBlockchain_ContractContext(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	fundAccount(bc, privateKey.PublicKey().Address(), 100+1000)
+	contract := ContractAddress(privateKey.PublicKey().Address(), 0)
+
+	// stores the block height under H and the value sent with the call under V
+	code := []byte{0x43, 0x48, 0x0c, 0x0f, 0x34, 0x56, 0x0c, 0x0f}
+	assert.Nil(t, bc.AddBlock(contractBlock(t, bc, privateKey, DeployTx{Code: code})))
+
+	tx := &Transaction{TxInner: CallTx{Contract: contract}, Nonce: 1, GasLimit: 1000, Value: 30}
+	assert.Nil(t, tx.Sign(privateKey))
+
+	block := randomBlock(t, 2, getPreviousBlockHash(t, bc, 2))
+	block.Transactions = nil
+	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+
+	storage := newContractStorage(bc.contractState, contract)
+
+	for key, expected := range map[string]Word{"H": NewWord(2), "V": NewWord(30)} {
+		value, err := storage.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, mustDecodeValue(t, value), key)
+	}
+
+	balance, err := bc.accountState.GetBalance(contract)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(30), balance)
+}
+
+func TestBlockchain_ContractReceipts(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+	fundAccount(bc, sender, 100)
+
+	code, err := Assemble(`
+		PUSH 7
+		LOG
+		PUSHB 'a'
+		PUSH 1
+		PACK
+		LOG
+	`)
+	assert.Nil(t, err)
+
+	deploy := contractBlock(t, bc, privateKey, DeployTx{Code: code})
+	assert.Nil(t, bc.AddBlock(deploy))
+
+	contract := ContractAddress(sender, 0)
+
+	receipt, err := bc.GetReceipt(deploy.Transactions[0].Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+	assert.True(t, receipt.Succeeded())
+	assert.Equal(t, contract, receipt.ContractAddress)
+	assert.Empty(t, receipt.Logs)
+
+	call := contractBlock(t, bc, privateKey, CallTx{Contract: contract})
+	assert.Nil(t, bc.AddBlock(call))
+	assert.NotEqual(t, ReceiptsRoot(nil), call.Header.ReceiptsRoot)
+
+	receipt, err = bc.GetReceipt(call.Transactions[0].Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+	assert.True(t, receipt.Succeeded())
+	assert.Equal(t, []*Log{
+		{Address: contract, Data: NewWord(7).Bytes()},
+		{Address: contract, Data: []byte("a")},
+	}, receipt.Logs)
+}
+
+func TestBlockchain_FailedCallKeepsValue(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+	fundAccount(bc, sender, 100+1000)
+
+	// stores FOO = 5 and fails afterwards, because ADD has no operands
+	code := append(append([]byte{}, storeFooCode...), byte(InstructionAdd))
+	assert.Nil(t, bc.AddBlock(contractBlock(t, bc, privateKey, DeployTx{Code: code})))
+
+	contract := ContractAddress(sender, 0)
+
+	tx := &Transaction{TxInner: CallTx{Contract: contract}, Nonce: 1, GasLimit: 1000, Value: 30, Fee: 5}
+	assert.Nil(t, tx.Sign(privateKey))
+
+	block := randomBlock(t, 2, getPreviousBlockHash(t, bc, 2))
+	block.Transactions = nil
+	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+
+	receipt, err := bc.GetReceipt(tx.Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, ReceiptStatusFailed, receipt.Status)
+	assert.Contains(t, receipt.Error, ErrStackUnderflow.Error())
+
+	// the sender only paid the fee and the gas, the value and the storage changes are dropped
+	assert.Equal(t, 5+receipt.GasUsed, receipt.Fee)
+
+	balance, err := bc.accountState.GetBalance(sender)
+	assert.Nil(t, err)
+	assert.Equal(t, 1100-receipt.Fee, balance)
+
+	balance, err = bc.accountState.GetBalance(contract)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), balance)
+
+	_, err = newContractStorage(bc.contractState, contract).Get([]byte("FOO"))
+	assert.NotNil(t, err)
+}
+
+func TestBlockchain_GasPrice(t *testing.T) {
+	bc, err := NewBlockchainWithOptions(randomBlock(t, 0, types.Hash{}), BlockchainOptions{GasPrice: 2})
+	assert.Nil(t, err)
+
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+
+	assert.Nil(t, bc.AddBlock(contractBlock(t, bc, privateKey, DeployTx{Code: storeFooCode})))
+	fundAccount(bc, sender, 5+1000*2)
+
+	contract := ContractAddress(sender, 0)
+
+	// the sender cannot pay the gas limit at the gas price
+	tx := &Transaction{TxInner: CallTx{Contract: contract}, Nonce: 1, GasLimit: 1001, Fee: 5}
+	assert.Nil(t, tx.Sign(privateKey))
+
+	block := randomBlock(t, 2, getPreviousBlockHash(t, bc, 2))
+	block.Transactions = nil
+	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
+	assert.ErrorIs(t, bc.AddBlock(block), ErrInsufficientBalance)
+
+	tx = &Transaction{TxInner: CallTx{Contract: contract}, Nonce: 1, GasLimit: 1000, Fee: 5}
+	assert.Nil(t, tx.Sign(privateKey))
+
+	block.Transactions = nil
+	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+
+	receipt, err := bc.GetReceipt(tx.Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+	assert.True(t, receipt.Succeeded(), receipt.Error)
+	assert.Less(t, receipt.GasUsed, uint64(1000))
+
+	// the gas used is charged, the rest of the gas limit is refunded
+	assert.Equal(t, 5+receipt.GasUsed*2, receipt.Fee)
+
+	balance, err := bc.accountState.GetBalance(sender)
+	assert.Nil(t, err)
+	assert.Equal(t, 5+1000*2-receipt.Fee, balance)
+
+	balance, err = bc.accountState.GetBalance(block.Validator.Address())
+	assert.Nil(t, err)
+	assert.Equal(t, receipt.Fee, balance)
+
+	fees, err := bc.BlockFees(block)
+	assert.Nil(t, err)
+	assert.Equal(t, receipt.Fee, fees)
+}
+
+// addressSource is the assembly source which pushes the address
+func addressSource(address types.Address) string {
+	source := ""
+	for _, b := range address {
+		source += fmt.Sprintf("PUSHB %d\n", b)
+	}
+
+	return source + "PUSH 20\nPACK\n"
+}
+
+// mustAssemble assembles the source of a test contract
+func mustAssemble(t *testing.T, source string) []byte {
+	code, err := Assemble(source)
+	assert.Nil(t, err)
+
+	return code
+}
+
+// sendCall adds a block which calls the contract with the given value and gas limit and returns the receipt of the call.
+// The sender is given the gas the call pays up front.
+func sendCall(t *testing.T, bc *Blockchain, privateKey crypto.PrivateKey, contract types.Address, value, gasLimit uint64) *Receipt {
+	fundAccount(bc, privateKey.PublicKey().Address(), gasLimit*bc.GasPrice())
+
+	tx := &Transaction{
+		TxInner:  CallTx{Contract: contract},
+		Nonce:    bc.NextNonce(privateKey.PublicKey().Address()),
+		Value:    value,
+		GasLimit: gasLimit,
+	}
+	assert.Nil(t, tx.Sign(privateKey))
+
+	block := randomBlock(t, bc.Height()+1, getPreviousBlockHash(t, bc, bc.Height()+1))
+	block.Transactions = nil
+	block.AddTransaction(tx)
+	sealBlock(t, bc, block)
+	assert.Nil(t, bc.AddBlock(block))
+
+	receipt, err := bc.GetReceipt(tx.Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+
+	return receipt
+}
+
+// storedValue returns the value the contract stored under the key
+func storedValue(t *testing.T, bc *Blockchain, contract types.Address, key string) Value {
+	value, err := newContractStorage(bc.contractState, contract).Get([]byte(key))
+	assert.Nil(t, err, key)
+
+	return mustDecodeValue(t, value)
+}
+
+func TestBlockchain_ContractCall(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+
+	callee := ContractAddress(sender, 0)
+	caller := ContractAddress(sender, 1)
+
+	calleeCode := mustAssemble(t, `
+		PUSH 42
+		PUSHB 'x'
+		STORE
+		PUSH 7
+		LOG
+		CALLER
+		RETURN
+	`)
+
+	// calls the callee and stores whether the call succeeded under s and what it returned under r
+	callerCode := mustAssemble(t, addressSource(callee)+`
+		PUSH 0
+		PUSH 255
+		CALL
+		PUSHB 's'
+		STORE
+		PUSHB 'r'
+		STORE
+	`)
+
+	assert.Nil(t, bc.AddBlock(contractBlock(t, bc, privateKey, DeployTx{Code: calleeCode}, DeployTx{Code: callerCode})))
+
+	receipt := sendCall(t, bc, privateKey, caller, 0, 1000)
+	assert.True(t, receipt.Succeeded(), receipt.Error)
+	assert.Equal(t, []*Log{{Address: callee, Data: NewWord(7).Bytes()}}, receipt.Logs)
+
+	assert.Equal(t, NewWord(1), storedValue(t, bc, caller, "s"))
+	assert.Equal(t, Bytes(caller.ToSlice()), storedValue(t, bc, caller, "r"))
+	assert.Equal(t, NewWord(42), storedValue(t, bc, callee, "x"))
+}
+
+func TestBlockchain_ContractCallRevert(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+	fundAccount(bc, sender, 100)
+
+	failing := ContractAddress(sender, 0)
+	stopping := ContractAddress(sender, 1)
+	caller := ContractAddress(sender, 2)
+
+	// sends 5 to the failing contract and 3 to the stopping one, the results are stored under f and s
+	callerCode := mustAssemble(t, addressSource(failing)+`
+		PUSH 5
+		PUSH 255
+		CALL
+		PUSHB 'f'
+		STORE
+		POP
+	`+addressSource(stopping)+`
+		PUSH 3
+		PUSH 255
+		CALL
+		PUSHB 's'
+		STORE
+	`)
+
+	// stores FOO = 5 and fails afterwards
+	failingCode := append(append([]byte{}, storeFooCode...), byte(InstructionAdd))
+
+	block := contractBlock(t, bc, privateKey, DeployTx{Code: failingCode}, DeployTx{Code: []byte{byte(InstructionStop)}}, DeployTx{Code: callerCode})
+	assert.Nil(t, bc.AddBlock(block))
+
+	receipt := sendCall(t, bc, privateKey, caller, 10, 1000)
+	assert.True(t, receipt.Succeeded(), receipt.Error)
+
+	// only the failing call is rolled back
+	assert.Equal(t, NewWord(0), storedValue(t, bc, caller, "f"))
+	assert.Equal(t, NewWord(1), storedValue(t, bc, caller, "s"))
+
+	_, err := newContractStorage(bc.contractState, failing).Get([]byte("FOO"))
+	assert.NotNil(t, err)
+
+	for contract, expected := range map[types.Address]uint64{caller: 7, failing: 0, stopping: 3} {
+		balance, err := bc.accountState.GetBalance(contract)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, balance, contract.String())
+	}
+}
+
+func TestBlockchain_StaticCall(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+
+	writing := ContractAddress(sender, 0)
+	reading := ContractAddress(sender, 1)
+	caller := ContractAddress(sender, 2)
+
+	callerCode := mustAssemble(t, addressSource(writing)+`
+		PUSH 255
+		STATICCALL
+		PUSHB 'w'
+		STORE
+		POP
+	`+addressSource(reading)+`
+		PUSH 255
+		STATICCALL
+		POP
+		PUSHB 'r'
+		STORE
+	`)
+
+	block := contractBlock(t, bc, privateKey,
+		DeployTx{Code: mustAssemble(t, "PUSH 1\nPUSHB 'x'\nSTORE")},
+		DeployTx{Code: mustAssemble(t, "PUSH 9\nRETURN")},
+		DeployTx{Code: callerCode},
+	)
+	assert.Nil(t, bc.AddBlock(block))
+
+	receipt := sendCall(t, bc, privateKey, caller, 0, 1000)
+	assert.True(t, receipt.Succeeded(), receipt.Error)
+
+	// the writing contract fails with ErrWriteProtection, the reading one returns its value
+	assert.Equal(t, NewWord(0), storedValue(t, bc, caller, "w"))
+	assert.Equal(t, NewWord(9), storedValue(t, bc, caller, "r"))
+}
+
+func TestBlockchain_CallGasForwarding(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+
+	looping := ContractAddress(sender, 0)
+	caller := ContractAddress(sender, 1)
+
+	// forwards 10 gas to a contract which loops until its gas is used up
+	callerCode := mustAssemble(t, addressSource(looping)+"PUSH 0\nPUSH 10\nCALL")
+
+	block := contractBlock(t, bc, privateKey, DeployTx{Code: mustAssemble(t, "loop:\nPUSH loop\nJUMP")}, DeployTx{Code: callerCode})
+	assert.Nil(t, bc.AddBlock(block))
+
+	receipt := sendCall(t, bc, privateKey, caller, 0, 1000)
+	assert.True(t, receipt.Succeeded(), receipt.Error)
+	assert.Equal(t, 20*GasFastStep+GasFastStep+GasFastStep+20*GasPackByte+2*GasFastStep+GasCall+10, receipt.GasUsed)
+}
+
+func TestBlockchain_CallDepth(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	contract := ContractAddress(privateKey.PublicKey().Address(), 0)
+
+	// logs and calls itself with all its gas, until the depth limit stops it
+	code := mustAssemble(t, `
+		PUSH 1
+		LOG
+		ADDRESS
+		PUSH 0
+		PUSH 0
+		PUSH 1
+		SUB
+		CALL
+	`)
+	assert.Nil(t, bc.AddBlock(contractBlock(t, bc, privateKey, DeployTx{Code: code})))
+
+	receipt := sendCall(t, bc, privateKey, contract, 0, 100000)
+	assert.True(t, receipt.Succeeded(), receipt.Error)
+	assert.Len(t, receipt.Logs, MaxCallDepth+1)
+}
@@ -0,0 +1,383 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	defaultSegmentSize = 64 << 20 // 64 MiB
+	segmentFilePattern = "blocks-%06d.seg"
+	// recordHeaderSize is the size of a record header: payload length, payload checksum, block height and block hash
+	recordHeaderSize = 4 + 4 + 4 + 32
+	// maxRecordSize is the largest payload of a record, a longer one can only come from a corrupted header
+	maxRecordSize = 32 << 20 // 32 MiB
+)
+
+var ErrCorruptedStore = errors.New("block store is corrupted")
+
+// segmentFile is the part of an os.File the store uses for a segment
+type segmentFile interface {
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// blockLocation is a position of an encoded block inside the segment files
+type blockLocation struct {
+	segment int
+	offset  int64
+	length  uint32
+}
+
+// DiskStore is an append-only block store. Blocks and their receipts are written to segment files one after another,
+// every segment is rotated after it grows beyond maxSegmentSize. The index by hash and by height is
+// kept in memory and rebuilt from the segment files when the store is opened.
+type DiskStore struct {
+	lock           sync.RWMutex
+	dir            string
+	maxSegmentSize int64
+	segments       map[int]segmentFile
+	active         int
+	activeSize     int64
+	byHash         map[types.Hash]blockLocation
+	byHeight       map[uint32][]types.Hash
+	maxHeight      uint32
+}
+
+// NewDiskStore is a constructor for the DiskStore. It opens or creates the store inside the given directory.
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	ds := &DiskStore{
+		dir:            dir,
+		maxSegmentSize: defaultSegmentSize,
+		segments:       make(map[int]segmentFile),
+		byHash:         make(map[types.Hash]blockLocation),
+		byHeight:       make(map[uint32][]types.Hash),
+	}
+
+	if err := ds.open(); err != nil {
+		ds.Close()
+		return nil, err
+	}
+
+	return ds, nil
+}
+
+// Put appends a block to the active segment, its receipts are stored in the same record right after it
+func (ds *DiskStore) Put(block *Block, receipts []*Receipt) error {
+	hash := block.Hash(BlockHasher{})
+
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	if _, ok := ds.byHash[hash]; ok {
+		return nil
+	}
+
+	payload := &bytes.Buffer{}
+	if err := block.Encode(NewBinaryBlockEncoder(payload)); err != nil {
+		return err
+	}
+
+	if err := NewBinaryReceiptsEncoder(payload).Encode(receipts); err != nil {
+		return err
+	}
+
+	if payload.Len() > maxRecordSize {
+		return fmt.Errorf("encoded block and receipts of %d bytes exceed the maximum record size", payload.Len())
+	}
+
+	if ds.activeSize > 0 && ds.activeSize+recordHeaderSize+int64(payload.Len()) > ds.maxSegmentSize {
+		if err := ds.rotate(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, recordHeaderSize, recordHeaderSize+payload.Len())
+	binary.BigEndian.PutUint32(record[0:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload.Bytes()))
+	binary.BigEndian.PutUint32(record[8:12], block.Header.Height)
+	copy(record[12:recordHeaderSize], hash.ToSlice())
+	record = append(record, payload.Bytes()...)
+
+	file := ds.segments[ds.active]
+	if _, err := file.Write(record); err != nil {
+		ds.discard(file)
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		ds.discard(file)
+		return err
+	}
+
+	ds.index(hash, block.Header.Height, blockLocation{
+		segment: ds.active,
+		offset:  ds.activeSize + recordHeaderSize,
+		length:  uint32(payload.Len()),
+	})
+	ds.activeSize += int64(len(record))
+
+	return nil
+}
+
+// Get reads a block with the given hash from disk
+func (ds *DiskStore) Get(hash types.Hash) (*Block, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	block := new(Block)
+
+	if err := ds.get(hash, func(r io.Reader) error { return block.Decode(NewBinaryBlockDecoder(r)) }); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// GetReceipts reads the receipts of the block with the given hash from disk
+func (ds *DiskStore) GetReceipts(hash types.Hash) ([]*Receipt, error) {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	var receipts []*Receipt
+
+	err := ds.get(hash, func(r io.Reader) error {
+		if err := new(Block).Decode(NewBinaryBlockDecoder(r)); err != nil {
+			return err
+		}
+
+		return NewBinaryReceiptsDecoder(r).Decode(&receipts)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return receipts, nil
+}
+
+// Has checks if the store contains a block with the given hash
+func (ds *DiskStore) Has(hash types.Hash) bool {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	_, ok := ds.byHash[hash]
+
+	return ok
+}
+
+// Iterate reads every stored block in ascending height order and calls fn for it
+func (ds *DiskStore) Iterate(fn func(block *Block) error) error {
+	ds.lock.RLock()
+	hashes := make([]types.Hash, 0, len(ds.byHash))
+
+	for height := uint32(0); height <= ds.maxHeight && len(ds.byHash) > 0; height++ {
+		hashes = append(hashes, ds.byHeight[height]...)
+	}
+	ds.lock.RUnlock()
+
+	for _, hash := range hashes {
+		block, err := ds.Get(hash)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes all opened segment files
+func (ds *DiskStore) Close() error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	var firstErr error
+
+	for id, file := range ds.segments {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		delete(ds.segments, id)
+	}
+
+	return firstErr
+}
+
+// get reads the record of the block with the given hash and passes its payload to decode
+func (ds *DiskStore) get(hash types.Hash, decode func(r io.Reader) error) error {
+	location, ok := ds.byHash[hash]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrBlockNotFound, hash)
+	}
+
+	payload := make([]byte, location.length)
+	if _, err := ds.segments[location.segment].ReadAt(payload, location.offset); err != nil {
+		return err
+	}
+
+	return decode(bytes.NewReader(payload))
+}
+
+func (ds *DiskStore) index(hash types.Hash, height uint32, location blockLocation) {
+	ds.byHash[hash] = location
+	ds.byHeight[height] = append(ds.byHeight[height], hash)
+
+	if height > ds.maxHeight {
+		ds.maxHeight = height
+	}
+}
+
+// open opens all existing segments and rebuilds the index. A partially written record at the end
+// of the last segment is the result of an interrupted write, so it is truncated.
+func (ds *DiskStore) open() error {
+	matches, err := filepath.Glob(filepath.Join(ds.dir, "blocks-*.seg"))
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int, 0, len(matches))
+
+	for _, match := range matches {
+		var id int
+		if _, err = fmt.Sscanf(filepath.Base(match), segmentFilePattern, &id); err != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+
+	if len(ids) == 0 {
+		ids = append(ids, 1)
+	}
+
+	for i, id := range ids {
+		file, err := os.OpenFile(ds.segmentPath(id), os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+
+		ds.segments[id] = file
+
+		size, err := ds.scan(id, file)
+		if err != nil {
+			if i != len(ids)-1 || !errors.Is(err, ErrCorruptedStore) {
+				return err
+			}
+
+			if err = file.Truncate(size); err != nil {
+				return err
+			}
+		}
+
+		ds.active = id
+		ds.activeSize = size
+	}
+
+	_, err = ds.segments[ds.active].Seek(ds.activeSize, io.SeekStart)
+
+	return err
+}
+
+// scan reads all records of a segment and adds them to the index. It returns the size of the valid part of the segment.
+func (ds *DiskStore) scan(id int, file segmentFile) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		offset int64
+		size   = info.Size()
+		header = make([]byte, recordHeaderSize)
+	)
+
+	for {
+		if _, err := file.ReadAt(header, offset); err != nil {
+			if err == io.EOF && offset == size {
+				return offset, nil
+			}
+
+			return offset, fmt.Errorf("%w: truncated record header in segment %d at %d", ErrCorruptedStore, id, offset)
+		}
+
+		var (
+			length   = binary.BigEndian.Uint32(header[0:4])
+			checksum = binary.BigEndian.Uint32(header[4:8])
+			height   = binary.BigEndian.Uint32(header[8:12])
+			hash     = types.HashFromBytes(header[12:recordHeaderSize])
+		)
+
+		// the length is not covered by the checksum, so it is checked before the payload is allocated
+		if length > maxRecordSize || int64(length) > size-offset-recordHeaderSize {
+			return offset, fmt.Errorf("%w: invalid record length %d in segment %d at %d", ErrCorruptedStore, length, id, offset)
+		}
+
+		payload := make([]byte, length)
+		if _, err := file.ReadAt(payload, offset+recordHeaderSize); err != nil {
+			return offset, fmt.Errorf("%w: truncated record in segment %d at %d", ErrCorruptedStore, id, offset)
+		}
+
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return offset, fmt.Errorf("%w: checksum mismatch in segment %d at %d", ErrCorruptedStore, id, offset)
+		}
+
+		ds.index(hash, height, blockLocation{
+			segment: id,
+			offset:  offset + recordHeaderSize,
+			length:  length,
+		})
+
+		offset += recordHeaderSize + int64(length)
+	}
+}
+
+// discard drops whatever part of a failed record was written to the active segment,
+// so the next record starts at a known offset
+func (ds *DiskStore) discard(file segmentFile) {
+	if err := file.Truncate(ds.activeSize); err == nil {
+		file.Seek(ds.activeSize, io.SeekStart)
+	}
+}
+
+func (ds *DiskStore) rotate() error {
+	id := ds.active + 1
+
+	file, err := os.OpenFile(ds.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	ds.segments[id] = file
+	ds.active = id
+	ds.activeSize = 0
+
+	return nil
+}
+
+func (ds *DiskStore) segmentPath(id int) string {
+	return filepath.Join(ds.dir, fmt.Sprintf(segmentFilePattern, id))
+}
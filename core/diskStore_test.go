@@ -0,0 +1,187 @@
+package core
+
+import (
+	"errors"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_PutGet(t *testing.T) {
+	store, err := NewDiskStore(t.TempDir())
+	assert.Nil(t, err)
+	defer store.Close()
+
+	block := randomBlock(t, 0, types.Hash{})
+	hash := block.Hash(BlockHasher{})
+
+	receipts := []*Receipt{
+		{TxHash: types.Hash{0x01}, GasUsed: 21, Fee: 26, Logs: []*Log{{Address: types.Address{0x02}, Data: []byte("log")}}},
+		{TxHash: types.Hash{0x03}, Status: ReceiptStatusFailed, ContractAddress: types.Address{0x04}, Error: "out of gas"},
+	}
+
+	assert.False(t, store.Has(hash))
+	assert.Nil(t, store.Put(block, receipts))
+	assert.True(t, store.Has(hash))
+
+	fetchedBlock, err := store.Get(hash)
+	assert.Nil(t, err)
+	assert.Equal(t, hash, fetchedBlock.Hash(BlockHasher{}))
+	assert.Equal(t, block.Header, fetchedBlock.Header)
+
+	fetchedReceipts, err := store.GetReceipts(hash)
+	assert.Nil(t, err)
+	assert.Equal(t, receipts, fetchedReceipts)
+
+	_, err = store.Get(types.Hash{})
+	assert.ErrorIs(t, err, ErrBlockNotFound)
+
+	_, err = store.GetReceipts(types.Hash{})
+	assert.ErrorIs(t, err, ErrBlockNotFound)
+}
+
+func TestDiskStore_Reopen(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+
+	// force a new segment for every block
+	store.maxSegmentSize = 1
+
+	hashes := []types.Hash{}
+	prevHash := types.Hash{}
+
+	for i := 0; i < 5; i++ {
+		block := randomBlock(t, uint32(i), prevHash)
+		prevHash = block.Hash(BlockHasher{})
+		hashes = append(hashes, prevHash)
+
+		assert.Nil(t, store.Put(block, nil))
+	}
+
+	assert.Nil(t, store.Close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	assert.Nil(t, err)
+	assert.Len(t, segments, 5)
+
+	store, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	iterated := []types.Hash{}
+	assert.Nil(t, store.Iterate(func(block *Block) error {
+		iterated = append(iterated, block.Hash(BlockHasher{}))
+		return nil
+	}))
+	assert.Equal(t, hashes, iterated)
+}
+
+func TestDiskStore_TruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+
+	first := randomBlock(t, 0, types.Hash{})
+	second := randomBlock(t, 1, first.Hash(BlockHasher{}))
+	assert.Nil(t, store.Put(first, nil))
+	assert.Nil(t, store.Put(second, nil))
+	assert.Nil(t, store.Close())
+
+	// simulate a crash in the middle of writing the second block
+	path := filepath.Join(dir, "blocks-000001.seg")
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(path, info.Size()-10))
+
+	store, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+
+	assert.True(t, store.Has(first.Hash(BlockHasher{})))
+	assert.False(t, store.Has(second.Hash(BlockHasher{})))
+
+	// the store keeps accepting blocks after the broken record has been dropped
+	assert.Nil(t, store.Put(second, nil))
+	assert.Nil(t, store.Close())
+
+	store, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	assert.True(t, store.Has(second.Hash(BlockHasher{})))
+}
+
+func TestDiskStore_CorruptedLength(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewDiskStore(dir)
+	assert.Nil(t, err)
+
+	first := randomBlock(t, 0, types.Hash{})
+	second := randomBlock(t, 1, first.Hash(BlockHasher{}))
+	assert.Nil(t, store.Put(first, nil))
+	assert.Nil(t, store.Put(second, nil))
+
+	offset := store.byHash[second.Hash(BlockHasher{})].offset - recordHeaderSize
+	assert.Nil(t, store.Close())
+
+	// a corrupted header of the last record claims a huge payload
+	path := filepath.Join(dir, "blocks-000001.seg")
+	file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	assert.Nil(t, err)
+	_, err = file.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, offset)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	store, err = NewDiskStore(dir)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	assert.True(t, store.Has(first.Hash(BlockHasher{})))
+	assert.False(t, store.Has(second.Hash(BlockHasher{})))
+}
+
+// failingSyncFile is a segment whose next Sync fails
+type failingSyncFile struct {
+	*os.File
+	fail bool
+}
+
+func (f *failingSyncFile) Sync() error {
+	if f.fail {
+		f.fail = false
+		return errors.New("sync failed")
+	}
+
+	return f.File.Sync()
+}
+
+func TestDiskStore_FailedSync(t *testing.T) {
+	store, err := NewDiskStore(t.TempDir())
+	assert.Nil(t, err)
+	defer store.Close()
+
+	file := &failingSyncFile{File: store.segments[store.active].(*os.File), fail: true}
+	store.segments[store.active] = file
+
+	first := randomBlock(t, 0, types.Hash{})
+	second := randomBlock(t, 1, first.Hash(BlockHasher{}))
+
+	assert.NotNil(t, store.Put(first, nil))
+	assert.False(t, store.Has(first.Hash(BlockHasher{})))
+
+	// the failed record is dropped, so the next one is indexed at the offset it was written to
+	assert.Nil(t, store.Put(second, nil))
+
+	fetched, err := store.Get(second.Hash(BlockHasher{}))
+	assert.Nil(t, err)
+	assert.Equal(t, second.Header, fetched.Header)
+
+	info, err := file.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, store.activeSize, info.Size())
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"github.com/evgeniy-dammer/blockchain/types"
+)
+
+// ChainTip describes the last block of a branch of the block tree
+type ChainTip struct {
+	Hash   types.Hash
+	Height uint32
+	Weight uint64 // accumulated weight of all blocks of the branch
+}
+
+// ForkChoice decides which branch of the block tree is the canonical chain
+type ForkChoice interface {
+	// Weight returns the weight the block adds to the branch it extends
+	Weight(block *Block) uint64
+	// Better reports whether the candidate branch has to replace the current canonical branch
+	Better(candidate, current ChainTip) bool
+}
+
+// LongestChain prefers the branch with the most blocks. On a tie the branch which was seen first is kept.
+type LongestChain struct{}
+
+// Weight
+func (LongestChain) Weight(*Block) uint64 {
+	return 1
+}
+
+// Better
+func (LongestChain) Better(candidate, current ChainTip) bool {
+	return candidate.Height > current.Height
+}
+
+// HeaviestChain prefers the branch with the highest accumulated weight. On a tie the branch which
+// was seen first is kept. A block weighs one plus the number of its transactions unless BlockWeight is set.
+type HeaviestChain struct {
+	BlockWeight func(block *Block) uint64
+}
+
+// Weight
+func (c HeaviestChain) Weight(block *Block) uint64 {
+	if c.BlockWeight != nil {
+		return c.BlockWeight(block)
+	}
+
+	return 1 + uint64(len(block.Transactions))
+}
+
+// Better
+func (HeaviestChain) Better(candidate, current ChainTip) bool {
+	return candidate.Weight > current.Weight
+}
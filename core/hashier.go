@@ -1,9 +1,7 @@
 package core
 
 import (
-	"bytes"
 	"crypto/sha256"
-	"encoding/gob"
 	"github.com/evgeniy-dammer/blockchain/types"
 )
 
@@ -15,22 +13,25 @@ type Hasher[T any] interface {
 // BlockHasher
 type BlockHasher struct{}
 
-// Hash hashes a block's Header
+// Hash hashes the canonical encoding of a block's Header
 func (BlockHasher) Hash(header *Header) types.Hash {
 	hash := sha256.Sum256(header.Bytes())
 
 	return types.Hash(hash)
 }
 
+// TransactionSigningHasher
+type TransactionSigningHasher struct{}
+
+// Hash hashes every consensus field of a transaction, the hash is what the sender signs
+func (TransactionSigningHasher) Hash(transaction *Transaction) types.Hash {
+	return types.Hash(sha256.Sum256(transaction.SigningBytes()))
+}
+
 // TransactionHasher
 type TransactionHasher struct{}
 
-// Hash hashes a transaction's data
+// Hash hashes the canonical encoding of a transaction, including its signature
 func (TransactionHasher) Hash(transaction *Transaction) types.Hash {
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(transaction); err != nil {
-		panic(err)
-	}
-
-	return types.Hash(sha256.Sum256(buf.Bytes()))
+	return types.Hash(sha256.Sum256(encodeTransaction(transaction, true)))
 }
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/types"
+)
+
+// Domain separation prefixes, so a leaf can never be mistaken for an inner node
+const (
+	merkleLeafPrefix  byte = 0x00
+	merkleInnerPrefix byte = 0x01
+)
+
+// MerkleProof proves that a leaf is part of a binary Merkle tree
+type MerkleProof struct {
+	Index    uint32       // position of the leaf in the tree
+	Leaves   uint32       // total number of leaves in the tree
+	Siblings []types.Hash // sibling hashes on the way from the leaf to the root
+}
+
+// MerkleRoot returns the root of the binary Merkle tree built over the given leaves.
+// A node without a sibling is moved to the next level unchanged. The root of an empty tree is zero.
+func MerkleRoot(leaves []types.Hash) types.Hash {
+	if len(leaves) == 0 {
+		return types.Hash{}
+	}
+
+	level := make([]types.Hash, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleLeaf(leaf)
+	}
+
+	for len(level) > 1 {
+		level = merkleNextLevel(level)
+	}
+
+	return level[0]
+}
+
+// NewMerkleProof returns a proof for the leaf with the given index
+func NewMerkleProof(leaves []types.Hash, index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("leaf index %d out of range [0, %d)", index, len(leaves))
+	}
+
+	proof := &MerkleProof{
+		Index:  uint32(index),
+		Leaves: uint32(len(leaves)),
+	}
+
+	level := make([]types.Hash, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleLeaf(leaf)
+	}
+
+	for position := index; len(level) > 1; position /= 2 {
+		if sibling := position ^ 1; sibling < len(level) {
+			proof.Siblings = append(proof.Siblings, level[sibling])
+		}
+
+		level = merkleNextLevel(level)
+	}
+
+	return proof, nil
+}
+
+// Verify checks that the leaf is part of the tree with the given root
+func (p *MerkleProof) Verify(root, leaf types.Hash) bool {
+	if p.Index >= p.Leaves {
+		return false
+	}
+
+	var (
+		hash     = merkleLeaf(leaf)
+		position = p.Index
+		width    = p.Leaves
+		siblings = p.Siblings
+	)
+
+	for ; width > 1; width = (width + 1) / 2 {
+		sibling := position ^ 1
+
+		if sibling < width {
+			if len(siblings) == 0 {
+				return false
+			}
+
+			if position%2 == 0 {
+				hash = merkleInner(hash, siblings[0])
+			} else {
+				hash = merkleInner(siblings[0], hash)
+			}
+
+			siblings = siblings[1:]
+		}
+
+		position /= 2
+	}
+
+	return len(siblings) == 0 && hash == root
+}
+
+func merkleNextLevel(level []types.Hash) []types.Hash {
+	next := make([]types.Hash, 0, (len(level)+1)/2)
+
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+			continue
+		}
+
+		next = append(next, merkleInner(level[i], level[i+1]))
+	}
+
+	return next
+}
+
+func merkleLeaf(leaf types.Hash) types.Hash {
+	return sha256.Sum256(append([]byte{merkleLeafPrefix}, leaf[:]...))
+}
+
+func merkleInner(left, right types.Hash) types.Hash {
+	data := make([]byte, 0, 1+2*len(left))
+	data = append(data, merkleInnerPrefix)
+	data = append(data, left[:]...)
+	data = append(data, right[:]...)
+
+	return sha256.Sum256(data)
+}
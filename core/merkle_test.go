@@ -0,0 +1,79 @@
+package core
+
+import (
+	"github.com/evgeniy-dammer/blockchain/crypto"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func merkleTestLeaves(n int) []types.Hash {
+	leaves := make([]types.Hash, n)
+	for i := range leaves {
+		leaves[i] = types.Hash{byte(i), byte(i >> 8), 0xaa}
+	}
+
+	return leaves
+}
+
+func TestMerkleRoot(t *testing.T) {
+	assert.True(t, MerkleRoot(nil).IsZero())
+
+	a, b, c := types.Hash{0x01}, types.Hash{0x02}, types.Hash{0x03}
+
+	assert.Equal(t, merkleLeaf(a), MerkleRoot([]types.Hash{a}))
+	assert.Equal(t, merkleInner(merkleLeaf(a), merkleLeaf(b)), MerkleRoot([]types.Hash{a, b}))
+	// the odd leaf is promoted to the next level unchanged
+	assert.Equal(t, merkleInner(merkleInner(merkleLeaf(a), merkleLeaf(b)), merkleLeaf(c)), MerkleRoot([]types.Hash{a, b, c}))
+	// the order of the leaves matters
+	assert.NotEqual(t, MerkleRoot([]types.Hash{a, b}), MerkleRoot([]types.Hash{b, a}))
+	// duplicating the last leaf does not give the same root
+	assert.NotEqual(t, MerkleRoot([]types.Hash{a, b, c}), MerkleRoot([]types.Hash{a, b, c, c}))
+}
+
+func TestMerkleProof_Verify(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		leaves := merkleTestLeaves(n)
+		root := MerkleRoot(leaves)
+
+		for i := range leaves {
+			proof, err := NewMerkleProof(leaves, i)
+			assert.Nil(t, err)
+			assert.True(t, proof.Verify(root, leaves[i]), "leaves %d index %d", n, i)
+			assert.False(t, proof.Verify(root, types.Hash{0xff}))
+
+			if len(proof.Siblings) > 0 {
+				proof.Siblings[0][0] ^= 0x01
+				assert.False(t, proof.Verify(root, leaves[i]))
+			}
+		}
+	}
+
+	_, err := NewMerkleProof(merkleTestLeaves(3), 3)
+	assert.NotNil(t, err)
+}
+
+func TestBlock_TransactionProof(t *testing.T) {
+	block := randomBlock(t, 0, types.Hash{})
+
+	for i := 0; i < 4; i++ {
+		tx := NewTransaction([]byte{byte(i)})
+		assert.Nil(t, tx.Sign(crypto.GeneratePrivateKey()))
+		block.AddTransaction(tx)
+	}
+
+	for _, tx := range block.Transactions {
+		hash := tx.Hash(TransactionHasher{})
+
+		proof, err := block.TransactionProof(hash)
+		assert.Nil(t, err)
+		assert.True(t, VerifyTransactionProof(block.Header, hash, proof))
+	}
+
+	_, err := block.TransactionProof(types.Hash{0x01})
+	assert.NotNil(t, err)
+
+	proof, err := block.TransactionProof(block.Transactions[0].Hash(TransactionHasher{}))
+	assert.Nil(t, err)
+	assert.False(t, VerifyTransactionProof(block.Header, block.Transactions[1].Hash(TransactionHasher{}), proof))
+}
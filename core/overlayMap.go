@@ -0,0 +1,130 @@
+package core
+
+// overlayMap is a map which can be layered on top of another one. Reads fall through to the parent map,
+// writes are kept in the overlay until they are committed to the parent.
+type overlayMap[K comparable, V any] struct {
+	data    map[K]V
+	deleted map[K]struct{} // keys deleted from the parent map
+	parent  *overlayMap[K, V]
+}
+
+// newOverlayMap is a constructor for the overlayMap
+func newOverlayMap[K comparable, V any]() *overlayMap[K, V] {
+	return &overlayMap[K, V]{
+		data:    make(map[K]V),
+		deleted: make(map[K]struct{}),
+	}
+}
+
+// get returns the value with the given key
+func (m *overlayMap[K, V]) get(key K) (V, bool) {
+	if value, ok := m.data[key]; ok {
+		return value, true
+	}
+
+	if _, deleted := m.deleted[key]; !deleted && m.parent != nil {
+		return m.parent.get(key)
+	}
+
+	var empty V
+
+	return empty, false
+}
+
+// put puts the given key and value into the map
+func (m *overlayMap[K, V]) put(key K, value V) {
+	m.data[key] = value
+	delete(m.deleted, key)
+}
+
+// delete removes the given key from the map
+func (m *overlayMap[K, V]) delete(key K) {
+	delete(m.data, key)
+
+	if m.parent != nil {
+		m.deleted[key] = struct{}{}
+	}
+}
+
+// all returns every key and value visible in the map, including the ones of the parent maps
+func (m *overlayMap[K, V]) all() map[K]V {
+	data := make(map[K]V)
+
+	if m.parent != nil {
+		data = m.parent.all()
+	}
+
+	for key := range m.deleted {
+		delete(data, key)
+	}
+
+	for key, value := range m.data {
+		data[key] = value
+	}
+
+	return data
+}
+
+// overlay returns an empty map on top of this one
+func (m *overlayMap[K, V]) overlay() *overlayMap[K, V] {
+	overlay := newOverlayMap[K, V]()
+	overlay.parent = m
+
+	return overlay
+}
+
+// commit applies the changes of the overlay to its parent map and clears the overlay
+func (m *overlayMap[K, V]) commit() {
+	for key := range m.deleted {
+		m.parent.delete(key)
+	}
+
+	for key, value := range m.data {
+		m.parent.put(key, value)
+	}
+
+	m.data = make(map[K]V)
+	m.deleted = make(map[K]struct{})
+}
+
+// undo returns the values of the parent map which are overwritten when the overlay is committed
+func (m *overlayMap[K, V]) undo() map[K]undoEntry[V] {
+	entries := make(map[K]undoEntry[V])
+
+	for _, keys := range []map[K]struct{}{keySet(m.data), m.deleted} {
+		for key := range keys {
+			value, ok := m.parent.get(key)
+			entries[key] = undoEntry[V]{value: value, exists: ok}
+		}
+	}
+
+	return entries
+}
+
+// revert puts the values of the undo entries back into the map
+func (m *overlayMap[K, V]) revert(entries map[K]undoEntry[V]) {
+	for key, entry := range entries {
+		if !entry.exists {
+			m.delete(key)
+			continue
+		}
+
+		m.put(key, entry.value)
+	}
+}
+
+// undoEntry is the value a key had before it was changed, exists is false if the key was not set
+type undoEntry[V any] struct {
+	value  V
+	exists bool
+}
+
+// keySet returns the keys of the map
+func keySet[K comparable, V any](data map[K]V) map[K]struct{} {
+	keys := make(map[K]struct{}, len(data))
+	for key := range data {
+		keys[key] = struct{}{}
+	}
+
+	return keys
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"time"
+)
+
+var ErrNothingToCall = errors.New("neither code nor contract given")
+
+// ReadOnlyCall runs code against the current state without changing it, like a CallTx which is never mined.
+// If Code is set, it runs against the storage of the Contract, otherwise the code of the Contract runs.
+type ReadOnlyCall struct {
+	From     types.Address
+	Contract types.Address
+	Code     []byte
+	Value    uint64
+	GasLimit uint64
+}
+
+// StorageRead is a value the code read from the storage of a contract
+type StorageRead struct {
+	Contract types.Address
+	Key      []byte
+	Value    Value
+}
+
+// ReadOnlyResult is the outcome of a ReadOnlyCall. Stack holds the values left on the stack, the bottom value first.
+type ReadOnlyResult struct {
+	ReturnValue Value
+	Stack       []Value
+	Reads       []StorageRead
+	Logs        []*Log
+	GasUsed     uint64
+	Err         error // set if the code failed
+}
+
+// ReadOnlyCall executes the call on top of the head state as if it was part of the next block. Every change
+// of the code is discarded afterwards. The returned error is only set if the call cannot be executed at all,
+// the failure of the code itself is the Err of the result.
+func (bc *Blockchain) ReadOnlyCall(call *ReadOnlyCall) (*ReadOnlyResult, error) {
+	if call.Code == nil && call.Contract == (types.Address{}) {
+		return nil, ErrNothingToCall
+	}
+
+	bc.stateLock.RLock()
+	defer bc.stateLock.RUnlock()
+
+	state := bc.state().overlay()
+
+	code := call.Code
+	if code == nil {
+		var err error
+		if code, err = getContractCode(state.contractState, call.Contract); err != nil {
+			return nil, err
+		}
+	}
+
+	if call.Value > 0 {
+		if err := state.accountState.Transfer(call.From, call.Contract, call.Value); err != nil {
+			return nil, fmt.Errorf("sender %s cannot pay the value: %w", call.From, err)
+		}
+	}
+
+	env := &callEnv{
+		header: &Header{Height: bc.Height() + 1, Timestamp: time.Now().UnixNano()},
+		reads:  &[]StorageRead{},
+	}
+
+	result, vm := bc.runCode(state, env, code, call.From, &ContractCall{
+		Contract: call.Contract,
+		Value:    call.Value,
+		GasLimit: call.GasLimit,
+	}, 0)
+
+	return &ReadOnlyResult{
+		ReturnValue: result.ReturnValue,
+		Stack:       vm.Stack().Values(),
+		Reads:       *env.reads,
+		Logs:        result.Logs,
+		GasUsed:     result.GasUsed,
+		Err:         result.Err,
+	}, nil
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"github.com/evgeniy-dammer/blockchain/crypto"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBlockchain_ReadOnlyCall(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+	contract := ContractAddress(sender, 0)
+
+	assert.Nil(t, bc.AddBlock(contractBlock(t, bc, privateKey, DeployTx{Code: storeFooCode})))
+	assert.True(t, sendCall(t, bc, privateKey, contract, 0, 1000).Succeeded())
+	stateRoot := bc.StateRoot()
+
+	// reads FOO, overwrites it, logs it and leaves the height on the stack
+	code := mustAssemble(t, `
+		BLOCKHEIGHT
+		PUSHB 'F'
+		PUSHB 'O'
+		PUSHB 'O'
+		PUSH 3
+		PACK
+		GET
+		DUP
+		PUSH 1
+		ADD
+		PUSHB 'F'
+		PUSHB 'O'
+		PUSHB 'O'
+		PUSH 3
+		PACK
+		STORE
+		LOG
+	`)
+
+	result, err := bc.ReadOnlyCall(&ReadOnlyCall{From: sender, Contract: contract, Code: code, GasLimit: 1000})
+	assert.Nil(t, err)
+	assert.Nil(t, result.Err)
+	assert.Equal(t, []Value{NewWord(uint64(bc.Height() + 1))}, result.Stack)
+	assert.Equal(t, []StorageRead{{Contract: contract, Key: []byte("FOO"), Value: NewWord(5)}}, result.Reads)
+	assert.Equal(t, []*Log{{Address: contract, Data: NewWord(5).Bytes()}}, result.Logs)
+	assert.NotZero(t, result.GasUsed)
+
+	// nothing was persisted
+	assert.Equal(t, stateRoot, bc.StateRoot())
+	assert.Equal(t, NewWord(5), storedValue(t, bc, contract, "FOO"))
+}
+
+func TestBlockchain_ReadOnlyCallContract(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	privateKey := crypto.GeneratePrivateKey()
+	sender := privateKey.PublicKey().Address()
+	contract := ContractAddress(sender, 0)
+
+	assert.Nil(t, bc.AddBlock(contractBlock(t, bc, privateKey, DeployTx{Code: mustAssemble(t, "CALLER\nRETURN")})))
+
+	result, err := bc.ReadOnlyCall(&ReadOnlyCall{From: sender, Contract: contract, GasLimit: 1000})
+	assert.Nil(t, err)
+	assert.Nil(t, result.Err)
+	assert.Equal(t, Bytes(sender.ToSlice()), result.ReturnValue)
+	assert.Empty(t, result.Stack)
+}
+
+func TestBlockchain_ReadOnlyCallFailures(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	sender := crypto.GeneratePrivateKey().PublicKey().Address()
+
+	_, err := bc.ReadOnlyCall(&ReadOnlyCall{From: sender, GasLimit: 1000})
+	assert.ErrorIs(t, err, ErrNothingToCall)
+
+	_, err = bc.ReadOnlyCall(&ReadOnlyCall{From: sender, Contract: types.Address{0x01}, GasLimit: 1000})
+	assert.ErrorIs(t, err, ErrContractNotFound)
+
+	_, err = bc.ReadOnlyCall(&ReadOnlyCall{From: sender, Code: []byte{0x00}, Value: 1, GasLimit: 1000})
+	assert.NotNil(t, err)
+
+	// the gas limit caps the execution
+	result, err := bc.ReadOnlyCall(&ReadOnlyCall{From: sender, Code: mustAssemble(t, "loop:\nPUSH loop\nJUMP"), GasLimit: 100})
+	assert.Nil(t, err)
+	assert.ErrorIs(t, result.Err, ErrOutOfGas)
+	assert.Equal(t, uint64(100), result.GasUsed)
+}
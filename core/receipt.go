@@ -0,0 +1,56 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/evgeniy-dammer/blockchain/types"
+)
+
+// ReceiptStatus tells whether the execution of a transaction succeeded
+type ReceiptStatus byte
+
+const (
+	ReceiptStatusFailed  ReceiptStatus = 0x00
+	ReceiptStatusSuccess ReceiptStatus = 0x01
+)
+
+// Log is the data a contract emitted with InstructionLog
+type Log struct {
+	Address types.Address // contract which emitted the log
+	Data    []byte
+}
+
+// Receipt records the outcome of a transaction executed on the canonical chain. A transaction whose
+// contract code fails is still included, it pays its fee, but the changes of the code are dropped.
+type Receipt struct {
+	TxHash          types.Hash
+	Status          ReceiptStatus
+	GasUsed         uint64        // gas used by deploying or calling a contract, zero for other transactions
+	Fee             uint64        // paid by the sender to the validator, the fee of the transaction plus the gas used at the gas price
+	ContractAddress types.Address // address of the contract created by a DeployTx, zero otherwise
+	Logs            []*Log
+	Error           string // why the execution failed, it is not part of the receipts root
+}
+
+// Succeeded checks if the transaction was executed successfully
+func (r *Receipt) Succeeded() bool {
+	return r.Status == ReceiptStatusSuccess
+}
+
+// ReceiptsRoot returns the root of the trie which maps the index of every transaction in the block to its receipt
+func ReceiptsRoot(receipts []*Receipt) types.Hash {
+	trie := NewTrie()
+
+	for i, receipt := range receipts {
+		trie.Put(binary.BigEndian.AppendUint32(nil, uint32(i)), encodeReceipt(receipt))
+	}
+
+	return trie.Hash()
+}
+
+func encodeReceipt(receipt *Receipt) []byte {
+	buf := &bytes.Buffer{}
+	writeReceipt(buf, receipt)
+
+	return buf.Bytes()
+}
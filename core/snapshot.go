@@ -0,0 +1,183 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	defaultSnapshotInterval = 100
+	defaultSnapshotRetain   = 3
+	snapshotFilePattern     = "state-%010d.snap"
+)
+
+var ErrSnapshotNotFound = errors.New("state snapshot not found")
+
+// StateSnapshot is a copy of the whole blockchain state right after the block with the given height was executed
+type StateSnapshot struct {
+	Height      uint32
+	BlockHash   types.Hash
+	Accounts    []Account
+	Contract    map[string][]byte
+	Collections map[types.Hash]*CollectionTx
+	Mints       map[types.Hash]*MintTx
+}
+
+// SnapshotStore keeps state snapshots versioned by block height
+type SnapshotStore interface {
+	Put(snapshot *StateSnapshot) error
+	Get(height uint32) (*StateSnapshot, error)
+	// Heights returns the heights of all stored snapshots in ascending order
+	Heights() ([]uint32, error)
+}
+
+// DiskSnapshotStore keeps every snapshot in its own file. Only the latest retain snapshots are kept.
+type DiskSnapshotStore struct {
+	lock   sync.Mutex
+	dir    string
+	retain int
+}
+
+// NewDiskSnapshotStore is a constructor for the DiskSnapshotStore
+func NewDiskSnapshotStore(dir string, retain int) (*DiskSnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	if retain <= 0 {
+		retain = defaultSnapshotRetain
+	}
+
+	return &DiskSnapshotStore{
+		dir:    dir,
+		retain: retain,
+	}, nil
+}
+
+// Put writes the snapshot to disk and removes the snapshots which are no longer retained.
+// The snapshot is written to a temporary file first, so a crash never leaves a half written snapshot behind.
+func (s *DiskSnapshotStore) Put(snapshot *StateSnapshot) error {
+	payload := &bytes.Buffer{}
+	if err := gob.NewEncoder(payload).Encode(snapshot); err != nil {
+		return err
+	}
+
+	data := make([]byte, 4, 4+payload.Len())
+	binary.BigEndian.PutUint32(data, crc32.ChecksumIEEE(payload.Bytes()))
+	data = append(data, payload.Bytes()...)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	path := s.path(snapshot.Height)
+
+	tmp, err := os.CreateTemp(s.dir, "state-*.tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return s.prune()
+}
+
+// Get reads the snapshot taken at the given height
+func (s *DiskSnapshotStore) Get(height uint32) (*StateSnapshot, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	data, err := os.ReadFile(s.path(height))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: height %d", ErrSnapshotNotFound, height)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 4 || crc32.ChecksumIEEE(data[4:]) != binary.BigEndian.Uint32(data[:4]) {
+		return nil, fmt.Errorf("state snapshot at height %d is corrupted", height)
+	}
+
+	snapshot := new(StateSnapshot)
+	if err = gob.NewDecoder(bytes.NewReader(data[4:])).Decode(snapshot); err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// Heights returns the heights of all snapshots on disk in ascending order
+func (s *DiskSnapshotStore) Heights() ([]uint32, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.heights()
+}
+
+func (s *DiskSnapshotStore) heights() ([]uint32, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "state-*.snap"))
+	if err != nil {
+		return nil, err
+	}
+
+	heights := make([]uint32, 0, len(matches))
+
+	for _, match := range matches {
+		var height uint32
+		if _, err = fmt.Sscanf(filepath.Base(match), snapshotFilePattern, &height); err != nil {
+			continue
+		}
+
+		heights = append(heights, height)
+	}
+
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+
+	return heights, nil
+}
+
+func (s *DiskSnapshotStore) prune() error {
+	heights, err := s.heights()
+	if err != nil {
+		return err
+	}
+
+	for len(heights) > s.retain {
+		if err = os.Remove(s.path(heights[0])); err != nil {
+			return err
+		}
+
+		heights = heights[1:]
+	}
+
+	return nil
+}
+
+func (s *DiskSnapshotStore) path(height uint32) string {
+	return filepath.Join(s.dir, fmt.Sprintf(snapshotFilePattern, height))
+}
@@ -0,0 +1,143 @@
+package core
+
+import (
+	"github.com/evgeniy-dammer/blockchain/crypto"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDiskSnapshotStore_PutGet(t *testing.T) {
+	store, err := NewDiskSnapshotStore(t.TempDir(), 2)
+	assert.Nil(t, err)
+
+	address := crypto.GeneratePrivateKey().PublicKey().Address()
+
+	for height := uint32(1); height <= 3; height++ {
+		assert.Nil(t, store.Put(&StateSnapshot{
+			Height:   height,
+			Accounts: []Account{{Address: address, Balance: uint64(height)}},
+			Contract: map[string][]byte{"FOO": {byte(height)}},
+		}))
+	}
+
+	heights, err := store.Heights()
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{2, 3}, heights)
+
+	snapshot, err := store.Get(3)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), snapshot.Accounts[0].Balance)
+	assert.Equal(t, []byte{3}, snapshot.Contract["FOO"])
+
+	_, err = store.Get(1)
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+}
+
+func TestBlockchain_RestoreFromSnapshot(t *testing.T) {
+	store := NewMemoryStore()
+	snapshots, err := NewDiskSnapshotStore(t.TempDir(), 0)
+	assert.Nil(t, err)
+
+	options := BlockchainOptions{
+		Logger:           log.NewNopLogger(),
+		Storage:          store,
+		Snapshots:        snapshots,
+		SnapshotInterval: 5,
+	}
+	genesis := randomBlock(t, 0, types.Hash{})
+
+	bc, err := NewBlockchainWithOptions(genesis, options)
+	assert.Nil(t, err)
+
+	var (
+		contract types.Address
+		call     types.Hash
+	)
+
+	for i := 1; i <= 12; i++ {
+		block := randomBlock(t, uint32(i), getPreviousBlockHash(t, bc, uint32(i)))
+
+		if i == 7 {
+			// deploys a contract which stores FOO = 5 and calls it
+			privateKey := crypto.GeneratePrivateKey()
+			contract = ContractAddress(privateKey.PublicKey().Address(), 0)
+			block = contractBlock(t, bc, privateKey, DeployTx{Code: storeFooCode}, CallTx{Contract: contract})
+			call = block.Transactions[1].Hash(TransactionHasher{})
+			assert.Nil(t, bc.AddBlock(block))
+
+			continue
+		}
+
+		sealBlock(t, bc, block)
+		assert.Nil(t, bc.AddBlock(block))
+	}
+
+	heights, err := snapshots.Heights()
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{0, 5, 10}, heights)
+
+	restored, err := NewBlockchainWithOptions(genesis, options)
+	assert.Nil(t, err)
+	assert.Equal(t, bc.Height(), restored.Height())
+	assert.Equal(t, len(bc.accountState.accounts), len(restored.accountState.accounts))
+	assert.Equal(t, bc.StateRoot(), restored.StateRoot())
+
+	from, err := restored.restoreSnapshot()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(11), from)
+
+	value, err := newContractStorage(restored.contractState, contract).Get([]byte("FOO"))
+	assert.Nil(t, err)
+	assert.Equal(t, NewWord(5), mustDecodeValue(t, value))
+
+	// the call is not executed again, its receipt comes from the storage
+	receipt, err := bc.GetReceipt(call)
+	assert.Nil(t, err)
+
+	restoredReceipt, err := restored.GetReceipt(call)
+	assert.Nil(t, err)
+	assert.Equal(t, receipt, restoredReceipt)
+}
+
+func TestBlockchain_RestoreFromInvalidSnapshot(t *testing.T) {
+	store := NewMemoryStore()
+	snapshots, err := NewDiskSnapshotStore(t.TempDir(), 0)
+	assert.Nil(t, err)
+
+	options := BlockchainOptions{
+		Logger:           log.NewNopLogger(),
+		Storage:          store,
+		Snapshots:        snapshots,
+		SnapshotInterval: 5,
+	}
+	genesis := randomBlock(t, 0, types.Hash{})
+
+	bc, err := NewBlockchainWithOptions(genesis, options)
+	assert.Nil(t, err)
+
+	for i := 1; i <= 12; i++ {
+		block := randomBlock(t, uint32(i), getPreviousBlockHash(t, bc, uint32(i)))
+		sealBlock(t, bc, block)
+		assert.Nil(t, bc.AddBlock(block))
+	}
+
+	// a snapshot whose state does not match the state root of its block is skipped
+	snapshot, err := snapshots.Get(10)
+	assert.Nil(t, err)
+
+	accounts := len(snapshot.Accounts)
+	snapshot.Accounts = append(snapshot.Accounts, Account{Address: crypto.GeneratePrivateKey().PublicKey().Address(), Balance: 1000})
+	assert.Nil(t, snapshots.Put(snapshot))
+
+	restored, err := NewBlockchainWithOptions(genesis, options)
+	assert.Nil(t, err)
+	assert.Equal(t, bc.Height(), restored.Height())
+	assert.Equal(t, bc.StateRoot(), restored.StateRoot())
+
+	// the blocks after the previous snapshot were executed again and replaced the invalid snapshot
+	snapshot, err = snapshots.Get(10)
+	assert.Nil(t, err)
+	assert.Equal(t, accounts, len(snapshot.Accounts))
+}
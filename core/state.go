@@ -4,40 +4,43 @@ import (
 	"fmt"
 )
 
-// State
+// State keeps the contract storage. It is an overlayMap, so an overlay of the state keeps its changes
+// until they are committed to the parent state.
 type State struct {
-	data map[string][]byte
+	*overlayMap[string, []byte]
 }
 
 // NewState is a constructor for the State
 func NewState() *State {
-	return &State{
-		data: make(map[string][]byte),
-	}
+	return &State{overlayMap: newOverlayMap[string, []byte]()}
 }
 
 // Put puts the given kay and value into state.data
 func (s *State) Put(key, value []byte) error {
-	s.data[string(key)] = value
+	s.put(string(key), value)
 
 	return nil
 }
 
 // Delete deletes the value from state.data with given key
 func (s *State) Delete(key []byte) error {
-	delete(s.data, string(key))
+	s.delete(string(key))
 
 	return nil
 }
 
 // Get returns value with the given key
 func (s *State) Get(k []byte) ([]byte, error) {
-	key := string(k)
-
-	value, ok := s.data[key]
+	value, ok := s.get(string(k))
 	if !ok {
-		return nil, fmt.Errorf("given key %s not found", key)
+		return nil, fmt.Errorf("given key %s not found", k)
 	}
 
 	return value, nil
 }
+
+// overlay returns an empty state on top of this one. Reads fall through to this state,
+// changes are kept inside the overlay until commit is called.
+func (s *State) overlay() *State {
+	return &State{overlayMap: s.overlayMap.overlay()}
+}
@@ -20,10 +20,40 @@ func TestAccountStateTransferSuccess(t *testing.T) {
 	state := NewAccountState()
 	from := crypto.GeneratePrivateKey().PublicKey().Address()
 
-	//state.AddBalance(from, 100)
+	state.AddBalance(from, 100)
 
 	to := crypto.GeneratePrivateKey().PublicKey().Address()
 	amount := uint64(90)
 
 	assert.Nil(t, state.Transfer(from, to, amount))
 }
+
+func TestStateOverlay(t *testing.T) {
+	state := NewState()
+	assert.Nil(t, state.Put([]byte("foo"), []byte{0x01}))
+	assert.Nil(t, state.Put([]byte("bar"), []byte{0x02}))
+
+	overlay := state.overlay()
+	assert.Nil(t, overlay.Put([]byte("foo"), []byte{0x03}))
+	assert.Nil(t, overlay.Delete([]byte("bar")))
+
+	value, err := overlay.Get([]byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x03}, value)
+
+	_, err = overlay.Get([]byte("bar"))
+	assert.NotNil(t, err)
+
+	value, err = state.Get([]byte("bar"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x02}, value)
+
+	overlay.commit()
+
+	value, err = state.Get([]byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x03}, value)
+
+	_, err = state.Get([]byte("bar"))
+	assert.NotNil(t, err)
+}
@@ -1,19 +1,120 @@
 package core
 
-// Storage interface
+import (
+	"errors"
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"sync"
+)
+
+var ErrBlockNotFound = errors.New("block not found")
+
+// Storage interface. Blocks are stored together with the receipts of their transactions.
 type Storage interface {
-	Put(block *Block) error
+	Put(block *Block, receipts []*Receipt) error
+	Get(hash types.Hash) (*Block, error)
+	GetReceipts(hash types.Hash) ([]*Receipt, error)
+	Has(hash types.Hash) bool
+	// Iterate calls fn for every stored block in ascending height order.
+	// Blocks with the same height are visited in the order they were stored.
+	Iterate(fn func(block *Block) error) error
 }
 
 // MemoryStore
-type MemoryStore struct{}
+type MemoryStore struct {
+	lock      sync.RWMutex
+	blocks    map[types.Hash]*Block
+	receipts  map[types.Hash][]*Receipt
+	byHeight  map[uint32][]types.Hash
+	maxHeight uint32
+}
 
 // NewMemoryStore is a constructor for the MemoryStore
 func NewMemoryStore() *MemoryStore {
-	return &MemoryStore{}
+	return &MemoryStore{
+		blocks:   make(map[types.Hash]*Block),
+		receipts: make(map[types.Hash][]*Receipt),
+		byHeight: make(map[uint32][]types.Hash),
+	}
+}
+
+// Put puts a block and its receipts into memory store
+func (ms *MemoryStore) Put(block *Block, receipts []*Receipt) error {
+	hash := block.Hash(BlockHasher{})
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if _, ok := ms.blocks[hash]; ok {
+		return nil
+	}
+
+	height := block.Header.Height
+
+	ms.blocks[hash] = block
+	ms.receipts[hash] = receipts
+	ms.byHeight[height] = append(ms.byHeight[height], hash)
+
+	if height > ms.maxHeight {
+		ms.maxHeight = height
+	}
+
+	return nil
 }
 
-// Put puts a block into memory store
-func (ms *MemoryStore) Put(block *Block) error {
+// Get returns a block with the given hash from memory store
+func (ms *MemoryStore) Get(hash types.Hash) (*Block, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	block, ok := ms.blocks[hash]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, hash)
+	}
+
+	return block, nil
+}
+
+// GetReceipts returns the receipts of the block with the given hash from memory store
+func (ms *MemoryStore) GetReceipts(hash types.Hash) ([]*Receipt, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	receipts, ok := ms.receipts[hash]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, hash)
+	}
+
+	return receipts, nil
+}
+
+// Has checks if memory store contains a block with the given hash
+func (ms *MemoryStore) Has(hash types.Hash) bool {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	_, ok := ms.blocks[hash]
+
+	return ok
+}
+
+// Iterate calls fn for every block in memory store in ascending height order
+func (ms *MemoryStore) Iterate(fn func(block *Block) error) error {
+	ms.lock.RLock()
+	blocks := make([]*Block, 0, len(ms.blocks))
+
+	for height := uint32(0); height <= ms.maxHeight && len(ms.blocks) > 0; height++ {
+		for _, hash := range ms.byHeight[height] {
+			blocks = append(blocks, ms.blocks[hash])
+		}
+	}
+	ms.lock.RUnlock()
+
+	for _, block := range blocks {
+		if err := fn(block); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
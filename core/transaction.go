@@ -2,10 +2,35 @@ package core
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/evgeniy-dammer/blockchain/crypto"
 	"github.com/evgeniy-dammer/blockchain/types"
-	"math/rand"
+	"math/bits"
+)
+
+// transactionSigningDomain prefixes the signed payload, so a transaction signature can never be a valid signature of anything else
+const transactionSigningDomain = "blockchain/transaction"
+
+// Tags of the TxInner inside the canonical encoding
+const (
+	txInnerNone        byte = 0x00
+	txInnerCollection  byte = 0x01
+	txInnerMint        byte = 0x02
+	txInnerDeploy      byte = 0x03
+	txInnerCall        byte = 0x04
+	txInnerUnsupported byte = 0xff
+)
+
+const (
+	MaxTxGas    = 1_000_000  // the highest gas limit a transaction may have
+	MaxBlockGas = 10_000_000 // the highest sum of the gas limits of the transactions of a block
+)
+
+var (
+	ErrInvalidChainID   = errors.New("invalid chain id")
+	ErrInvalidFee       = errors.New("invalid transaction fee")
+	ErrGasLimitExceeded = errors.New("gas limit exceeded")
 )
 
 type TxType byte
@@ -31,22 +56,24 @@ type MintTx struct {
 
 // Transaction
 type Transaction struct {
+	ChainID   uint32 // network the transaction is meant for, it cannot be replayed on another one
 	Type      TxType
-	TxInner   any    // Only used for native NFT logic
-	Data      []byte // Any arbitrary data for the VM
+	TxInner   any    // Only used for native NFT logic and contracts
+	Data      []byte // Any arbitrary data, it is not executed
 	To        crypto.PublicKey
 	Value     uint64
 	From      crypto.PublicKey
 	Signature *crypto.Signature
-	Nonce     int64
+	Nonce     uint64     // must be the nonce of the sender account, so every transaction can be mined only once
+	Fee       uint64     // paid by the sender to the validator of the block which includes the transaction, on top of the gas
+	GasLimit  uint64     // the most gas the contract code of the transaction may use, paid up front at the gas price of the chain
 	hash      types.Hash // cached version of transaction data hash
 }
 
-// NewTransaction is a constructor for a Transaction
+// NewTransaction is a constructor for a Transaction. The nonce has to be set to the next nonce of the sender.
 func NewTransaction(data []byte) *Transaction {
 	return &Transaction{
-		Data:  data,
-		Nonce: rand.Int63n(1000000000000000),
+		Data: data,
 	}
 }
 
@@ -59,14 +86,109 @@ func (t *Transaction) Hash(hasher Hasher[*Transaction]) types.Hash {
 	return t.hash
 }
 
-// Sign signs a Transaction data
+// TotalFee returns the fee the sender pays for the transaction, that is the transaction fee plus the fee of a native NFT transaction
+func (t *Transaction) TotalFee() (uint64, error) {
+	var innerFee int64
+
+	switch inner := t.TxInner.(type) {
+	case CollectionTx:
+		innerFee = inner.Fee
+	case MintTx:
+		innerFee = inner.Fee
+	}
+
+	if innerFee < 0 {
+		return 0, fmt.Errorf("%w: negative fee %d", ErrInvalidFee, innerFee)
+	}
+
+	fee := t.Fee + uint64(innerFee)
+	if fee < t.Fee {
+		return 0, fmt.Errorf("%w: fee overflows", ErrInvalidFee)
+	}
+
+	return fee, nil
+}
+
+// MaxFee returns the most the sender pays in fees for the transaction, that is the total fee plus, for a transaction
+// which pays for gas, the whole gas limit at the given gas price. The gas the transaction does not use is refunded.
+func (t *Transaction) MaxFee(gasPrice uint64) (uint64, error) {
+	fee, err := t.TotalFee()
+	if err != nil {
+		return 0, err
+	}
+
+	if !t.paysGas() {
+		return fee, nil
+	}
+
+	high, gasFee := bits.Mul64(t.GasLimit, gasPrice)
+	if high != 0 {
+		return 0, fmt.Errorf("%w: gas fee overflows", ErrInvalidFee)
+	}
+
+	maxFee := fee + gasFee
+	if maxFee < fee {
+		return 0, fmt.Errorf("%w: fee overflows", ErrInvalidFee)
+	}
+
+	return maxFee, nil
+}
+
+// checkGasLimit checks that the gas limit of the transaction is at most MaxTxGas
+func (t *Transaction) checkGasLimit() error {
+	if t.GasLimit > MaxTxGas {
+		return fmt.Errorf("%w: transaction %s has gas limit %d, at most %d is allowed", ErrGasLimitExceeded, t.Hash(TransactionHasher{}), t.GasLimit, MaxTxGas)
+	}
+
+	return nil
+}
+
+// blockGas returns the gas the transaction takes up of the MaxBlockGas of its block. Only a transaction which pays
+// for gas pays for its gas limit, so the gas limit of any other transaction is ignored and takes up nothing.
+func (t *Transaction) blockGas() uint64 {
+	if !t.paysGas() {
+		return 0
+	}
+
+	return t.GasLimit
+}
+
+// paysGas checks if the transaction pays for gas, which only deploying or calling a contract does
+func (t *Transaction) paysGas() bool {
+	switch t.TxInner.(type) {
+	case DeployTx, CallTx:
+		return true
+	}
+
+	return false
+}
+
+// Cost returns the most the sender pays for the transaction at the given gas price, that is the maximum fee plus the value
+func (t *Transaction) Cost(gasPrice uint64) (uint64, error) {
+	fee, err := t.MaxFee(gasPrice)
+	if err != nil {
+		return 0, err
+	}
+
+	cost := fee + t.Value
+	if cost < fee {
+		return 0, fmt.Errorf("%w: fee and value overflow", ErrInvalidFee)
+	}
+
+	return cost, nil
+}
+
+// Sign signs a Transaction. The signature covers the digest of every consensus field, including the sender.
 func (t *Transaction) Sign(privateKey crypto.PrivateKey) error {
-	signature, err := privateKey.Sign(t.Data)
+	t.From = privateKey.PublicKey()
+
+	hash := TransactionSigningHasher{}.Hash(t)
+
+	signature, err := privateKey.Sign(hash.ToSlice())
 	if err != nil {
 		return err
 	}
 
-	t.From = privateKey.PublicKey()
 	t.Signature = signature
 
 	return nil
@@ -78,13 +200,20 @@ func (t *Transaction) Verify() error {
 		return fmt.Errorf("transaction has no signature")
 	}
 
-	if !t.Signature.Verify(t.From, t.Data) {
+	hash := TransactionSigningHasher{}.Hash(t)
+
+	if !t.Signature.Verify(t.From, hash.ToSlice()) {
 		return fmt.Errorf("invalid transaction signature")
 	}
 
 	return nil
 }
 
+// SigningBytes returns the canonical encoding of every consensus field of the transaction, that is everything but the signature
+func (t *Transaction) SigningBytes() []byte {
+	return append([]byte(transactionSigningDomain), encodeTransaction(t, false)...)
+}
+
 // Encode encodes the transaction
 func (t *Transaction) Encode(encoder Encoder[*Transaction]) error {
 	return encoder.Encode(t)
@@ -98,4 +227,6 @@ func (t *Transaction) Decode(decoder Decoder[*Transaction]) error {
 func init() {
 	gob.Register(CollectionTx{})
 	gob.Register(MintTx{})
+	gob.Register(DeployTx{})
+	gob.Register(CallTx{})
 }
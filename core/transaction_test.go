@@ -88,3 +88,49 @@ func randomTransactionWithSignature(t *testing.T) *Transaction {
 
 	return &tx
 }
+
+func TestTransaction_VerifyTamper(t *testing.T) {
+	privateKey := crypto.GeneratePrivateKey()
+
+	tamper := map[string]func(tx *Transaction){
+		"to":      func(tx *Transaction) { tx.To = crypto.GeneratePrivateKey().PublicKey() },
+		"value":   func(tx *Transaction) { tx.Value++ },
+		"nonce":   func(tx *Transaction) { tx.Nonce++ },
+		"chainID": func(tx *Transaction) { tx.ChainID++ },
+		"data":    func(tx *Transaction) { tx.Data = []byte("bar") },
+		"fee":     func(tx *Transaction) { tx.Fee++ },
+		"gas":     func(tx *Transaction) { tx.GasLimit++ },
+		"type":    func(tx *Transaction) { tx.Type = TxTypeMint },
+		"inner":   func(tx *Transaction) { tx.TxInner = CollectionTx{Fee: 1} },
+	}
+
+	for name, change := range tamper {
+		tx := &Transaction{
+			ChainID: 1,
+			Type:    TxTypeCollection,
+			TxInner: CollectionTx{Fee: 200},
+			To:      crypto.GeneratePrivateKey().PublicKey(),
+			Value:   100,
+			Nonce:   3,
+		}
+
+		// transfers without data are signed as well
+		assert.Nil(t, tx.Sign(privateKey), name)
+		assert.Nil(t, tx.Verify(), name)
+
+		change(tx)
+		assert.NotNil(t, tx.Verify(), name)
+	}
+}
+
+func TestTransaction_TotalFee(t *testing.T) {
+	tx := &Transaction{Fee: 10, TxInner: MintTx{Fee: 5}}
+
+	fee, err := tx.TotalFee()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(15), fee)
+
+	tx.TxInner = CollectionTx{Fee: -1}
+	_, err = tx.TotalFee()
+	assert.ErrorIs(t, err, ErrInvalidFee)
+}
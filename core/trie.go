@@ -0,0 +1,335 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/evgeniy-dammer/blockchain/types"
+)
+
+const (
+	trieNodeLeaf      byte = 0x00
+	trieNodeExtension byte = 0x01
+	trieNodeBranch    byte = 0x02
+)
+
+// Trie is a Merkle Patricia trie. Keys are split into nibbles and every node commits
+// to its children by their SHA-256 hash, so the root hash commits to the whole content.
+// Nodes are never changed in place, an update creates new nodes along the changed path,
+// which keeps the cached hashes of all other nodes valid.
+type Trie struct {
+	root trieNode
+}
+
+type trieNode interface {
+	hash() types.Hash
+}
+
+type leafNode struct {
+	path   []byte // remaining key nibbles
+	value  []byte
+	cached *types.Hash
+}
+
+type extensionNode struct {
+	path   []byte // shared key nibbles
+	child  trieNode
+	cached *types.Hash
+}
+
+type branchNode struct {
+	children [16]trieNode
+	value    []byte // value of the key which ends at this node
+	cached   *types.Hash
+}
+
+// NewTrie is a constructor for the Trie
+func NewTrie() *Trie {
+	return &Trie{}
+}
+
+// Copy returns a copy of the trie. Nodes are never changed in place, so both tries share all their nodes
+// and updates of one of them do not show up in the other one.
+func (t *Trie) Copy() *Trie {
+	return &Trie{root: t.root}
+}
+
+// Put puts the given key and value into the trie
+func (t *Trie) Put(key, value []byte) {
+	if value == nil {
+		// a nil value marks a branch without a value
+		value = []byte{}
+	}
+
+	t.root = trieInsert(t.root, keyToNibbles(key), value)
+}
+
+// Get returns the value stored under the given key
+func (t *Trie) Get(key []byte) ([]byte, bool) {
+	node, path := t.root, keyToNibbles(key)
+
+	for {
+		switch n := node.(type) {
+		case nil:
+			return nil, false
+		case *leafNode:
+			if !bytes.Equal(n.path, path) {
+				return nil, false
+			}
+
+			return n.value, true
+		case *extensionNode:
+			if !bytes.HasPrefix(path, n.path) {
+				return nil, false
+			}
+
+			node, path = n.child, path[len(n.path):]
+		case *branchNode:
+			if len(path) == 0 {
+				return n.value, n.value != nil
+			}
+
+			node, path = n.children[path[0]], path[1:]
+		}
+	}
+}
+
+// Delete removes the given key from the trie
+func (t *Trie) Delete(key []byte) {
+	t.root = trieDelete(t.root, keyToNibbles(key))
+}
+
+// Hash returns the root hash of the trie. The hash of an empty trie is zero.
+func (t *Trie) Hash() types.Hash {
+	if t.root == nil {
+		return types.Hash{}
+	}
+
+	return t.root.hash()
+}
+
+func trieInsert(node trieNode, path, value []byte) trieNode {
+	switch n := node.(type) {
+	case nil:
+		return &leafNode{path: path, value: value}
+	case *leafNode:
+		if bytes.Equal(n.path, path) {
+			return &leafNode{path: path, value: value}
+		}
+
+		prefix := commonPrefix(n.path, path)
+		branch := &branchNode{}
+		branch.attach(n.path[len(prefix):], n.value)
+		branch.attach(path[len(prefix):], value)
+
+		return newExtension(prefix, branch)
+	case *extensionNode:
+		prefix := commonPrefix(n.path, path)
+		if len(prefix) == len(n.path) {
+			return &extensionNode{path: n.path, child: trieInsert(n.child, path[len(prefix):], value)}
+		}
+
+		rest := n.path[len(prefix):]
+		branch := &branchNode{}
+		branch.children[rest[0]] = newExtension(rest[1:], n.child)
+		branch.attach(path[len(prefix):], value)
+
+		return newExtension(prefix, branch)
+	case *branchNode:
+		branch := n.copy()
+
+		if len(path) == 0 {
+			branch.value = value
+		} else {
+			branch.children[path[0]] = trieInsert(n.children[path[0]], path[1:], value)
+		}
+
+		return branch
+	}
+
+	return node
+}
+
+func trieDelete(node trieNode, path []byte) trieNode {
+	switch n := node.(type) {
+	case *leafNode:
+		if bytes.Equal(n.path, path) {
+			return nil
+		}
+	case *extensionNode:
+		if !bytes.HasPrefix(path, n.path) {
+			return n
+		}
+
+		child := trieDelete(n.child, path[len(n.path):])
+		if child == n.child {
+			return n
+		}
+
+		return joinPath(n.path, child)
+	case *branchNode:
+		branch := n.copy()
+
+		if len(path) == 0 {
+			if n.value == nil {
+				return n
+			}
+
+			branch.value = nil
+		} else {
+			child := trieDelete(n.children[path[0]], path[1:])
+			if child == n.children[path[0]] {
+				return n
+			}
+
+			branch.children[path[0]] = child
+		}
+
+		return branch.normalize()
+	}
+
+	return node
+}
+
+// attach puts a value under the given path below a new branch
+func (n *branchNode) attach(path, value []byte) {
+	if len(path) == 0 {
+		n.value = value
+		return
+	}
+
+	n.children[path[0]] = &leafNode{path: path[1:], value: value}
+}
+
+func (n *branchNode) copy() *branchNode {
+	return &branchNode{children: n.children, value: n.value}
+}
+
+// normalize collapses a branch which is left with a single child or only a value
+func (n *branchNode) normalize() trieNode {
+	index, count := -1, 0
+
+	for i, child := range n.children {
+		if child != nil {
+			index = i
+			count++
+		}
+	}
+
+	switch {
+	case count == 0 && n.value == nil:
+		return nil
+	case count == 0:
+		return &leafNode{path: []byte{}, value: n.value}
+	case count == 1 && n.value == nil:
+		return joinPath([]byte{byte(index)}, n.children[index])
+	}
+
+	return n
+}
+
+// newExtension puts the node below the given path, an empty path needs no extension
+func newExtension(path []byte, child trieNode) trieNode {
+	if len(path) == 0 {
+		return child
+	}
+
+	return &extensionNode{path: path, child: child}
+}
+
+// joinPath prepends the path to the node, merging it with the path of leaves and extensions
+func joinPath(path []byte, node trieNode) trieNode {
+	switch n := node.(type) {
+	case nil:
+		return nil
+	case *leafNode:
+		return &leafNode{path: concatNibbles(path, n.path), value: n.value}
+	case *extensionNode:
+		return newExtension(concatNibbles(path, n.path), n.child)
+	}
+
+	return newExtension(path, node)
+}
+
+func (n *leafNode) hash() types.Hash {
+	if n.cached == nil {
+		buf := &bytes.Buffer{}
+		buf.WriteByte(trieNodeLeaf)
+		writeLengthPrefixed(buf, n.path)
+		writeLengthPrefixed(buf, n.value)
+
+		hash := types.Hash(sha256.Sum256(buf.Bytes()))
+		n.cached = &hash
+	}
+
+	return *n.cached
+}
+
+func (n *extensionNode) hash() types.Hash {
+	if n.cached == nil {
+		buf := &bytes.Buffer{}
+		buf.WriteByte(trieNodeExtension)
+		writeLengthPrefixed(buf, n.path)
+		childHash := n.child.hash()
+		buf.Write(childHash[:])
+
+		hash := types.Hash(sha256.Sum256(buf.Bytes()))
+		n.cached = &hash
+	}
+
+	return *n.cached
+}
+
+func (n *branchNode) hash() types.Hash {
+	if n.cached == nil {
+		buf := &bytes.Buffer{}
+		buf.WriteByte(trieNodeBranch)
+
+		for _, child := range n.children {
+			childHash := types.Hash{}
+			if child != nil {
+				childHash = child.hash()
+			}
+
+			buf.Write(childHash[:])
+		}
+
+		if n.value == nil {
+			buf.WriteByte(0)
+		} else {
+			buf.WriteByte(1)
+			writeLengthPrefixed(buf, n.value)
+		}
+
+		hash := types.Hash(sha256.Sum256(buf.Bytes()))
+		n.cached = &hash
+	}
+
+	return *n.cached
+}
+
+func keyToNibbles(key []byte) []byte {
+	nibbles := make([]byte, len(key)*2)
+
+	for i, b := range key {
+		nibbles[i*2] = b >> 4
+		nibbles[i*2+1] = b & 0x0f
+	}
+
+	return nibbles
+}
+
+func commonPrefix(a, b []byte) []byte {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return a[:i]
+}
+
+func concatNibbles(a, b []byte) []byte {
+	path := make([]byte, 0, len(a)+len(b))
+	path = append(path, a...)
+
+	return append(path, b...)
+}
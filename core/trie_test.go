@@ -0,0 +1,105 @@
+package core
+
+import (
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func TestTrie_PutGetDelete(t *testing.T) {
+	trie := NewTrie()
+	assert.True(t, trie.Hash().IsZero())
+
+	trie.Put([]byte("dog"), []byte("puppy"))
+	trie.Put([]byte("do"), []byte("verb"))
+	trie.Put([]byte("doge"), []byte("coin"))
+	trie.Put([]byte("horse"), []byte("stallion"))
+
+	value, ok := trie.Get([]byte("do"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("verb"), value)
+
+	value, ok = trie.Get([]byte("doge"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("coin"), value)
+
+	_, ok = trie.Get([]byte("d"))
+	assert.False(t, ok)
+
+	trie.Put([]byte("dog"), []byte("hound"))
+	value, _ = trie.Get([]byte("dog"))
+	assert.Equal(t, []byte("hound"), value)
+
+	trie.Delete([]byte("do"))
+	_, ok = trie.Get([]byte("do"))
+	assert.False(t, ok)
+
+	value, ok = trie.Get([]byte("dog"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("hound"), value)
+}
+
+func TestTrie_HashIsOrderIndependent(t *testing.T) {
+	keys := make([][]byte, 200)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i*7))
+	}
+
+	a := NewTrie()
+	for _, key := range keys {
+		a.Put(key, key)
+	}
+
+	b := NewTrie()
+	for _, i := range rand.Perm(len(keys)) {
+		b.Put(keys[i], keys[i])
+	}
+
+	assert.Equal(t, a.Hash(), b.Hash())
+
+	// deleting keys must give the same hash as never inserting them
+	c := NewTrie()
+	for i, key := range keys {
+		if i%3 != 0 {
+			c.Put(key, key)
+		}
+	}
+
+	for i, key := range keys {
+		if i%3 == 0 {
+			b.Delete(key)
+		}
+	}
+
+	assert.Equal(t, c.Hash(), b.Hash())
+
+	for _, key := range keys {
+		b.Delete(key)
+	}
+
+	assert.Equal(t, types.Hash{}, b.Hash())
+}
+
+func TestWorldState_Root(t *testing.T) {
+	bc := newBlockchainWithGenesis(t)
+	root := bc.StateRoot()
+
+	fundAccount(bc, types.Address{0x01}, 0)
+	assert.NotEqual(t, root, bc.StateRoot())
+
+	root = bc.StateRoot()
+	state := bc.state().overlay()
+	assert.Nil(t, state.contractState.Put([]byte("FOO"), []byte{0x01}))
+
+	// the overlay has its own root, the state changes only when the overlay is committed
+	assert.NotEqual(t, root, state.root())
+	assert.Equal(t, root, bc.StateRoot())
+
+	state.commit()
+	assert.Equal(t, state.root(), bc.StateRoot())
+
+	// the trie updated on commit matches a trie built from the whole state
+	assert.Equal(t, bc.state().buildTrie().Hash(), bc.StateRoot())
+}
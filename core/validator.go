@@ -22,30 +22,54 @@ func NewBlockValidator(blockchain *Blockchain) *BlockValidator {
 	return &BlockValidator{blockchain: blockchain}
 }
 
-// ValidateBlock validates and verifies a block
+// ValidateBlock validates and verifies a block. The block may extend any known block, not only the head,
+// so competing branches are kept in the block tree, as long as they fork off at most maxReorgDepth blocks below the head.
 func (bv *BlockValidator) ValidateBlock(block *Block) error {
-	if bv.blockchain.HasBlock(block.Header.Height) {
+	hash := block.Hash(BlockHasher{})
+
+	if bv.blockchain.HasBlockWithHash(hash) {
 		return ErrBlockKnown
 	}
 
-	if block.Header.Height != bv.blockchain.Height()+1 {
-		return fmt.Errorf("block %s too high", block.Hash(BlockHasher{}))
+	prevHeader, err := bv.blockchain.GetHeaderByHash(block.Header.PreviousBlockHash)
+	if err != nil {
+		return fmt.Errorf("%w: block %s extends %s", ErrUnknownParent, hash, block.Header.PreviousBlockHash)
 	}
 
-	prevHeader, err := bv.blockchain.GetHeader(block.Header.Height - 1)
-	if err != nil {
+	if block.Header.Height != prevHeader.Height+1 {
+		return fmt.Errorf("block %s has height %d, expected %d", hash, block.Header.Height, prevHeader.Height+1)
+	}
+
+	if err := bv.blockchain.checkForkDepth(block.Header.PreviousBlockHash); err != nil {
 		return err
 	}
 
-	hash := BlockHasher{}.Hash(prevHeader)
+	if err := block.Verify(); err != nil {
+		return err
+	}
 
-	if hash != block.Header.PreviousBlockHash {
-		return fmt.Errorf("the hash of the previous block %s is invalid", block.Header.PreviousBlockHash)
+	if err := block.checkGasLimits(); err != nil {
+		return err
 	}
 
-	if err := block.Verify(); err != nil {
+	// The state is only known for the head. The state root of a side branch block
+	// is checked when the blockchain switches to its branch.
+	if block.Header.PreviousBlockHash != bv.blockchain.HeadHash() {
+		return nil
+	}
+
+	stateRoot, receiptsRoot, err := bv.blockchain.CalculateRoots(block)
+	if err != nil {
 		return err
 	}
 
+	if stateRoot != block.Header.StateRoot {
+		return fmt.Errorf("block %s has invalid state root %s, expected %s", hash, block.Header.StateRoot, stateRoot)
+	}
+
+	if receiptsRoot != block.Header.ReceiptsRoot {
+		return fmt.Errorf("block %s has invalid receipts root %s, expected %s", hash, block.Header.ReceiptsRoot, receiptsRoot)
+	}
+
 	return nil
 }
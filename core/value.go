@@ -0,0 +1,58 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Tags of the encoded values inside the contract storage
+const (
+	valueTagWord  byte = 0x01
+	valueTagBytes byte = 0x02
+)
+
+var ErrInvalidValue = errors.New("invalid value encoding")
+
+// Value is a value on the stack of the VirtualMachine, either a Word or Bytes
+type Value interface {
+	isValue()
+}
+
+// Bytes is a byte array on the stack of the VirtualMachine, used for keys, addresses and hashes
+type Bytes []byte
+
+func (Word) isValue()  {}
+func (Bytes) isValue() {}
+
+// encodeValue returns the encoding of the value which is kept in the contract storage.
+// The value is prefixed with its type, so decodeValue returns a value of the same type.
+func encodeValue(value Value) ([]byte, error) {
+	switch v := value.(type) {
+	case Word:
+		return append([]byte{valueTagWord}, v.Bytes()...), nil
+	case Bytes:
+		return append([]byte{valueTagBytes}, v...), nil
+	default:
+		return nil, fmt.Errorf("%w: cannot encode %T", ErrInvalidValue, value)
+	}
+}
+
+// decodeValue decodes a value written by encodeValue
+func decodeValue(b []byte) (Value, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w: empty value", ErrInvalidValue)
+	}
+
+	switch b[0] {
+	case valueTagWord:
+		if len(b) != 1+WordSize {
+			return nil, fmt.Errorf("%w: word of %d bytes", ErrInvalidValue, len(b)-1)
+		}
+
+		return WordFromBytes(b[1:]), nil
+	case valueTagBytes:
+		return Bytes(append([]byte{}, b[1:]...)), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown tag %#x", ErrInvalidValue, b[0])
+	}
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// mustDecodeValue decodes a value read from the contract storage
+func mustDecodeValue(t *testing.T, b []byte) Value {
+	value, err := decodeValue(b)
+	assert.Nil(t, err)
+
+	return value
+}
+
+func TestValue_StateRoundTrip(t *testing.T) {
+	state := NewState()
+
+	values := map[string]Value{
+		"word":  Word{1, 2, 3, 4},
+		"zero":  Word{},
+		"bytes": Bytes("FOO"),
+		"empty": Bytes{},
+	}
+
+	for key, value := range values {
+		encoded, err := encodeValue(value)
+		assert.Nil(t, err)
+		assert.Nil(t, state.Put([]byte(key), encoded))
+	}
+
+	for key, value := range values {
+		encoded, err := state.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, mustDecodeValue(t, encoded), key)
+	}
+}
+
+func TestValue_DecodeInvalid(t *testing.T) {
+	for _, b := range [][]byte{nil, {0x03}, {valueTagWord, 0x01}} {
+		_, err := decodeValue(b)
+		assert.ErrorIs(t, err, ErrInvalidValue)
+	}
+}
+
+func TestVirtualMachine_StoreAndGetValues(t *testing.T) {
+	// stores the bytes "ab" under A and the word 2 under B, then returns B + B read back from the storage
+	code, err := Assemble(`
+		PUSHB 'a'
+		PUSHB 'b'
+		PUSH 2
+		PACK
+		PUSHB 'A'
+		STORE
+		PUSH 2
+		PUSHB 'B'
+		STORE
+		PUSHB 'B'
+		GET
+		DUP
+		ADD
+		RETURN
+	`)
+	assert.Nil(t, err)
+
+	state := NewState()
+	vm := NewVirtualMachine(code, state, 1000)
+	assert.Nil(t, vm.Run())
+	assert.Equal(t, NewWord(4), vm.ReturnValue())
+
+	value, err := state.Get([]byte("A"))
+	assert.Nil(t, err)
+	assert.Equal(t, Bytes("ab"), mustDecodeValue(t, value))
+}
@@ -1,164 +1,732 @@
 package core
 
-import "encoding/binary"
+import (
+	"errors"
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/types"
+)
 
 type Instruction byte
 
 const (
-	InstructionPushInt  Instruction = 0x0a
-	InstructionAdd      Instruction = 0x0b
-	InstructionPushByte Instruction = 0x0c
-	InstructionPack     Instruction = 0x0d
-	InstructionSub      Instruction = 0x0e
-	InstructionStore    Instruction = 0x0f
-	InstructionGet      Instruction = 0xae
-	InstructionMul      Instruction = 0xea
-	InstructionDiv      Instruction = 0xfd
+	InstructionPushInt     Instruction = 0x0a
+	InstructionAdd         Instruction = 0x0b
+	InstructionPushByte    Instruction = 0x0c
+	InstructionPack        Instruction = 0x0d
+	InstructionSub         Instruction = 0x0e
+	InstructionStore       Instruction = 0x0f
+	InstructionGet         Instruction = 0xae
+	InstructionMul         Instruction = 0xea
+	InstructionDiv         Instruction = 0xfd
+	InstructionStop        Instruction = 0x00
+	InstructionLt          Instruction = 0x10
+	InstructionGt          Instruction = 0x11
+	InstructionEq          Instruction = 0x14
+	InstructionNot         Instruction = 0x15
+	InstructionAnd         Instruction = 0x16
+	InstructionOr          Instruction = 0x17
+	InstructionPop         Instruction = 0x50
+	InstructionJump        Instruction = 0x56
+	InstructionJumpI       Instruction = 0x57
+	InstructionDup         Instruction = 0x80
+	InstructionSwap        Instruction = 0x90
+	InstructionReturn      Instruction = 0xf3
+	InstructionAddress     Instruction = 0x30
+	InstructionBalance     Instruction = 0x31
+	InstructionCaller      Instruction = 0x33
+	InstructionCallValue   Instruction = 0x34
+	InstructionTimestamp   Instruction = 0x42
+	InstructionBlockHeight Instruction = 0x43
+	InstructionTxHash      Instruction = 0x49
+	InstructionLog         Instruction = 0xa0
+	InstructionCall        Instruction = 0xf1
+	InstructionStaticCall  Instruction = 0xfa
+)
+
+// MaxCallDepth is the number of nested calls a contract call may start, deeper calls fail
+const MaxCallDepth = 64
+
+// Gas costs of the instructions
+const (
+	GasZero      uint64 = 0   // halting
+	GasQuickStep uint64 = 2   // dropping a value
+	GasFastStep  uint64 = 3   // pushing, stack manipulation, simple arithmetic and comparisons
+	GasSlowStep  uint64 = 5   // multiplication and division
+	GasMidStep   uint64 = 8   // jumps
+	GasPackByte  uint64 = 1   // every byte packed on top of the GasFastStep
+	GasStateRead uint64 = 50  // reading the contract state
+	GasStore     uint64 = 100 // writing the contract state
+	GasLog       uint64 = 20  // emitting a log
+	GasLogByte   uint64 = 1   // every byte of the log data on top of the GasLog
+	GasCall      uint64 = 40  // calling another contract, on top of the gas forwarded to it
+	GasCodeByte  uint64 = 10  // every byte of the code a contract is deployed with
 )
 
-// Stack
+// instructionGas is the gas schedule, the gas an instruction costs before it is executed
+var instructionGas = map[Instruction]uint64{
+	InstructionPushInt:     GasFastStep,
+	InstructionPushByte:    GasFastStep,
+	InstructionPack:        GasFastStep,
+	InstructionAdd:         GasFastStep,
+	InstructionSub:         GasFastStep,
+	InstructionMul:         GasSlowStep,
+	InstructionDiv:         GasSlowStep,
+	InstructionStore:       GasStore,
+	InstructionGet:         GasStateRead,
+	InstructionStop:        GasZero,
+	InstructionReturn:      GasZero,
+	InstructionLt:          GasFastStep,
+	InstructionGt:          GasFastStep,
+	InstructionEq:          GasFastStep,
+	InstructionNot:         GasFastStep,
+	InstructionAnd:         GasFastStep,
+	InstructionOr:          GasFastStep,
+	InstructionPop:         GasQuickStep,
+	InstructionDup:         GasFastStep,
+	InstructionSwap:        GasFastStep,
+	InstructionJump:        GasMidStep,
+	InstructionJumpI:       GasMidStep,
+	InstructionAddress:     GasQuickStep,
+	InstructionBalance:     GasStateRead,
+	InstructionCaller:      GasQuickStep,
+	InstructionCallValue:   GasQuickStep,
+	InstructionTimestamp:   GasQuickStep,
+	InstructionBlockHeight: GasQuickStep,
+	InstructionTxHash:      GasQuickStep,
+	InstructionLog:         GasLog,
+	InstructionCall:        GasCall,
+	InstructionStaticCall:  GasCall,
+}
+
+var (
+	ErrOutOfGas        = errors.New("out of gas")
+	ErrInvalidOpcode   = errors.New("invalid opcode")
+	ErrMissingOperand  = errors.New("missing operand")
+	ErrInvalidOperand  = errors.New("invalid operand")
+	ErrStackOverflow   = errors.New("stack overflow")
+	ErrStackUnderflow  = errors.New("stack underflow")
+	ErrDivisionByZero  = errors.New("division by zero")
+	ErrInvalidPackSize = errors.New("invalid pack size")
+	ErrInvalidJump     = errors.New("invalid jump destination")
+	ErrWriteProtection = errors.New("write protection")
+)
+
+// ExecutionContext is the environment the code runs in, it is read by the environment instructions
+type ExecutionContext struct {
+	Caller      types.Address // sender of the transaction, or the calling contract
+	Value       uint64        // value sent with the transaction, or with the call
+	Address     types.Address // address of the running contract
+	BlockHeight uint32
+	Timestamp   int64
+	TxHash      types.Hash
+	Balance     func(address types.Address) uint64   // returns the balance of an account, zero for an unknown account
+	Depth       int                                  // number of calls which led to the running one
+	Static      bool                                 // the code may not change the state, set by InstructionStaticCall
+	Call        func(call *ContractCall) *CallResult // runs another contract, without it every call fails
+}
+
+// ContractCall is a call of one contract to another
+type ContractCall struct {
+	Contract types.Address
+	Value    uint64
+	GasLimit uint64
+	Static   bool
+}
+
+// CallResult is the outcome of a ContractCall. If Err is set, every change of the call is dropped.
+type CallResult struct {
+	ReturnValue Value
+	GasUsed     uint64
+	Logs        []*Log
+	Err         error
+}
+
+// Stack is the last in, first out stack of the VirtualMachine. It holds at most the number of values
+// it was created with, pushing more fails with ErrStackOverflow instead of growing the stack.
 type Stack struct {
-	data         []any
+	data         []Value
 	stackPointer int
 }
 
 // NewStack is a constructor for the Stack
 func NewStack(size int) *Stack {
 	return &Stack{
-		data:         make([]any, size),
+		data:         make([]Value, size),
 		stackPointer: 0,
 	}
 }
 
-// Push pushes the given value at the end of the stack
-func (s *Stack) Push(value any) {
+// Push pushes the given value on top of the stack
+func (s *Stack) Push(value Value) error {
+	if s.stackPointer >= len(s.data) {
+		return ErrStackOverflow
+	}
+
 	s.data[s.stackPointer] = value
 	s.stackPointer++
+
+	return nil
 }
 
-// Pop pops the value from the start of the stack
-func (s *Stack) Pop() any {
-	value := s.data[0]
-	s.data = append(s.data[:0], s.data[1:]...)
+// Pop pops the value from the top of the stack
+func (s *Stack) Pop() (Value, error) {
+	if s.stackPointer == 0 {
+		return nil, ErrStackUnderflow
+	}
+
 	s.stackPointer--
+	value := s.data[s.stackPointer]
+	s.data[s.stackPointer] = nil
+
+	return value, nil
+}
+
+// Dup pushes the value on top of the stack once more
+func (s *Stack) Dup() error {
+	if s.stackPointer == 0 {
+		return ErrStackUnderflow
+	}
+
+	return s.Push(s.data[s.stackPointer-1])
+}
+
+// Swap exchanges the two values on top of the stack
+func (s *Stack) Swap() error {
+	if s.stackPointer < 2 {
+		return ErrStackUnderflow
+	}
 
-	return value
+	s.data[s.stackPointer-1], s.data[s.stackPointer-2] = s.data[s.stackPointer-2], s.data[s.stackPointer-1]
+
+	return nil
+}
+
+// Len returns the number of values on the stack
+func (s *Stack) Len() int {
+	return s.stackPointer
+}
+
+// Values returns a copy of the values on the stack, the bottom value first
+func (s *Stack) Values() []Value {
+	return append([]Value{}, s.data[:s.stackPointer]...)
 }
 
 // VirtualMachine
 type VirtualMachine struct {
 	data               []byte
+	operands           []bool // marks the bytes of data which are operands of the next instruction
 	instructionPointer int
+	nextInstruction    int  // the instruction executed after the current one, changed by jumps
+	stopped            bool // set by the instructions which halt the execution
+	returnValue        Value
 	stack              *Stack
-	contractState      *State
+	contractState      ContractStorage
+	context            *ExecutionContext
+	logs               []*Log // emitted by InstructionLog and by the successful calls
+	gasLimit           uint64
+	gasUsed            uint64
 }
 
-// NewVirtualMachine is a constructor for the VirtualMachine
-func NewVirtualMachine(data []byte, contractState *State) *VirtualMachine {
+// NewVirtualMachine is a constructor for the VirtualMachine. The execution fails with ErrOutOfGas
+// as soon as it needs more than gasLimit gas.
+func NewVirtualMachine(data []byte, contractState ContractStorage, gasLimit uint64) *VirtualMachine {
 	return &VirtualMachine{
 		data:               data,
 		instructionPointer: 0,
 		stack:              NewStack(128),
 		contractState:      contractState,
+		context:            &ExecutionContext{},
+		gasLimit:           gasLimit,
 	}
 }
 
-// Run runs the virtual machine
+// SetContext sets the environment of the code. Without a context the environment instructions return zero values.
+func (vm *VirtualMachine) SetContext(context *ExecutionContext) {
+	vm.context = context
+}
+
+// ReturnValue returns the value passed to InstructionReturn, or nil if the code did not return a value
+func (vm *VirtualMachine) ReturnValue() Value {
+	return vm.returnValue
+}
+
+// GasUsed returns the gas used by the executed instructions
+func (vm *VirtualMachine) GasUsed() uint64 {
+	return vm.gasUsed
+}
+
+// Logs returns the logs emitted by the code in the order they were emitted
+func (vm *VirtualMachine) Logs() []*Log {
+	return vm.logs
+}
+
+// Stack returns the stack of the virtual machine
+func (vm *VirtualMachine) Stack() *Stack {
+	return vm.stack
+}
+
+// Run runs the virtual machine. Invalid code and failing instructions return an error, they never panic.
 func (vm *VirtualMachine) Run() error {
-	for {
+	operands, err := analyzeCode(vm.data)
+	if err != nil {
+		return err
+	}
+
+	vm.operands = operands
+
+	for ; vm.instructionPointer < len(vm.data) && !vm.stopped; vm.instructionPointer = vm.nextInstruction {
+		vm.nextInstruction = vm.instructionPointer + 1
+
+		// operands are read by the instruction which follows them
+		if vm.operands[vm.instructionPointer] {
+			continue
+		}
+
 		instruction := Instruction(vm.data[vm.instructionPointer])
 
-		if err := vm.Exec(instruction); err != nil {
+		if err := vm.useGas(instructionGas[instruction]); err != nil {
 			return err
 		}
 
-		vm.instructionPointer++
+		if err := vm.Exec(instruction); err != nil {
+			return fmt.Errorf("instruction %#x at %d: %w", byte(instruction), vm.instructionPointer, err)
+		}
+	}
+
+	return nil
+}
+
+// analyzeCode checks that the code consists of valid instructions only and returns which of its bytes are operands.
+// The operand of a push instruction is the byte right before it, so the code is parsed from the end.
+// Jumps may only land on instructions, never on an operand.
+func analyzeCode(data []byte) ([]bool, error) {
+	operands := make([]bool, len(data))
+
+	for i := len(data) - 1; i >= 0; i-- {
+		instruction := Instruction(data[i])
+
+		if _, ok := instructionGas[instruction]; !ok {
+			return nil, fmt.Errorf("%w: %#x at %d", ErrInvalidOpcode, data[i], i)
+		}
+
+		if instruction == InstructionPushInt || instruction == InstructionPushByte {
+			if i == 0 {
+				return nil, fmt.Errorf("%w: push at %d", ErrMissingOperand, i)
+			}
 
-		if vm.instructionPointer > len(vm.data)-1 {
-			break
+			i--
+			operands[i] = true
 		}
 	}
 
+	return operands, nil
+}
+
+// useGas charges the gas of an instruction
+func (vm *VirtualMachine) useGas(gas uint64) error {
+	if vm.gasLimit-vm.gasUsed < gas {
+		vm.gasUsed = vm.gasLimit
+		return ErrOutOfGas
+	}
+
+	vm.gasUsed += gas
+
+	return nil
+}
+
+func (vm *VirtualMachine) push(value Value) error {
+	return vm.stack.Push(value)
+}
+
+func (vm *VirtualMachine) pop() (Value, error) {
+	return vm.stack.Pop()
+}
+
+func (vm *VirtualMachine) popWord() (Word, error) {
+	value, err := vm.pop()
+	if err != nil {
+		return Word{}, err
+	}
+
+	w, ok := value.(Word)
+	if !ok {
+		return Word{}, fmt.Errorf("%w: expected word, got %T", ErrInvalidOperand, value)
+	}
+
+	return w, nil
+}
+
+func (vm *VirtualMachine) popBytes() (Bytes, error) {
+	value, err := vm.pop()
+	if err != nil {
+		return nil, err
+	}
+
+	b, ok := value.(Bytes)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected bytes, got %T", ErrInvalidOperand, value)
+	}
+
+	return b, nil
+}
+
+// jump continues the execution at the destination
+func (vm *VirtualMachine) jump(destination Word) error {
+	if !destination.IsUint64() || destination.Uint64() >= uint64(len(vm.data)) || vm.operands[destination.Uint64()] {
+		return fmt.Errorf("%w: %s", ErrInvalidJump, destination)
+	}
+
+	vm.nextInstruction = int(destination.Uint64())
+
 	return nil
 }
 
+// popOperands pops the two operands of a binary instruction. The second operand is on top of the stack,
+// so the operands are pushed in the order they are written: a b SUB computes a - b.
+func (vm *VirtualMachine) popOperands() (Word, Word, error) {
+	b, err := vm.popWord()
+	if err != nil {
+		return Word{}, Word{}, err
+	}
+
+	a, err := vm.popWord()
+	if err != nil {
+		return Word{}, Word{}, err
+	}
+
+	return a, b, nil
+}
+
 // Exec executes the instruction
 func (vm *VirtualMachine) Exec(instruction Instruction) error {
 	switch instruction {
 	case InstructionPushInt:
-		vm.stack.Push(int(vm.data[vm.instructionPointer-1]))
+		return vm.push(NewWord(uint64(vm.data[vm.instructionPointer-1])))
 	case InstructionPushByte:
-		vm.stack.Push(byte(vm.data[vm.instructionPointer-1]))
+		return vm.push(Bytes{vm.data[vm.instructionPointer-1]})
 	case InstructionPack:
-		n := vm.stack.Pop().(int)
-		b := make([]byte, n)
+		n, err := vm.popWord()
+		if err != nil {
+			return err
+		}
+
+		if !n.IsUint64() || n.Uint64() > uint64(vm.stack.Len()) {
+			return fmt.Errorf("%w: %s", ErrInvalidPackSize, n)
+		}
+
+		// the byte arrays are joined in the order they were pushed
+		parts := make([]Bytes, n.Uint64())
 
-		for i := 0; i < n; i++ {
-			b[i] = vm.stack.Pop().(byte)
+		for i := len(parts) - 1; i >= 0; i-- {
+			if parts[i], err = vm.popBytes(); err != nil {
+				return err
+			}
 		}
 
-		vm.stack.Push(b)
+		b := Bytes{}
+		for _, part := range parts {
+			b = append(b, part...)
+		}
+
+		if err := vm.useGas(uint64(len(b)) * GasPackByte); err != nil {
+			return err
+		}
+
+		return vm.push(b)
 	case InstructionSub:
-		a := vm.stack.Pop().(int)
-		b := vm.stack.Pop().(int)
-		c := a - b
+		a, b, err := vm.popOperands()
+		if err != nil {
+			return err
+		}
 
-		vm.stack.Push(c)
+		return vm.push(a.Sub(b))
 	case InstructionAdd:
-		a := vm.stack.Pop().(int)
-		b := vm.stack.Pop().(int)
-		c := a + b
+		a, b, err := vm.popOperands()
+		if err != nil {
+			return err
+		}
 
-		vm.stack.Push(c)
+		return vm.push(a.Add(b))
 	case InstructionStore:
-		var (
-			key             = vm.stack.Pop().([]byte)
-			value           = vm.stack.Pop()
-			serializedValue []byte
-		)
+		if vm.context.Static {
+			return ErrWriteProtection
+		}
 
-		switch v := value.(type) {
-		case int:
-			serializedValue = serializeInt64(int64(v))
-		default:
-			panic("TODO: unknown type")
+		key, err := vm.popBytes()
+		if err != nil {
+			return err
+		}
+
+		value, err := vm.pop()
+		if err != nil {
+			return err
 		}
 
-		vm.contractState.Put(key, serializedValue)
+		serializedValue, err := encodeValue(value)
+		if err != nil {
+			return err
+		}
+
+		return vm.contractState.Put(key, serializedValue)
 	case InstructionGet:
-		key := vm.stack.Pop().([]byte)
+		key, err := vm.popBytes()
+		if err != nil {
+			return err
+		}
 
-		value, err := vm.contractState.Get(key)
+		serializedValue, err := vm.contractState.Get(key)
 		if err != nil {
 			return err
 		}
 
-		vm.stack.Push(value)
+		value, err := decodeValue(serializedValue)
+		if err != nil {
+			return err
+		}
+
+		return vm.push(value)
 	case InstructionMul:
-		a := vm.stack.Pop().(int)
-		b := vm.stack.Pop().(int)
-		c := a * b
+		a, b, err := vm.popOperands()
+		if err != nil {
+			return err
+		}
 
-		vm.stack.Push(c)
+		return vm.push(a.Mul(b))
 	case InstructionDiv:
-		a := vm.stack.Pop().(int)
-		b := vm.stack.Pop().(int)
-		c := a / b
+		a, b, err := vm.popOperands()
+		if err != nil {
+			return err
+		}
+
+		if b.IsZero() {
+			return ErrDivisionByZero
+		}
+
+		return vm.push(a.Div(b))
+	case InstructionLt:
+		a, b, err := vm.popOperands()
+		if err != nil {
+			return err
+		}
+
+		return vm.push(boolToWord(a.Cmp(b) < 0))
+	case InstructionGt:
+		a, b, err := vm.popOperands()
+		if err != nil {
+			return err
+		}
+
+		return vm.push(boolToWord(a.Cmp(b) > 0))
+	case InstructionEq:
+		a, b, err := vm.popOperands()
+		if err != nil {
+			return err
+		}
+
+		return vm.push(boolToWord(a == b))
+	case InstructionNot:
+		a, err := vm.popWord()
+		if err != nil {
+			return err
+		}
+
+		return vm.push(boolToWord(a.IsZero()))
+	case InstructionAnd:
+		a, b, err := vm.popOperands()
+		if err != nil {
+			return err
+		}
 
-		vm.stack.Push(c)
+		return vm.push(a.And(b))
+	case InstructionOr:
+		a, b, err := vm.popOperands()
+		if err != nil {
+			return err
+		}
+
+		return vm.push(a.Or(b))
+	case InstructionPop:
+		_, err := vm.pop()
+
+		return err
+	case InstructionDup:
+		return vm.stack.Dup()
+	case InstructionSwap:
+		return vm.stack.Swap()
+	case InstructionJump:
+		destination, err := vm.popWord()
+		if err != nil {
+			return err
+		}
+
+		return vm.jump(destination)
+	case InstructionJumpI:
+		destination, condition, err := vm.popOperands()
+		if err != nil {
+			return err
+		}
+
+		if condition.IsZero() {
+			return nil
+		}
+
+		return vm.jump(destination)
+	case InstructionAddress:
+		return vm.push(Bytes(vm.context.Address.ToSlice()))
+	case InstructionBalance:
+		address, err := vm.popBytes()
+		if err != nil {
+			return err
+		}
+
+		if len(address) != len(types.Address{}) {
+			return fmt.Errorf("%w: address of %d bytes", ErrInvalidOperand, len(address))
+		}
+
+		balance := uint64(0)
+		if vm.context.Balance != nil {
+			balance = vm.context.Balance(types.AddressFromBytes(address))
+		}
+
+		return vm.push(NewWord(balance))
+	case InstructionCaller:
+		return vm.push(Bytes(vm.context.Caller.ToSlice()))
+	case InstructionCallValue:
+		return vm.push(NewWord(vm.context.Value))
+	case InstructionTimestamp:
+		return vm.push(NewWord(uint64(vm.context.Timestamp)))
+	case InstructionBlockHeight:
+		return vm.push(NewWord(uint64(vm.context.BlockHeight)))
+	case InstructionTxHash:
+		return vm.push(Bytes(vm.context.TxHash.ToSlice()))
+	case InstructionLog:
+		if vm.context.Static {
+			return ErrWriteProtection
+		}
+
+		value, err := vm.pop()
+		if err != nil {
+			return err
+		}
+
+		var data []byte
+
+		switch v := value.(type) {
+		case Bytes:
+			data = v
+		case Word:
+			data = v.Bytes()
+		}
+
+		if err := vm.useGas(uint64(len(data)) * GasLogByte); err != nil {
+			return err
+		}
+
+		vm.logs = append(vm.logs, &Log{Address: vm.context.Address, Data: data})
+	case InstructionCall:
+		return vm.call(false)
+	case InstructionStaticCall:
+		return vm.call(true)
+	case InstructionStop:
+		vm.stopped = true
+	case InstructionReturn:
+		value, err := vm.pop()
+		if err != nil {
+			return err
+		}
+
+		vm.returnValue = value
+		vm.stopped = true
+	default:
+		return fmt.Errorf("%w: %#x", ErrInvalidOpcode, byte(instruction))
 	}
 
 	return nil
 }
 
-func serializeInt64(value int64) []byte {
-	buf := make([]byte, 8)
+// call runs another contract with the gas popped from the stack, but at most the remaining gas.
+// It pushes the return value of the call, or empty bytes, and whether the call succeeded.
+// A failing call only drops its own changes, the calling code goes on.
+func (vm *VirtualMachine) call(static bool) error {
+	gas, err := vm.popWord()
+	if err != nil {
+		return err
+	}
 
-	binary.LittleEndian.PutUint64(buf, uint64(value))
+	value := Word{}
+	if !static {
+		if value, err = vm.popWord(); err != nil {
+			return err
+		}
+	}
+
+	contract, err := vm.popBytes()
+	if err != nil {
+		return err
+	}
+
+	if len(contract) != len(types.Address{}) {
+		return fmt.Errorf("%w: address of %d bytes", ErrInvalidOperand, len(contract))
+	}
+
+	if !value.IsUint64() {
+		return fmt.Errorf("%w: value %s", ErrInvalidOperand, value)
+	}
+
+	if vm.context.Static && !value.IsZero() {
+		return ErrWriteProtection
+	}
+
+	if available := vm.gasLimit - vm.gasUsed; !gas.IsUint64() || gas.Uint64() > available {
+		gas = NewWord(available)
+	}
+
+	var result *CallResult
+
+	switch {
+	case vm.context.Call == nil:
+		result = &CallResult{Err: errors.New("contract calls are not available")}
+	case vm.context.Depth >= MaxCallDepth:
+		result = &CallResult{Err: fmt.Errorf("call depth %d reached", MaxCallDepth)}
+	default:
+		result = vm.context.Call(&ContractCall{
+			Contract: types.AddressFromBytes(contract),
+			Value:    value.Uint64(),
+			GasLimit: gas.Uint64(),
+			Static:   static || vm.context.Static,
+		})
+	}
 
-	return buf
+	if err := vm.useGas(result.GasUsed); err != nil {
+		return err
+	}
+
+	if result.Err != nil {
+		if err := vm.push(Bytes{}); err != nil {
+			return err
+		}
+
+		return vm.push(boolToWord(false))
+	}
+
+	vm.logs = append(vm.logs, result.Logs...)
+
+	returnValue := result.ReturnValue
+	if returnValue == nil {
+		returnValue = Bytes{}
+	}
+
+	if err := vm.push(returnValue); err != nil {
+		return err
+	}
+
+	return vm.push(boolToWord(true))
 }
 
-func deserializeInt64(b []byte) int64 {
-	return int64(binary.LittleEndian.Uint64(b))
+func boolToWord(b bool) Word {
+	if b {
+		return NewWord(1)
+	}
+
+	return Word{}
 }
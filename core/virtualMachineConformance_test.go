@@ -0,0 +1,133 @@
+package core
+
+import (
+	"github.com/evgeniy-dammer/blockchain/types"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// conformanceTest runs the source with conformanceContext and checks the outcome described in docs/vm.md
+type conformanceTest struct {
+	source string
+	ret    Value
+	logs   []*Log
+	gas    uint64 // only checked if the code succeeds
+	err    error
+}
+
+var conformanceContext = &ExecutionContext{
+	Caller:      types.Address{0x01},
+	Value:       7,
+	Address:     types.Address{0x02},
+	BlockHeight: 3,
+	Timestamp:   4,
+	TxHash:      types.Hash{0x05},
+	Balance: func(address types.Address) uint64 {
+		return uint64(address[0]) * 10
+	},
+}
+
+var conformanceTests = map[string]conformanceTest{
+	"STOP":                {source: "PUSH 1\nSTOP\nPUSH 2\nRETURN", gas: 3},
+	"RETURN":              {source: "PUSH 1\nRETURN", ret: NewWord(1), gas: 3},
+	"RETURN empty stack":  {source: "RETURN", err: ErrStackUnderflow},
+	"PUSH":                {source: "PUSH 255\nRETURN", ret: NewWord(255), gas: 3},
+	"PUSHB":               {source: "PUSHB 'a'\nRETURN", ret: Bytes("a"), gas: 3},
+	"PACK":                {source: "PUSHB 'a'\nPUSHB 'b'\nPUSHB 'c'\nPUSH 3\nPACK\nRETURN", ret: Bytes("abc"), gas: 18},
+	"PACK nothing":        {source: "PUSH 0\nPACK\nRETURN", ret: Bytes{}, gas: 6},
+	"PACK packed":         {source: "PUSHB 'a'\nPUSHB 'b'\nPUSH 2\nPACK\nPUSHB 'c'\nPUSH 2\nPACK\nRETURN", ret: Bytes("abc"), gas: 26},
+	"PACK too many":       {source: "PUSHB 'a'\nPUSH 2\nPACK", err: ErrInvalidPackSize},
+	"PACK word":           {source: "PUSH 1\nPUSH 1\nPACK", err: ErrInvalidOperand},
+	"ADD":                 {source: "PUSH 2\nPUSH 3\nADD\nRETURN", ret: NewWord(5), gas: 9},
+	"ADD wraps":           {source: "PUSH 0\nPUSH 1\nSUB\nPUSH 1\nADD\nRETURN", ret: NewWord(0), gas: 15},
+	"ADD bytes":           {source: "PUSHB 'a'\nPUSH 1\nADD", err: ErrInvalidOperand},
+	"ADD empty stack":     {source: "PUSH 1\nADD", err: ErrStackUnderflow},
+	"SUB":                 {source: "PUSH 5\nPUSH 3\nSUB\nRETURN", ret: NewWord(2), gas: 9},
+	"SUB wraps":           {source: "PUSH 0\nPUSH 1\nSUB\nRETURN", ret: maxWord, gas: 9},
+	"MUL":                 {source: "PUSH 6\nPUSH 7\nMUL\nRETURN", ret: NewWord(42), gas: 11},
+	"MUL wraps":           {source: "PUSH 0\nPUSH 1\nSUB\nPUSH 2\nMUL\nRETURN", ret: maxWord.Sub(NewWord(1)), gas: 17},
+	"DIV":                 {source: "PUSH 7\nPUSH 2\nDIV\nRETURN", ret: NewWord(3), gas: 11},
+	"DIV by zero":         {source: "PUSH 7\nPUSH 0\nDIV", err: ErrDivisionByZero},
+	"LT":                  {source: "PUSH 2\nPUSH 3\nLT\nRETURN", ret: NewWord(1), gas: 9},
+	"GT":                  {source: "PUSH 2\nPUSH 3\nGT\nRETURN", ret: NewWord(0), gas: 9},
+	"EQ":                  {source: "PUSH 3\nPUSH 3\nEQ\nRETURN", ret: NewWord(1), gas: 9},
+	"NOT zero":            {source: "PUSH 0\nNOT\nRETURN", ret: NewWord(1), gas: 6},
+	"NOT non-zero":        {source: "PUSH 5\nNOT\nRETURN", ret: NewWord(0), gas: 6},
+	"AND":                 {source: "PUSH 6\nPUSH 3\nAND\nRETURN", ret: NewWord(2), gas: 9},
+	"OR":                  {source: "PUSH 6\nPUSH 3\nOR\nRETURN", ret: NewWord(7), gas: 9},
+	"POP":                 {source: "PUSH 1\nPUSH 2\nPOP\nRETURN", ret: NewWord(1), gas: 8},
+	"POP empty stack":     {source: "POP", err: ErrStackUnderflow},
+	"DUP":                 {source: "PUSH 2\nDUP\nADD\nRETURN", ret: NewWord(4), gas: 9},
+	"DUP empty stack":     {source: "DUP", err: ErrStackUnderflow},
+	"SWAP":                {source: "PUSH 3\nPUSH 5\nSWAP\nSUB\nRETURN", ret: NewWord(2), gas: 12},
+	"SWAP single value":   {source: "PUSH 3\nSWAP", err: ErrStackUnderflow},
+	"JUMP":                {source: "PUSH skip\nJUMP\nPUSH 1\nRETURN\nskip:\nPUSH 2\nRETURN", ret: NewWord(2), gas: 14},
+	"JUMP to operand":     {source: "PUSH 3\nJUMP\nPUSH 1\nRETURN", err: ErrInvalidJump},
+	"JUMP behind code":    {source: "PUSH 100\nJUMP", err: ErrInvalidJump},
+	"JUMPI taken":         {source: "PUSH skip\nPUSH 1\nJUMPI\nPUSH 1\nRETURN\nskip:\nPUSH 2\nRETURN", ret: NewWord(2), gas: 17},
+	"JUMPI not taken":     {source: "PUSH skip\nPUSH 0\nJUMPI\nPUSH 1\nRETURN\nskip:\nPUSH 2\nRETURN", ret: NewWord(1), gas: 17},
+	"STORE and GET":       {source: "PUSH 9\nPUSHB 'k'\nSTORE\nPUSHB 'k'\nGET\nRETURN", ret: NewWord(9), gas: 159},
+	"STORE and GET bytes": {source: "PUSHB 'v'\nPUSHB 'k'\nSTORE\nPUSHB 'k'\nGET\nRETURN", ret: Bytes("v"), gas: 159},
+	"STORE word key":      {source: "PUSH 1\nPUSH 2\nSTORE", err: ErrInvalidOperand},
+	"LOG word":            {source: "PUSH 1\nLOG", logs: []*Log{{Address: conformanceContext.Address, Data: NewWord(1).Bytes()}}, gas: 55},
+	"LOG bytes":           {source: "PUSHB 'a'\nLOG", logs: []*Log{{Address: conformanceContext.Address, Data: []byte("a")}}, gas: 24},
+	"ADDRESS":             {source: "ADDRESS\nRETURN", ret: Bytes(conformanceContext.Address.ToSlice()), gas: 2},
+	"BALANCE":             {source: "ADDRESS\nBALANCE\nRETURN", ret: NewWord(20), gas: 52},
+	"BALANCE word":        {source: "PUSH 2\nBALANCE", err: ErrInvalidOperand},
+	"CALLER":              {source: "CALLER\nRETURN", ret: Bytes(conformanceContext.Caller.ToSlice()), gas: 2},
+	"CALLVALUE":           {source: "CALLVALUE\nRETURN", ret: NewWord(7), gas: 2},
+	"TIMESTAMP":           {source: "TIMESTAMP\nRETURN", ret: NewWord(4), gas: 2},
+	"BLOCKHEIGHT":         {source: "BLOCKHEIGHT\nRETURN", ret: NewWord(3), gas: 2},
+	"TXHASH":              {source: "TXHASH\nRETURN", ret: Bytes(conformanceContext.TxHash.ToSlice()), gas: 2},
+	"CALL":                {source: pushAddress + "PUSH 0\nPUSH 100\nCALL\nRETURN", ret: NewWord(0), gas: 132},
+	"CALL short address":  {source: "PUSHB 1\nPUSH 0\nPUSH 100\nCALL", err: ErrInvalidOperand},
+	"STATICCALL":          {source: pushAddress + "PUSH 100\nSTATICCALL\nPOP\nRETURN", ret: Bytes{}, gas: 131},
+}
+
+// pushAddress pushes the address 0x0101…01, which the conformanceContext cannot call
+var pushAddress = strings.Repeat("PUSHB 1\n", 20) + "PUSH 20\nPACK\n"
+
+func TestVirtualMachine_Conformance(t *testing.T) {
+	covered := make(map[Instruction]bool)
+
+	for name, test := range conformanceTests {
+		code, err := Assemble(test.source)
+		assert.Nil(t, err, name)
+
+		operands, err := analyzeCode(code)
+		assert.Nil(t, err, name)
+
+		for i, b := range code {
+			if !operands[i] {
+				covered[Instruction(b)] = true
+			}
+		}
+
+		vm := NewVirtualMachine(code, NewState(), 1000)
+		vm.SetContext(conformanceContext)
+
+		err = vm.Run()
+		if test.err != nil {
+			assert.ErrorIs(t, err, test.err, name)
+			continue
+		}
+
+		assert.Nil(t, err, name)
+		assert.Equal(t, test.ret, vm.ReturnValue(), name)
+		assert.Equal(t, test.logs, vm.Logs(), name)
+		assert.Equal(t, test.gas, vm.GasUsed(), name)
+	}
+
+	for instruction := range instructionGas {
+		assert.True(t, covered[instruction], "%s is not covered", instruction)
+	}
+}
+
+func TestVirtualMachine_GetUnknownKey(t *testing.T) {
+	code, err := Assemble("PUSHB 'k'\nGET")
+	assert.Nil(t, err)
+
+	vm := NewVirtualMachine(code, NewState(), 1000)
+	assert.NotNil(t, vm.Run())
+}
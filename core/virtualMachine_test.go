@@ -1,6 +1,8 @@
 package core
 
 import (
+	"errors"
+	"github.com/evgeniy-dammer/blockchain/types"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -8,33 +10,223 @@ import (
 func TestStack_Pop(t *testing.T) {
 	stack := NewStack(128)
 
-	stack.Push(1)
-	stack.Push(2)
+	assert.Nil(t, stack.Push(NewWord(1)))
+	assert.Nil(t, stack.Push(NewWord(2)))
 
-	value := stack.Pop()
-
-	assert.Equal(t, value, 1)
+	value, err := stack.Pop()
+	assert.Nil(t, err)
+	assert.Equal(t, value, NewWord(2))
 
-	value = stack.Pop()
+	value, err = stack.Pop()
+	assert.Nil(t, err)
+	assert.Equal(t, value, NewWord(1))
 
-	assert.Equal(t, value, 2)
+	_, err = stack.Pop()
+	assert.ErrorIs(t, err, ErrStackUnderflow)
 }
 
 func TestStack_PushBytes(t *testing.T) {
-	s := NewStack(100)
-	s.Push(2)
-	s.Push(0x61)
-	s.Push(0x61)
+	s := NewStack(2)
+	assert.Nil(t, s.Push(Bytes{0x61}))
+	assert.Nil(t, s.Push(Bytes{0x61}))
+	assert.ErrorIs(t, s.Push(NewWord(2)), ErrStackOverflow)
+	assert.Equal(t, 2, s.Len())
+}
+
+func TestStack_DupSwap(t *testing.T) {
+	s := NewStack(3)
+	assert.ErrorIs(t, s.Dup(), ErrStackUnderflow)
+
+	assert.Nil(t, s.Push(NewWord(1)))
+	assert.ErrorIs(t, s.Swap(), ErrStackUnderflow)
+
+	assert.Nil(t, s.Push(NewWord(2)))
+	assert.Nil(t, s.Swap())
+	assert.Nil(t, s.Dup())
+	assert.ErrorIs(t, s.Dup(), ErrStackOverflow)
+
+	for _, expected := range []Word{NewWord(1), NewWord(1), NewWord(2)} {
+		value, err := s.Pop()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, value)
+	}
 }
 
 func TestVirtualMachine_Run(t *testing.T) {
-	data := []byte{0x03, 0x0a, 0x46, 0x0c, 0x4f, 0x0c, 0x4f, 0x0c, 0x0d, 0x05, 0x0a, 0x0f}
+	data := []byte{0x05, 0x0a, 0x46, 0x0c, 0x4f, 0x0c, 0x4f, 0x0c, 0x03, 0x0a, 0x0d, 0x0f}
 	contractState := NewState()
-	vm := NewVirtualMachine(data, contractState)
+	vm := NewVirtualMachine(data, contractState, 1000)
 	assert.Nil(t, vm.Run())
+	assert.Equal(t, 6*GasFastStep+3*GasPackByte+GasStore, vm.GasUsed())
 
 	valueBytes, err := contractState.Get([]byte("FOO"))
-	value := deserializeInt64(valueBytes)
 	assert.Nil(t, err)
-	assert.Equal(t, value, int64(5))
+	assert.Equal(t, NewWord(5), mustDecodeValue(t, valueBytes))
+}
+
+func TestVirtualMachine_OutOfGas(t *testing.T) {
+	data := []byte{0x05, 0x0a, 0x46, 0x0c, 0x4f, 0x0c, 0x4f, 0x0c, 0x03, 0x0a, 0x0d, 0x0f}
+	contractState := NewState()
+
+	vm := NewVirtualMachine(data, contractState, 20)
+	assert.ErrorIs(t, vm.Run(), ErrOutOfGas)
+	assert.Equal(t, uint64(20), vm.GasUsed())
+
+	_, err := contractState.Get([]byte("FOO"))
+	assert.NotNil(t, err)
+}
+
+func TestVirtualMachine_Errors(t *testing.T) {
+	tests := map[string]struct {
+		data []byte
+		err  error
+	}{
+		"invalid opcode":   {data: []byte{0x01}, err: ErrInvalidOpcode},
+		"missing operand":  {data: []byte{0x0a}, err: ErrMissingOperand},
+		"stack underflow":  {data: []byte{0x01, 0x0a, 0x0b}, err: ErrStackUnderflow},
+		"invalid operand":  {data: []byte{0x01, 0x0c, 0x02, 0x0a, 0x0b}, err: ErrInvalidOperand},
+		"division by zero": {data: []byte{0x01, 0x0a, 0x00, 0x0a, 0xfd}, err: ErrDivisionByZero},
+		"invalid pack":     {data: []byte{0x05, 0x0a, 0x0d}, err: ErrInvalidPackSize},
+		"store no key":     {data: []byte{0x01, 0x0a, 0x02, 0x0a, 0x0f}, err: ErrInvalidOperand},
+	}
+
+	for name, test := range tests {
+		vm := NewVirtualMachine(test.data, NewState(), 1000)
+		err := vm.Run()
+		assert.True(t, errors.Is(err, test.err), "%s: %v", name, err)
+	}
+}
+
+func TestVirtualMachine_StackOverflow(t *testing.T) {
+	data := []byte{}
+	for i := 0; i < 129; i++ {
+		data = append(data, 0x01, byte(InstructionPushInt))
+	}
+
+	vm := NewVirtualMachine(data, NewState(), 10000)
+	assert.ErrorIs(t, vm.Run(), ErrStackOverflow)
+}
+
+func TestVirtualMachine_Jump(t *testing.T) {
+	// jumps over the STOP at 3 to the push at 5
+	data := []byte{0x05, 0x0a, 0x56, 0x00, 0x07, 0x0a, 0xf3}
+
+	vm := NewVirtualMachine(data, NewState(), 1000)
+	assert.Nil(t, vm.Run())
+	assert.Equal(t, NewWord(7), vm.ReturnValue())
+
+	// 4 is the operand of the push at 5
+	data[0] = 0x04
+
+	vm = NewVirtualMachine(data, NewState(), 1000)
+	assert.ErrorIs(t, vm.Run(), ErrInvalidJump)
+}
+
+func TestVirtualMachine_JumpI(t *testing.T) {
+	for condition, expected := range map[byte]Value{0x00: nil, 0x01: NewWord(9)} {
+		// jumps to the push at 7 if the condition is set, otherwise stops at 5
+		data := []byte{0x07, 0x0a, condition, 0x0a, 0x57, 0x00, 0x09, 0x0a, 0xf3}
+
+		vm := NewVirtualMachine(data, NewState(), 1000)
+		assert.Nil(t, vm.Run())
+		assert.Equal(t, expected, vm.ReturnValue())
+	}
+}
+
+func TestVirtualMachine_Loop(t *testing.T) {
+	// jumps back to the push at 1 forever, so only the gas limit ends the execution
+	data := []byte{0x01, 0x0a, 0x56}
+
+	vm := NewVirtualMachine(data, NewState(), 1000)
+	assert.ErrorIs(t, vm.Run(), ErrOutOfGas)
+	assert.Equal(t, uint64(1000), vm.GasUsed())
+}
+
+func TestVirtualMachine_Comparison(t *testing.T) {
+	tests := map[Instruction][]int{
+		InstructionLt:  {2, 3, 1},
+		InstructionGt:  {2, 3, 0},
+		InstructionEq:  {3, 3, 1},
+		InstructionAnd: {6, 3, 2},
+		InstructionOr:  {6, 3, 7},
+	}
+
+	for instruction, test := range tests {
+		data := []byte{byte(test[0]), 0x0a, byte(test[1]), 0x0a, byte(instruction), 0xf3}
+
+		vm := NewVirtualMachine(data, NewState(), 1000)
+		assert.Nil(t, vm.Run())
+		assert.Equal(t, NewWord(uint64(test[2])), vm.ReturnValue(), "%#x", byte(instruction))
+	}
+
+	vm := NewVirtualMachine([]byte{0x00, 0x0a, 0x15, 0xf3}, NewState(), 1000)
+	assert.Nil(t, vm.Run())
+	assert.Equal(t, NewWord(1), vm.ReturnValue())
+}
+
+func TestVirtualMachine_StackInstructions(t *testing.T) {
+	// push 1, push 2, swap, pop drops the 1, dup and add returns 2 + 2
+	data := []byte{0x01, 0x0a, 0x02, 0x0a, 0x90, 0x50, 0x80, 0x0b, 0xf3}
+
+	vm := NewVirtualMachine(data, NewState(), 1000)
+	assert.Nil(t, vm.Run())
+	assert.Equal(t, NewWord(4), vm.ReturnValue())
+
+	vm = NewVirtualMachine([]byte{0x01, 0x0a, 0x90}, NewState(), 1000)
+	assert.ErrorIs(t, vm.Run(), ErrStackUnderflow)
+}
+
+func TestVirtualMachine_Log(t *testing.T) {
+	// logs the word 3 and the packed bytes "ab"
+	data := []byte{0x03, 0x0a, 0xa0, 0x61, 0x0c, 0x62, 0x0c, 0x02, 0x0a, 0x0d, 0xa0}
+
+	vm := NewVirtualMachine(data, NewState(), 1000)
+	assert.Nil(t, vm.Run())
+	assert.Equal(t, []*Log{{Data: NewWord(3).Bytes()}, {Data: []byte("ab")}}, vm.Logs())
+	assert.Equal(t, 5*GasFastStep+2*GasPackByte+2*GasLog+(WordSize+2)*GasLogByte, vm.GasUsed())
+
+	// the log data is paid per byte
+	vm = NewVirtualMachine(data, NewState(), 5*GasFastStep+2*GasPackByte+2*GasLog+(WordSize+1)*GasLogByte)
+	assert.ErrorIs(t, vm.Run(), ErrOutOfGas)
+}
+
+func TestVirtualMachine_Context(t *testing.T) {
+	context := &ExecutionContext{
+		Caller:      types.Address{0x01},
+		Value:       7,
+		Address:     types.Address{0x02},
+		BlockHeight: 3,
+		Timestamp:   4,
+		TxHash:      types.Hash{0x05},
+		Balance: func(address types.Address) uint64 {
+			return uint64(address[0]) * 10
+		},
+	}
+
+	tests := map[Instruction]Value{
+		InstructionCaller:      Bytes(context.Caller.ToSlice()),
+		InstructionCallValue:   NewWord(7),
+		InstructionAddress:     Bytes(context.Address.ToSlice()),
+		InstructionBlockHeight: NewWord(3),
+		InstructionTimestamp:   NewWord(4),
+		InstructionTxHash:      Bytes(context.TxHash.ToSlice()),
+	}
+
+	for instruction, expected := range tests {
+		vm := NewVirtualMachine([]byte{byte(instruction), 0xf3}, NewState(), 1000)
+		vm.SetContext(context)
+		assert.Nil(t, vm.Run())
+		assert.Equal(t, expected, vm.ReturnValue(), "%#x", byte(instruction))
+	}
+
+	// the balance of the running contract
+	vm := NewVirtualMachine([]byte{0x30, 0x31, 0xf3}, NewState(), 1000)
+	vm.SetContext(context)
+	assert.Nil(t, vm.Run())
+	assert.Equal(t, NewWord(20), vm.ReturnValue())
+
+	// without a context the environment is empty
+	vm = NewVirtualMachine([]byte{0x43, 0xf3}, NewState(), 1000)
+	assert.Nil(t, vm.Run())
+	assert.Equal(t, NewWord(0), vm.ReturnValue())
 }
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+)
+
+// WordSize is the number of bytes of an encoded Word
+const WordSize = 32
+
+// Word is an unsigned 256-bit integer, the number type of the VirtualMachine. The arithmetic wraps around
+// modulo 2^256, so its results do not depend on the platform. The limbs are stored least significant first.
+type Word [4]uint64
+
+// NewWord returns the Word of the given value
+func NewWord(value uint64) Word {
+	return Word{value}
+}
+
+// WordFromBytes returns the Word of a big endian number. Only the last WordSize bytes are used.
+func WordFromBytes(b []byte) Word {
+	if len(b) > WordSize {
+		b = b[len(b)-WordSize:]
+	}
+
+	buf := make([]byte, WordSize)
+	copy(buf[WordSize-len(b):], b)
+
+	var w Word
+	for i := range w {
+		w[i] = binary.BigEndian.Uint64(buf[WordSize-8*(i+1):])
+	}
+
+	return w
+}
+
+// Bytes returns the word as WordSize big endian bytes
+func (w Word) Bytes() []byte {
+	buf := make([]byte, WordSize)
+	for i, limb := range w {
+		binary.BigEndian.PutUint64(buf[WordSize-8*(i+1):], limb)
+	}
+
+	return buf
+}
+
+// IsZero checks if the word is zero
+func (w Word) IsZero() bool {
+	return w == Word{}
+}
+
+// IsUint64 checks if the word fits into an uint64
+func (w Word) IsUint64() bool {
+	return w[1] == 0 && w[2] == 0 && w[3] == 0
+}
+
+// Uint64 returns the lowest 64 bits of the word
+func (w Word) Uint64() uint64 {
+	return w[0]
+}
+
+// Cmp compares the words and returns -1 if w < x, 0 if w == x and 1 if w > x
+func (w Word) Cmp(x Word) int {
+	for i := len(w) - 1; i >= 0; i-- {
+		if w[i] < x[i] {
+			return -1
+		}
+
+		if w[i] > x[i] {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// Add returns w + x modulo 2^256
+func (w Word) Add(x Word) Word {
+	var (
+		z     Word
+		carry uint64
+	)
+
+	for i := range z {
+		z[i], carry = bits.Add64(w[i], x[i], carry)
+	}
+
+	return z
+}
+
+// Sub returns w - x modulo 2^256
+func (w Word) Sub(x Word) Word {
+	var (
+		z      Word
+		borrow uint64
+	)
+
+	for i := range z {
+		z[i], borrow = bits.Sub64(w[i], x[i], borrow)
+	}
+
+	return z
+}
+
+// Mul returns w * x modulo 2^256
+func (w Word) Mul(x Word) Word {
+	var z Word
+
+	for i := range w {
+		carry := uint64(0)
+
+		// limbs beyond the fourth are dropped, that is the wrap around
+		for j := 0; i+j < len(z); j++ {
+			hi, lo := bits.Mul64(w[i], x[j])
+
+			var c uint64
+			lo, c = bits.Add64(lo, z[i+j], 0)
+			hi += c
+			lo, c = bits.Add64(lo, carry, 0)
+			hi += c
+
+			z[i+j] = lo
+			carry = hi
+		}
+	}
+
+	return z
+}
+
+// Div returns w / x rounded down, or zero if x is zero
+func (w Word) Div(x Word) Word {
+	if x.IsZero() {
+		return Word{}
+	}
+
+	if w.IsUint64() && x.IsUint64() {
+		return NewWord(w[0] / x[0])
+	}
+
+	quotient := new(big.Int).Quo(w.big(), x.big())
+
+	return WordFromBytes(quotient.Bytes())
+}
+
+// And returns the bitwise and of the words
+func (w Word) And(x Word) Word {
+	return Word{w[0] & x[0], w[1] & x[1], w[2] & x[2], w[3] & x[3]}
+}
+
+// Or returns the bitwise or of the words
+func (w Word) Or(x Word) Word {
+	return Word{w[0] | x[0], w[1] | x[1], w[2] | x[2], w[3] | x[3]}
+}
+
+// String returns the decimal representation of the word
+func (w Word) String() string {
+	return w.big().String()
+}
+
+func (w Word) big() *big.Int {
+	return new(big.Int).SetBytes(w.Bytes())
+}
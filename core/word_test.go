@@ -0,0 +1,55 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+)
+
+// maxWord is 2^256 - 1
+var maxWord = Word{^uint64(0), ^uint64(0), ^uint64(0), ^uint64(0)}
+
+func TestWord_Bytes(t *testing.T) {
+	w := Word{1, 2, 3, 4}
+
+	assert.Len(t, w.Bytes(), WordSize)
+	assert.Equal(t, w, WordFromBytes(w.Bytes()))
+	assert.Equal(t, NewWord(0x0102), WordFromBytes([]byte{0x01, 0x02}))
+	assert.Equal(t, "18446744073709551616", Word{0, 1}.String())
+}
+
+func TestWord_WrappingArithmetic(t *testing.T) {
+	assert.Equal(t, Word{}, maxWord.Add(NewWord(1)))
+	assert.Equal(t, maxWord, Word{}.Sub(NewWord(1)))
+	assert.Equal(t, Word{0, 1}, Word{^uint64(0)}.Add(NewWord(1)))
+	assert.Equal(t, maxWord.Sub(NewWord(1)), maxWord.Mul(NewWord(2)))
+	assert.Equal(t, NewWord(1), maxWord.Mul(maxWord))
+}
+
+func TestWord_MulDivMatchBigInt(t *testing.T) {
+	modulus := new(big.Int).Lsh(big.NewInt(1), 256)
+
+	words := []Word{
+		NewWord(7),
+		{^uint64(0), 5},
+		{1, 2, 3, 4},
+		{0, 0, 0, 1 << 63},
+		maxWord,
+	}
+
+	for _, a := range words {
+		for _, b := range words {
+			product := new(big.Int).Mul(a.big(), b.big())
+			assert.Equal(t, new(big.Int).Mod(product, modulus).String(), a.Mul(b).String(), "%s * %s", a, b)
+			assert.Equal(t, new(big.Int).Quo(a.big(), b.big()).String(), a.Div(b).String(), "%s / %s", a, b)
+		}
+	}
+
+	assert.Equal(t, Word{}, NewWord(7).Div(Word{}))
+}
+
+func TestWord_Cmp(t *testing.T) {
+	assert.Equal(t, -1, NewWord(1).Cmp(Word{0, 1}))
+	assert.Equal(t, 1, Word{0, 0, 1}.Cmp(Word{^uint64(0), ^uint64(0)}))
+	assert.Equal(t, 0, maxWord.Cmp(maxWord))
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/evgeniy-dammer/blockchain/types"
+)
+
+// Prefixes which separate the different kinds of state inside the state trie
+const (
+	stateKeyAccount    byte = 'a'
+	stateKeyContract   byte = 's'
+	stateKeyCollection byte = 'c'
+	stateKeyMint       byte = 'm'
+)
+
+// worldState groups all the state which is changed by executing transactions
+type worldState struct {
+	accountState    *AccountState
+	contractState   *State
+	collectionState *overlayMap[types.Hash, *CollectionTx]
+	mintState       *overlayMap[types.Hash, *MintTx]
+	trie            *Trie       // the state trie of the blockchain state, overlays have none
+	parent          *worldState // If set the state is an overlay on top of the parent state
+}
+
+// overlay returns a copy-on-write view of the state. Changes made through the view
+// are applied to the state only when commit is called, otherwise they are simply dropped.
+func (ws *worldState) overlay() *worldState {
+	return &worldState{
+		accountState:    ws.accountState.overlay(),
+		contractState:   ws.contractState.overlay(),
+		collectionState: ws.collectionState.overlay(),
+		mintState:       ws.mintState.overlay(),
+		parent:          ws,
+	}
+}
+
+// commit applies the changes of the overlay to the state it was created from. If that state keeps
+// the state trie, the changed keys are written into the trie as well.
+func (ws *worldState) commit() {
+	if trie := ws.parent.trie; trie != nil {
+		ws.updateTrie(trie)
+
+		// The trie is shared by all readers of the state, hashing it here keeps them from
+		// caching the hashes of its nodes concurrently.
+		trie.Hash()
+	}
+
+	ws.accountState.commit()
+	ws.contractState.commit()
+	ws.collectionState.commit()
+	ws.mintState.commit()
+}
+
+// stateUndo keeps the values a block overwrote. Reverting it on top of the state after the block
+// brings back the state as it was before the block was executed.
+type stateUndo struct {
+	accounts    map[types.Address]undoEntry[Account]
+	contract    map[string]undoEntry[[]byte]
+	collections map[types.Hash]undoEntry[*CollectionTx]
+	mints       map[types.Hash]undoEntry[*MintTx]
+}
+
+// undo returns the values of the parent state which are overwritten when the overlay is committed
+func (ws *worldState) undo() *stateUndo {
+	return &stateUndo{
+		accounts:    ws.accountState.undo(),
+		contract:    ws.contractState.undo(),
+		collections: ws.collectionState.undo(),
+		mints:       ws.mintState.undo(),
+	}
+}
+
+// revert restores the values kept in the undo
+func (ws *worldState) revert(undo *stateUndo) {
+	ws.accountState.revert(undo.accounts)
+	ws.contractState.revert(undo.contract)
+	ws.collectionState.revert(undo.collections)
+	ws.mintState.revert(undo.mints)
+}
+
+// buildTrie builds the state trie which holds accounts, contract storage and NFT state under separate key prefixes
+func (ws *worldState) buildTrie() *Trie {
+	trie := NewTrie()
+
+	for address, account := range ws.accountState.all() {
+		trie.Put(stateKey(stateKeyAccount, address.ToSlice()), encodeAccount(account))
+	}
+
+	for key, value := range ws.contractState.all() {
+		trie.Put(stateKey(stateKeyContract, []byte(key)), value)
+	}
+
+	for hash, collection := range ws.collectionState.all() {
+		trie.Put(stateKey(stateKeyCollection, hash.ToSlice()), encodeCollection(collection))
+	}
+
+	for hash, mint := range ws.mintState.all() {
+		trie.Put(stateKey(stateKeyMint, hash.ToSlice()), encodeMint(mint))
+	}
+
+	trie.Hash()
+
+	return trie
+}
+
+// currentTrie returns the state trie with the changes of the overlay applied. The trie of the parent state
+// is copied and only the keys changed in the overlays are written into the copy.
+func (ws *worldState) currentTrie() *Trie {
+	if ws.parent == nil {
+		return ws.trie
+	}
+
+	trie := ws.parent.currentTrie().Copy()
+	ws.updateTrie(trie)
+
+	return trie
+}
+
+// updateTrie writes the keys changed in the state, but not in its parent states, into the trie
+func (ws *worldState) updateTrie(trie *Trie) {
+	ws.accountState.mu.RLock()
+	for address := range ws.accountState.deleted {
+		trie.Delete(stateKey(stateKeyAccount, address.ToSlice()))
+	}
+
+	for address, account := range ws.accountState.accounts {
+		trie.Put(stateKey(stateKeyAccount, address.ToSlice()), encodeAccount(account))
+	}
+	ws.accountState.mu.RUnlock()
+
+	for key := range ws.contractState.deleted {
+		trie.Delete(stateKey(stateKeyContract, []byte(key)))
+	}
+
+	for key, value := range ws.contractState.data {
+		trie.Put(stateKey(stateKeyContract, []byte(key)), value)
+	}
+
+	for hash := range ws.collectionState.deleted {
+		trie.Delete(stateKey(stateKeyCollection, hash.ToSlice()))
+	}
+
+	for hash, collection := range ws.collectionState.data {
+		trie.Put(stateKey(stateKeyCollection, hash.ToSlice()), encodeCollection(collection))
+	}
+
+	for hash := range ws.mintState.deleted {
+		trie.Delete(stateKey(stateKeyMint, hash.ToSlice()))
+	}
+
+	for hash, mint := range ws.mintState.data {
+		trie.Put(stateKey(stateKeyMint, hash.ToSlice()), encodeMint(mint))
+	}
+}
+
+// root returns the root hash of the state trie
+func (ws *worldState) root() types.Hash {
+	return ws.currentTrie().Hash()
+}
+
+func stateKey(prefix byte, key []byte) []byte {
+	return append([]byte{prefix}, key...)
+}
+
+func encodeAccount(account *Account) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, account.Balance)
+	binary.Write(buf, binary.BigEndian, account.Nonce)
+
+	return buf.Bytes()
+}
+
+func encodeCollection(collection *CollectionTx) []byte {
+	buf := &bytes.Buffer{}
+	writeCollection(buf, collection)
+
+	return buf.Bytes()
+}
+
+func encodeMint(mint *MintTx) []byte {
+	buf := &bytes.Buffer{}
+	writeMint(buf, mint)
+
+	return buf.Bytes()
+}
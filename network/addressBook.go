@@ -0,0 +1,268 @@
+package network
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	minAddressScore       = -3 // an address with a lower score is dropped from the book
+	maxAddressScore       = 10
+	maxAddressesPerSource = 32 // the most addresses of the book shared by the same source
+)
+
+// AddressInfo is what the AddressBook knows about the address of a node
+type AddressInfo struct {
+	Address     string
+	Source      string    // the host of the peer which shared the address, empty if the node learned it itself
+	Score       int       // grows with every successful connection and shrinks with every failed one
+	LastSeen    time.Time // the last time a connection succeeded or a peer shared the address
+	LastAttempt time.Time // the last time the node dialled the address
+}
+
+// AddressBook keeps the addresses of the nodes the node knows about, learned from the seed nodes
+// and shared by its peers
+type AddressBook struct {
+	lock      sync.RWMutex
+	addresses map[string]*AddressInfo
+	sources   map[string]int // the number of addresses shared by every source
+	maxSize   int
+}
+
+// NewAddressBook is a constructor for the AddressBook
+func NewAddressBook(maxSize int) *AddressBook {
+	return &AddressBook{
+		addresses: make(map[string]*AddressInfo),
+		sources:   make(map[string]int),
+		maxSize:   maxSize,
+	}
+}
+
+// Add adds the address if it is valid and not known yet and returns true if it was added.
+// A full book drops its worst address for it, unless the worst address is better than a new one.
+func (b *AddressBook) Add(address string) bool {
+	return b.AddFrom(address, "")
+}
+
+// AddFrom adds the address shared by the source like Add. A source which shared maxAddressesPerSource
+// addresses of the book already cannot add more, so a single peer cannot fill the book.
+func (b *AddressBook) AddFrom(address, source string) bool {
+	if !validAddress(address) {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.addresses[address]; ok {
+		return false
+	}
+
+	if source != "" && b.sources[source] >= maxAddressesPerSource {
+		return false
+	}
+
+	if len(b.addresses) >= b.maxSize {
+		worst := b.worst()
+		if worst == nil || worst.Score > 0 {
+			return false
+		}
+
+		b.remove(worst)
+	}
+
+	b.addresses[address] = &AddressInfo{Address: address, Source: source, LastSeen: time.Now()}
+	if source != "" {
+		b.sources[source]++
+	}
+
+	return true
+}
+
+// MarkGood raises the score of an address the node connected to, the address is added if it is not known
+func (b *AddressBook) MarkGood(address string) {
+	b.Add(address)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	info, ok := b.addresses[address]
+	if !ok {
+		return
+	}
+
+	info.LastSeen = time.Now()
+	if info.Score < maxAddressScore {
+		info.Score++
+	}
+}
+
+// MarkFailed lowers the score of an address the node failed to connect to and drops it if the score gets too low
+func (b *AddressBook) MarkFailed(address string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	info, ok := b.addresses[address]
+	if !ok {
+		return
+	}
+
+	info.Score--
+	if info.Score < minAddressScore {
+		b.remove(info)
+	}
+}
+
+// Get returns what the book knows about the address
+func (b *AddressBook) Get(address string) (AddressInfo, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	info, ok := b.addresses[address]
+	if !ok {
+		return AddressInfo{}, false
+	}
+
+	return *info, true
+}
+
+// Len returns the number of known addresses
+func (b *AddressBook) Len() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return len(b.addresses)
+}
+
+// Best returns at most n addresses, the best score and then the most recently seen first
+func (b *AddressBook) Best(n int) []string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	return addressesOf(b.sorted(), n)
+}
+
+// Candidates returns at most n addresses to dial, the best first. It skips the addresses which were dialled
+// less than retryAfter ago and the ones skip returns true for. The returned addresses count as dialled.
+func (b *AddressBook) Candidates(n int, retryAfter time.Duration, skip func(address string) bool) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	candidates := []*AddressInfo{}
+
+	for _, info := range b.sorted() {
+		if len(candidates) == n {
+			break
+		}
+
+		if now.Sub(info.LastAttempt) < retryAfter || (skip != nil && skip(info.Address)) {
+			continue
+		}
+
+		info.LastAttempt = now
+		candidates = append(candidates, info)
+	}
+
+	return addressesOf(candidates, n)
+}
+
+// sorted returns the addresses, the best score and then the most recently seen first.
+// Must be called with the lock held.
+func (b *AddressBook) sorted() []*AddressInfo {
+	infos := make([]*AddressInfo, 0, len(b.addresses))
+	for _, info := range b.addresses {
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Score != infos[j].Score {
+			return infos[i].Score > infos[j].Score
+		}
+
+		if !infos[i].LastSeen.Equal(infos[j].LastSeen) {
+			return infos[i].LastSeen.After(infos[j].LastSeen)
+		}
+
+		return infos[i].Address < infos[j].Address
+	})
+
+	return infos
+}
+
+// worst returns the address with the lowest score. Must be called with the lock held.
+func (b *AddressBook) worst() *AddressInfo {
+	infos := b.sorted()
+	if len(infos) == 0 {
+		return nil
+	}
+
+	return infos[len(infos)-1]
+}
+
+// remove drops the address from the book. Must be called with the lock held.
+func (b *AddressBook) remove(info *AddressInfo) {
+	delete(b.addresses, info.Address)
+
+	if info.Source == "" {
+		return
+	}
+
+	if b.sources[info.Source]--; b.sources[info.Source] == 0 {
+		delete(b.sources, info.Source)
+	}
+}
+
+// addressesOf returns the first n addresses of the infos
+func addressesOf(infos []*AddressInfo, n int) []string {
+	if len(infos) > n {
+		infos = infos[:n]
+	}
+
+	addresses := make([]string, len(infos))
+	for i, info := range infos {
+		addresses[i] = info.Address
+	}
+
+	return addresses
+}
+
+// validAddress checks if the address is a host and a port a node can be dialled at
+func validAddress(address string) bool {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+
+	number, err := strconv.Atoi(port)
+
+	return err == nil && number > 0 && number <= 65535
+}
+
+// peerAddress returns the address the peer accepts connections at. Only the port is taken from the listen address
+// the peer announced, the host is the one the peer connected from, so a peer cannot make the node dial another host.
+func peerAddress(remote net.Addr, listenAddr string) (string, bool) {
+	_, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", false
+	}
+
+	host, err := remoteHost(remote)
+	if err != nil {
+		return "", false
+	}
+
+	address := net.JoinHostPort(host, port)
+
+	return address, validAddress(address)
+}
+
+// remoteHost returns the host the remote end of a connection connected from
+func remoteHost(remote net.Addr) (string, error) {
+	host, _, err := net.SplitHostPort(remote.String())
+
+	return host, err
+}
@@ -0,0 +1,150 @@
+package network
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddressBook_Add(t *testing.T) {
+	book := NewAddressBook(2)
+
+	assert.True(t, book.Add("127.0.0.1:3000"))
+	assert.False(t, book.Add("127.0.0.1:3000"))
+	assert.True(t, book.Add(":4000"))
+
+	for _, invalid := range []string{"", "127.0.0.1", "127.0.0.1:0", "127.0.0.1:70000", "127.0.0.1:port"} {
+		assert.False(t, book.Add(invalid), invalid)
+	}
+
+	// a full book drops an address without a score for a new one, but keeps good addresses
+	assert.True(t, book.Add(":5000"))
+	assert.Equal(t, 2, book.Len())
+
+	book.MarkGood(":5000")
+	book.MarkGood("127.0.0.1:3000")
+	assert.False(t, book.Add(":6000"))
+}
+
+func TestAddressBook_AddFrom(t *testing.T) {
+	book := NewAddressBook(100)
+
+	for i := 0; i < maxAddressesPerSource; i++ {
+		assert.True(t, book.AddFrom(fmt.Sprintf("10.0.1.%d:3000", i), "10.0.0.1"))
+	}
+
+	// the source cannot add more, other sources and the node itself can
+	assert.False(t, book.AddFrom("10.0.2.1:3000", "10.0.0.1"))
+	assert.True(t, book.AddFrom("10.0.2.1:3000", "10.0.0.2"))
+	assert.True(t, book.Add("10.0.2.2:3000"))
+
+	// a dropped address makes room for another one of its source
+	for i := 0; i < 4; i++ {
+		book.MarkFailed("10.0.1.0:3000")
+	}
+
+	_, ok := book.Get("10.0.1.0:3000")
+	assert.False(t, ok)
+	assert.True(t, book.AddFrom("10.0.2.3:3000", "10.0.0.1"))
+}
+
+func TestAddressBook_Scores(t *testing.T) {
+	book := NewAddressBook(10)
+	book.Add(":3000")
+	book.Add(":4000")
+	book.MarkGood(":5000")
+
+	book.MarkGood(":4000")
+	book.MarkGood(":4000")
+	book.MarkFailed(":3000")
+
+	assert.Equal(t, []string{":4000", ":5000", ":3000"}, book.Best(10))
+	assert.Equal(t, []string{":4000"}, book.Best(1))
+
+	info, ok := book.Get(":4000")
+	assert.True(t, ok)
+	assert.Equal(t, 2, info.Score)
+	assert.WithinDuration(t, time.Now(), info.LastSeen, time.Second)
+
+	// an address which keeps failing is dropped
+	for i := 0; i < 3; i++ {
+		book.MarkFailed(":3000")
+	}
+
+	_, ok = book.Get(":3000")
+	assert.False(t, ok)
+}
+
+func TestAddressBook_Candidates(t *testing.T) {
+	book := NewAddressBook(10)
+	for i := 0; i < 5; i++ {
+		book.Add(fmt.Sprintf(":%d", 3000+i))
+	}
+
+	book.MarkGood(":3004")
+
+	connected := func(address string) bool { return address == ":3000" }
+
+	candidates := book.Candidates(2, time.Minute, connected)
+	assert.Equal(t, 2, len(candidates))
+	assert.Equal(t, ":3004", candidates[0])
+	assert.NotContains(t, candidates, ":3000")
+
+	// the dialled addresses are not retried right away
+	rest := book.Candidates(10, time.Minute, connected)
+	assert.Equal(t, 2, len(rest))
+	assert.NotContains(t, rest, candidates[0])
+	assert.NotContains(t, rest, candidates[1])
+
+	assert.Empty(t, book.Candidates(10, time.Minute, connected))
+	assert.Equal(t, 4, len(book.Candidates(10, 0, connected)))
+}
+
+func TestPeerAddress(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51234}
+
+	// the peer cannot make the node dial another host
+	tests := map[string]string{
+		":3000":            "10.0.0.1:3000",
+		"0.0.0.0:3000":     "10.0.0.1:3000",
+		"192.168.1.1:3000": "10.0.0.1:3000",
+	}
+
+	for listenAddr, expected := range tests {
+		address, ok := peerAddress(remote, listenAddr)
+		assert.True(t, ok, listenAddr)
+		assert.Equal(t, expected, address, listenAddr)
+	}
+
+	_, ok := peerAddress(remote, "")
+	assert.False(t, ok)
+}
+
+func TestServer_ProcessPeersMessage(t *testing.T) {
+	server, err := NewServer(ServerOptions{ID: "TEST"})
+	assert.Nil(t, err)
+
+	from := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51234}
+
+	assert.Nil(t, server.ProcessMessage(&DecodedMessage{
+		From: from,
+		Data: &PeersMessage{Addresses: []string{"10.0.0.2:3000", "invalid", "10.0.0.3:3000"}},
+	}))
+	assert.Equal(t, 2, server.addressBook.Len())
+
+	tooMany := make([]string, maxPeersPerMessage+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("10.0.1.%d:3000", i)
+	}
+
+	assert.NotNil(t, server.ProcessMessage(&DecodedMessage{From: from, Data: &PeersMessage{Addresses: tooMany}}))
+	assert.Equal(t, 2, server.addressBook.Len())
+
+	// the peer cannot fill the book, not even from another port
+	from = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51235}
+
+	assert.Nil(t, server.ProcessMessage(&DecodedMessage{From: from, Data: &PeersMessage{Addresses: tooMany[:maxPeersPerMessage]}}))
+	assert.Equal(t, maxAddressesPerSource, server.addressBook.Len())
+}
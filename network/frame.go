@@ -0,0 +1,100 @@
+package network
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A frame carries one Message over a stream:
+//
+//	frame = magic u32 | version u8 | type u8 | length u32 | checksum u32 | data
+//
+// The checksum is the first 4 bytes of the sha256 hash of the data. Integers are big endian.
+const (
+	frameMagic      uint32 = 0x424c4b43 // "BLKC"
+	frameVersion    byte   = 0x01
+	frameHeaderSize        = 4 + 1 + 1 + 4 + 4
+
+	// MaxFrameSize is the largest data a single frame may carry
+	MaxFrameSize = 32 << 20
+)
+
+var (
+	ErrInvalidFrame  = errors.New("invalid frame")
+	ErrFrameTooLarge = errors.New("frame too large")
+)
+
+// encodeFrame returns the frame which carries the message
+func encodeFrame(m *Message) ([]byte, error) {
+	if len(m.Data) > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes of data, at most %d are allowed", ErrFrameTooLarge, len(m.Data), MaxFrameSize)
+	}
+
+	buf := make([]byte, frameHeaderSize, frameHeaderSize+len(m.Data))
+	binary.BigEndian.PutUint32(buf[0:], frameMagic)
+	buf[4] = frameVersion
+	buf[5] = byte(m.Type)
+	binary.BigEndian.PutUint32(buf[6:], uint32(len(m.Data)))
+	binary.BigEndian.PutUint32(buf[10:], frameChecksum(m.Data))
+
+	return append(buf, m.Data...), nil
+}
+
+// frameChecksum returns the checksum of the frame data
+func frameChecksum(data []byte) uint32 {
+	hash := sha256.Sum256(data)
+
+	return binary.BigEndian.Uint32(hash[:4])
+}
+
+// FrameReader reads the messages of a stream frame by frame, no matter how the stream splits
+// or merges the frames.
+type FrameReader struct {
+	r *bufio.Reader
+}
+
+// NewFrameReader is a constructor for the FrameReader
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r)}
+}
+
+// ReadMessage reads the next frame and returns its message. It returns io.EOF only if the stream ended
+// between two frames, a stream which ends inside a frame returns io.ErrUnexpectedEOF.
+func (fr *FrameReader) ReadMessage() (*Message, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(fr.r, header); err != nil {
+		return nil, err
+	}
+
+	if magic := binary.BigEndian.Uint32(header[0:]); magic != frameMagic {
+		return nil, fmt.Errorf("%w: magic %#x", ErrInvalidFrame, magic)
+	}
+
+	if header[4] != frameVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidFrame, header[4])
+	}
+
+	length := binary.BigEndian.Uint32(header[6:])
+	if length > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes of data, at most %d are allowed", ErrFrameTooLarge, length, MaxFrameSize)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(fr.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	if checksum := binary.BigEndian.Uint32(header[10:]); checksum != frameChecksum(data) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidFrame)
+	}
+
+	return &Message{Type: MessageType(header[5]), Data: data}, nil
+}
@@ -0,0 +1,113 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+// mustFrame returns the frame which carries the message
+func mustFrame(t *testing.T, message *Message) []byte {
+	frame, err := message.Bytes()
+	assert.Nil(t, err)
+
+	return frame
+}
+
+func TestFrame_RoundTrip(t *testing.T) {
+	first := NewMessage(MessageTypeBlock, bytes.Repeat([]byte{0xab}, 10_000))
+	second := NewMessage(MessageTypeGetStatus, nil)
+
+	// both frames in one stream which returns a single byte per read
+	stream := append(mustFrame(t, first), mustFrame(t, second)...)
+	reader := NewFrameReader(iotest.OneByteReader(bytes.NewReader(stream)))
+
+	message, err := reader.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, first, message)
+
+	message, err = reader.ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, MessageTypeGetStatus, message.Type)
+	assert.Empty(t, message.Data)
+
+	_, err = reader.ReadMessage()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFrame_Invalid(t *testing.T) {
+	frame := mustFrame(t, NewMessage(MessageTypeTransaction, []byte("tx")))
+
+	corrupt := func(change func(b []byte)) []byte {
+		b := append([]byte{}, frame...)
+		change(b)
+
+		return b
+	}
+
+	tests := map[string]struct {
+		frame []byte
+		err   error
+	}{
+		"magic":     {corrupt(func(b []byte) { b[0] = 0 }), ErrInvalidFrame},
+		"version":   {corrupt(func(b []byte) { b[4] = 0xff }), ErrInvalidFrame},
+		"checksum":  {corrupt(func(b []byte) { b[len(b)-1] ^= 0x01 }), ErrInvalidFrame},
+		"too large": {corrupt(func(b []byte) { binary.BigEndian.PutUint32(b[6:], MaxFrameSize+1) }), ErrFrameTooLarge},
+		"truncated": {frame[:len(frame)-1], io.ErrUnexpectedEOF},
+		"header":    {frame[:5], io.ErrUnexpectedEOF},
+	}
+
+	for name, test := range tests {
+		_, err := NewFrameReader(bytes.NewReader(test.frame)).ReadMessage()
+		assert.ErrorIs(t, err, test.err, name)
+	}
+
+	_, err := NewMessage(MessageTypeBlocks, make([]byte, MaxFrameSize+1)).Bytes()
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+}
+
+func TestTCPPeer_ReadLoop(t *testing.T) {
+	local, remote := net.Pipe()
+	peer := newTCPPeer(local, false)
+
+	rpcCh := make(chan RPC)
+	errCh := make(chan error)
+
+	go func() {
+		errCh <- peer.readLoop(rpcCh)
+	}()
+
+	// larger than the buffers of the connection, so it arrives in several reads
+	message := NewMessage(MessageTypeBlocks, bytes.Repeat([]byte{0x01}, 100_000))
+	go remote.Write(mustFrame(t, message))
+
+	rpc := <-rpcCh
+	decoded, err := NewFrameReader(rpc.Payload).ReadMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, message, decoded)
+
+	// the loop ends once the peer is gone and closes the connection
+	assert.Nil(t, remote.Close())
+	assert.Nil(t, <-errCh)
+	assert.NotNil(t, peer.SendMessage(message))
+}
+
+func TestTCPPeer_ReadLoopInvalidFrame(t *testing.T) {
+	local, remote := net.Pipe()
+	peer := newTCPPeer(local, false)
+
+	errCh := make(chan error)
+
+	go func() {
+		errCh <- peer.readLoop(make(chan RPC))
+	}()
+
+	go remote.Write([]byte("not a frame at all"))
+
+	assert.ErrorIs(t, <-errCh, ErrInvalidFrame)
+	assert.NotNil(t, peer.SendMessage(NewMessage(MessageTypeGetStatus, nil)))
+}
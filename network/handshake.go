@@ -0,0 +1,248 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/crypto"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"time"
+)
+
+// ProtocolVersion is the version of the peer protocol the node speaks, peers have to speak the same version
+const ProtocolVersion uint32 = 1
+
+const (
+	handshakeTimeout   = 10 * time.Second
+	handshakeNonceSize = 32
+)
+
+var ErrHandshakeFailed = errors.New("handshake failed")
+
+// HandshakeMessage is the first message both peers send on a new connection
+type HandshakeMessage struct {
+	Version     uint32
+	GenesisHash types.Hash
+	ID          string           // the id of the server
+	ListenAddr  string           // the address the node accepts connections at, its host may be empty
+	PublicKey   crypto.PublicKey // the node key
+	Nonce       []byte           // the other peer has to sign it
+	SessionKey  []byte           // the ephemeral X25519 key of an encrypted session, empty if the node does not encrypt
+}
+
+// localHandshake is the handshake of the node together with the private keys behind it
+type localHandshake struct {
+	message    *HandshakeMessage
+	nodeKey    crypto.PrivateKey
+	sessionKey *ecdh.PrivateKey // set if the node encrypts its traffic
+}
+
+// HandshakeAuthMessage is the second message of the handshake, it proves that the peer owns the node key
+// of its HandshakeMessage
+type HandshakeAuthMessage struct {
+	Signature *crypto.Signature
+}
+
+// digest returns the hash the sender of the handshake signs to answer the nonce of the other peer.
+// It covers the whole handshake, so none of its fields can be changed on the way.
+func (h *HandshakeMessage) digest(nonce []byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(nonce)
+	binary.Write(buf, binary.BigEndian, h.Version)
+	buf.Write(h.GenesisHash.ToSlice())
+	binary.Write(buf, binary.BigEndian, uint32(len(h.ID)))
+	buf.WriteString(h.ID)
+	binary.Write(buf, binary.BigEndian, uint32(len(h.ListenAddr)))
+	buf.WriteString(h.ListenAddr)
+	buf.Write(h.PublicKey)
+	buf.Write(h.SessionKey)
+
+	hash := sha256.Sum256(buf.Bytes())
+
+	return hash[:]
+}
+
+// newLocalHandshake returns the handshake of the node with a fresh nonce. If encrypt is set,
+// it also creates a fresh session key.
+func newLocalHandshake(id, listenAddr string, genesisHash types.Hash, nodeKey crypto.PrivateKey, encrypt bool) (*localHandshake, error) {
+	nonce := make([]byte, handshakeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	local := &localHandshake{
+		message: &HandshakeMessage{
+			Version:     ProtocolVersion,
+			GenesisHash: genesisHash,
+			ID:          id,
+			ListenAddr:  listenAddr,
+			PublicKey:   nodeKey.PublicKey(),
+			Nonce:       nonce,
+		},
+		nodeKey: nodeKey,
+	}
+
+	if encrypt {
+		sessionKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		local.sessionKey = sessionKey
+		local.message.SessionKey = sessionKey.PublicKey().Bytes()
+	}
+
+	return local, nil
+}
+
+// handshake exchanges the handshake with the peer and sets the ID and the PublicKey of the peer, and its
+// Address if it is not known yet. It fails
+// if the peer speaks another protocol version, follows another genesis block, cannot prove that it owns
+// its node key, is the node itself or does not agree on encrypting the traffic. If both peers encrypt,
+// every following frame is sealed with the keys derived from their session keys.
+func (p *TCPPeer) handshake(local *localHandshake) error {
+	if err := p.conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+
+	if err := p.sendGob(MessageTypeHandshake, local.message); err != nil {
+		return err
+	}
+
+	remote := new(HandshakeMessage)
+	if err := p.readGob(MessageTypeHandshake, remote); err != nil {
+		return err
+	}
+
+	if err := checkHandshake(local.message, remote); err != nil {
+		return err
+	}
+
+	signature, err := local.nodeKey.Sign(local.message.digest(remote.Nonce))
+	if err != nil {
+		return err
+	}
+
+	if err := p.sendGob(MessageTypeHandshakeAuth, &HandshakeAuthMessage{Signature: signature}); err != nil {
+		return err
+	}
+
+	auth := new(HandshakeAuthMessage)
+	if err := p.readGob(MessageTypeHandshakeAuth, auth); err != nil {
+		return err
+	}
+
+	if auth.Signature == nil || auth.Signature.R == nil || auth.Signature.S == nil ||
+		!auth.Signature.Verify(remote.PublicKey, remote.digest(local.message.Nonce)) {
+		return fmt.Errorf("%w: invalid signature of %s", ErrHandshakeFailed, remote.PublicKey)
+	}
+
+	if local.sessionKey != nil {
+		if p.session, err = p.newSession(local, remote); err != nil {
+			return err
+		}
+	}
+
+	p.ID = remote.ID
+	p.PublicKey = remote.PublicKey
+
+	if p.Address == "" {
+		p.Address, _ = peerAddress(p.conn.RemoteAddr(), remote.ListenAddr)
+	}
+
+	return p.conn.SetDeadline(time.Time{})
+}
+
+// newSession creates the session of the peer from the session keys of the handshakes. The session keys
+// are covered by the signatures of the handshake, so only the owners of both node keys know the secret.
+func (p *TCPPeer) newSession(local *localHandshake, remote *HandshakeMessage) (*session, error) {
+	remoteKey, err := ecdh.X25519().NewPublicKey(remote.SessionKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid session key: %s", ErrHandshakeFailed, err)
+	}
+
+	secret, err := local.sessionKey.ECDH(remoteKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrHandshakeFailed, err)
+	}
+
+	initiator, responder := local.message, remote
+	if !p.Outgoing {
+		initiator, responder = remote, local.message
+	}
+
+	transcript := sha256.New()
+	transcript.Write(initiator.Nonce)
+	transcript.Write(responder.Nonce)
+	transcript.Write(initiator.SessionKey)
+	transcript.Write(responder.SessionKey)
+
+	return newSession(secret, transcript.Sum(nil), p.Outgoing)
+}
+
+// checkHandshake checks if the node is able to talk to the peer which sent the remote handshake
+func checkHandshake(local, remote *HandshakeMessage) error {
+	if remote.Version != local.Version {
+		return fmt.Errorf("%w: peer speaks protocol version %d, not %d", ErrHandshakeFailed, remote.Version, local.Version)
+	}
+
+	if remote.GenesisHash != local.GenesisHash {
+		return fmt.Errorf("%w: peer follows genesis block %s, not %s", ErrHandshakeFailed, remote.GenesisHash, local.GenesisHash)
+	}
+
+	if len(remote.Nonce) != handshakeNonceSize {
+		return fmt.Errorf("%w: nonce of %d bytes", ErrHandshakeFailed, len(remote.Nonce))
+	}
+
+	if x, _ := elliptic.UnmarshalCompressed(elliptic.P256(), remote.PublicKey); x == nil {
+		return fmt.Errorf("%w: invalid node key", ErrHandshakeFailed)
+	}
+
+	if bytes.Equal(remote.PublicKey, local.PublicKey) {
+		return fmt.Errorf("%w: connected to itself", ErrHandshakeFailed)
+	}
+
+	if len(local.SessionKey) > 0 && len(remote.SessionKey) == 0 {
+		return fmt.Errorf("%w: peer does not encrypt its traffic", ErrHandshakeFailed)
+	}
+
+	if len(local.SessionKey) == 0 && len(remote.SessionKey) > 0 {
+		return fmt.Errorf("%w: peer requires encrypted traffic", ErrHandshakeFailed)
+	}
+
+	return nil
+}
+
+// sendGob sends the gob encoded data as a message of the given type
+func (p *TCPPeer) sendGob(messageType MessageType, data any) error {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(data); err != nil {
+		return err
+	}
+
+	return p.SendMessage(NewMessage(messageType, buf.Bytes()))
+}
+
+// readGob reads the next message, which has to be of the given type, and decodes its gob encoded data
+func (p *TCPPeer) readGob(messageType MessageType, data any) error {
+	message, err := p.reader.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	if message.Type != messageType {
+		return fmt.Errorf("%w: expected message type %x, got %x", ErrHandshakeFailed, messageType, message.Type)
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(message.Data)).Decode(data); err != nil {
+		return fmt.Errorf("%w: %s", ErrHandshakeFailed, err)
+	}
+
+	return nil
+}
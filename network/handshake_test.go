@@ -0,0 +1,138 @@
+package network
+
+import (
+	"bytes"
+	"github.com/evgeniy-dammer/blockchain/crypto"
+	"github.com/evgeniy-dammer/blockchain/types"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+// connectedPeers returns both ends of a TCP connection
+func connectedPeers(t *testing.T) (*TCPPeer, *TCPPeer) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+
+	return newTCPPeer(conn, true), newTCPPeer(<-accepted, false)
+}
+
+// handshakePeers runs the handshakes of both ends of a new connection and returns the peers and their errors.
+// A peer whose handshake fails is closed.
+func handshakePeers(t *testing.T, a, b *localHandshake) (*TCPPeer, *TCPPeer, error, error) {
+	peerA, peerB := connectedPeers(t)
+
+	errCh := make(chan error)
+	go func() {
+		err := peerB.handshake(b)
+		if err != nil {
+			peerB.Close()
+		}
+
+		errCh <- err
+	}()
+
+	errA := peerA.handshake(a)
+	if errA != nil {
+		peerA.Close()
+	}
+
+	return peerA, peerB, errA, <-errCh
+}
+
+// mustLocalHandshake returns a new handshake of the node with the given key
+func mustLocalHandshake(t *testing.T, id string, nodeKey crypto.PrivateKey, encrypt bool) *localHandshake {
+	local, err := newLocalHandshake(id, ":3000", types.Hash{0x01}, nodeKey, encrypt)
+	assert.Nil(t, err)
+
+	return local
+}
+
+func TestHandshake(t *testing.T) {
+	keyA, keyB := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+
+	peerA, peerB, errA, errB := handshakePeers(t, mustLocalHandshake(t, "A", keyA, false), mustLocalHandshake(t, "B", keyB, false))
+	defer peerA.Close()
+	defer peerB.Close()
+
+	assert.Nil(t, errA)
+	assert.Nil(t, errB)
+	assert.Equal(t, "B", peerA.ID)
+	assert.Equal(t, keyB.PublicKey(), peerA.PublicKey)
+	assert.Equal(t, "A", peerB.ID)
+	assert.Equal(t, "127.0.0.1:3000", peerB.Address)
+	assert.Nil(t, peerA.session)
+}
+
+func TestHandshake_Rejected(t *testing.T) {
+	keyA, keyB := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+
+	tests := map[string]func(b *localHandshake){
+		"version":   func(b *localHandshake) { b.message.Version = ProtocolVersion + 1 },
+		"genesis":   func(b *localHandshake) { b.message.GenesisHash = types.Hash{0x02} },
+		"key":       func(b *localHandshake) { b.message.PublicKey = crypto.GeneratePrivateKey().PublicKey() },
+		"itself":    func(b *localHandshake) { b.message.PublicKey = keyA.PublicKey() },
+		"encrypts":  func(b *localHandshake) { *b = *mustLocalHandshake(t, "B", keyB, true) },
+		"plaintext": func(b *localHandshake) { b.message.SessionKey = nil },
+	}
+
+	for name, change := range tests {
+		b := mustLocalHandshake(t, "B", keyB, false)
+		change(b)
+
+		a := mustLocalHandshake(t, "A", keyA, name == "plaintext")
+
+		peerA, peerB, errA, _ := handshakePeers(t, a, b)
+		assert.ErrorIs(t, errA, ErrHandshakeFailed, name)
+
+		peerA.Close()
+		peerB.Close()
+	}
+}
+
+func TestHandshake_Encrypted(t *testing.T) {
+	keyA, keyB := crypto.GeneratePrivateKey(), crypto.GeneratePrivateKey()
+
+	peerA, peerB, errA, errB := handshakePeers(t, mustLocalHandshake(t, "A", keyA, true), mustLocalHandshake(t, "B", keyB, true))
+	defer peerA.Close()
+	defer peerB.Close()
+
+	assert.Nil(t, errA)
+	assert.Nil(t, errB)
+	assert.NotNil(t, peerA.session)
+	assert.NotNil(t, peerB.session)
+
+	rpcCh := make(chan RPC)
+	go peerA.readLoop(rpcCh)
+	go peerB.readLoop(rpcCh)
+
+	// the server dispatch receives the plain frames in both directions
+	for _, test := range []struct {
+		from, to *TCPPeer
+		message  *Message
+	}{
+		{peerA, peerB, NewMessage(MessageTypeGetStatus, nil)},
+		{peerB, peerA, NewMessage(MessageTypeBlocks, bytes.Repeat([]byte{0x01}, 100_000))},
+		{peerA, peerB, NewMessage(MessageTypeTransaction, []byte("tx"))},
+	} {
+		assert.Nil(t, test.from.SendMessage(test.message))
+
+		rpc := <-rpcCh
+		assert.Equal(t, test.to.conn.RemoteAddr(), rpc.From)
+
+		decoded, err := NewFrameReader(rpc.Payload).ReadMessage()
+		assert.Nil(t, err)
+		assert.Equal(t, test.message.Type, decoded.Type)
+		assert.Equal(t, len(test.message.Data), len(decoded.Data))
+	}
+}
@@ -13,6 +13,13 @@ type BlocksMessage struct {
 	Blocks []*core.Block
 }
 
+type GetPeersMessage struct{}
+
+// PeersMessage shares the addresses of known nodes
+type PeersMessage struct {
+	Addresses []string
+}
+
 type StatusMessage struct {
 	ID            string // the id of the server
 	Version       uint32
@@ -0,0 +1,144 @@
+package network
+
+import (
+	"errors"
+	"github.com/evgeniy-dammer/blockchain/core"
+	"net"
+	"time"
+)
+
+const (
+	banThreshold = 100       // the misbehaviour score which gets a peer banned
+	banDuration  = time.Hour // how long a banned peer cannot connect
+
+	// Misbehaviour scores
+	misbehaviourUndecodable  = 20 // a message which cannot be decoded
+	misbehaviourInvalidFrame = 50 // a frame which is invalid, it also ends the connection
+	misbehaviourInvalidBlock = 50 // a block which fails the validation
+
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 5 * time.Minute
+)
+
+var ErrPeerBanned = errors.New("peer is banned")
+
+// maintainConnection keeps the node connected to the address. After a failed dial or a rejected peer
+// it waits with an exponential backoff before it dials again, after an established connection is lost
+// it starts over with the shortest backoff.
+func (s *Server) maintainConnection(addr string) {
+	backoff := minReconnectBackoff
+
+	for {
+		// the node may have connected to the address in another way
+		if s.isConnected(addr) {
+			time.Sleep(discoveryInterval)
+			continue
+		}
+
+		peer, err := s.dial(addr)
+		if err == nil {
+			s.peerCh <- peer
+			<-peer.done
+
+			if peer.added {
+				backoff = minReconnectBackoff
+			}
+		}
+
+		s.options.Logger.Log("msg", "reconnecting", "addr", addr, "in", backoff, "err", err)
+
+		time.Sleep(backoff)
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// nextBackoff returns the backoff after the given one, twice as long but at most maxReconnectBackoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff *= 2; backoff > maxReconnectBackoff {
+		return maxReconnectBackoff
+	}
+
+	return backoff
+}
+
+// removePeer removes a peer whose connection ended
+func (s *Server) removePeer(peer *TCPPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.peerMap[peer.conn.RemoteAddr()] == peer {
+		delete(s.peerMap, peer.conn.RemoteAddr())
+	}
+
+	s.options.Logger.Log("msg", "peer removed from the server", "addr", peer.conn.RemoteAddr(), "id", peer.ID)
+}
+
+// misbehave raises the misbehaviour score of the peer. A peer which reaches banThreshold is banned for
+// banDuration and disconnected. The ban is kept for the host the peer connected from, the node key and
+// the announced address are chosen by the peer, so they cannot be trusted.
+func (s *Server) misbehave(from net.Addr, score int, reason error) {
+	s.mu.Lock()
+
+	peer, ok := s.peerMap[from]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+
+	peer.misbehaviour += score
+	total := peer.misbehaviour
+	banned := total >= banThreshold
+
+	if banned {
+		if host, err := remoteHost(peer.conn.RemoteAddr()); err == nil {
+			s.bans[host] = time.Now().Add(banDuration)
+		}
+	}
+
+	s.mu.Unlock()
+
+	s.options.Logger.Log("msg", "peer misbehaved", "addr", from, "id", peer.ID, "score", total, "banned", banned, "reason", reason)
+
+	if banned {
+		// ends the read loop of the peer, which removes it
+		peer.Close()
+	}
+}
+
+// isBanned checks if the host is banned
+func (s *Server) isBanned(host string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok := s.bans[host]
+	if !ok {
+		return false
+	}
+
+	if time.Now().Before(until) {
+		return true
+	}
+
+	delete(s.bans, host)
+
+	return false
+}
+
+// isBannedAddress checks if the host of the address is banned
+func (s *Server) isBannedAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+
+	return err == nil && s.isBanned(host)
+}
+
+// isInvalidBlock checks if the message failed because it carries a block which is invalid. A block which is
+// known already or does not extend a known block may be sent by an honest peer, so it is not invalid.
+func isInvalidBlock(message *DecodedMessage, err error) bool {
+	switch message.Data.(type) {
+	case *core.Block, *BlocksMessage:
+	default:
+		return false
+	}
+
+	return !errors.Is(err, core.ErrBlockKnown) && !errors.Is(err, core.ErrUnknownParent) && !errors.Is(err, core.ErrReorgTooDeep)
+}
@@ -0,0 +1,176 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/evgeniy-dammer/blockchain/core"
+	"github.com/evgeniy-dammer/blockchain/crypto"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// connectServers connects a peer to the server, the peer runs the handshake of the other server.
+// It returns the peer as the server sees it and the other end of the connection.
+func connectServers(t *testing.T, server, other *Server) (*TCPPeer, *TCPPeer) {
+	local, remote := connectedPeers(t)
+
+	go server.handlePeer(remote)
+
+	handshake, err := other.localHandshake()
+	assert.Nil(t, err)
+
+	if err := local.handshake(handshake); err != nil {
+		local.Close()
+	}
+
+	return remote, local
+}
+
+// peerCount returns the number of peers of the server
+func peerCount(s *Server) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.peerMap)
+}
+
+func TestServer_RemovePeer(t *testing.T) {
+	server, err := NewServer(ServerOptions{ID: "A"})
+	assert.Nil(t, err)
+
+	other, err := NewServer(ServerOptions{ID: "B", ListenAddr: ":3000"})
+	assert.Nil(t, err)
+
+	peer, remote := connectServers(t, server, other)
+	assert.Eventually(t, func() bool { return peerCount(server) == 1 }, time.Second, 10*time.Millisecond)
+	assert.True(t, peer.added)
+
+	// the peer is removed once its connection ends
+	remote.Close()
+	<-peer.done
+	assert.Equal(t, 0, peerCount(server))
+}
+
+func TestServer_Ban(t *testing.T) {
+	server, err := NewServer(ServerOptions{ID: "A"})
+	assert.Nil(t, err)
+
+	other, err := NewServer(ServerOptions{ID: "B", ListenAddr: ":3000"})
+	assert.Nil(t, err)
+
+	peer, remote := connectServers(t, server, other)
+	defer remote.Close()
+	assert.Eventually(t, func() bool { return peerCount(server) == 1 }, time.Second, 10*time.Millisecond)
+
+	reason := errors.New("invalid block")
+	server.misbehave(peer.conn.RemoteAddr(), misbehaviourInvalidBlock, reason)
+	assert.Equal(t, 1, peerCount(server))
+
+	// reaching the threshold disconnects the peer and bans the host it connected from
+	server.misbehave(peer.conn.RemoteAddr(), misbehaviourInvalidBlock, reason)
+	<-peer.done
+	assert.Equal(t, 0, peerCount(server))
+	assert.True(t, server.isBanned("127.0.0.1"))
+	assert.Equal(t, 1, len(server.bans))
+
+	// the host cannot connect again, not even with a new node key, and its addresses are not dialled
+	renamed, err := NewServer(ServerOptions{ID: "C", ListenAddr: ":4000"})
+	assert.Nil(t, err)
+
+	peer, remote = connectServers(t, server, renamed)
+	defer remote.Close()
+	<-peer.done
+	assert.False(t, peer.added)
+	assert.Empty(t, peer.ID)
+
+	_, err = server.dial("127.0.0.1:4000")
+	assert.ErrorIs(t, err, ErrPeerBanned)
+
+	// the ban ends
+	server.mu.Lock()
+	for key := range server.bans {
+		server.bans[key] = time.Now()
+	}
+	server.mu.Unlock()
+
+	assert.False(t, server.isBanned("127.0.0.1"))
+}
+
+func TestNextBackoff(t *testing.T) {
+	backoffs := []time.Duration{}
+	for backoff := minReconnectBackoff; len(backoffs) < 10; backoff = nextBackoff(backoff) {
+		backoffs = append(backoffs, backoff)
+	}
+
+	assert.Equal(t, []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second,
+		64 * time.Second, 128 * time.Second, 256 * time.Second, maxReconnectBackoff,
+	}, backoffs)
+}
+
+func TestIsInvalidBlock(t *testing.T) {
+	block := &DecodedMessage{Data: &core.Block{}}
+
+	assert.True(t, isInvalidBlock(block, errors.New("invalid state root")))
+	assert.True(t, isInvalidBlock(&DecodedMessage{Data: &BlocksMessage{}}, errors.New("invalid signature")))
+	assert.False(t, isInvalidBlock(block, core.ErrBlockKnown))
+	assert.False(t, isInvalidBlock(block, fmt.Errorf("%w: block extends an unknown block", core.ErrUnknownParent)))
+	assert.False(t, isInvalidBlock(&DecodedMessage{Data: &StatusMessage{}}, errors.New("peer not known")))
+}
+
+// readBlocksMessage reads the messages the peer receives until it gets a BlocksMessage
+func readBlocksMessage(t *testing.T, peer *TCPPeer) *BlocksMessage {
+	for {
+		message, err := peer.readMessage()
+		assert.Nil(t, err)
+
+		if message.Type != MessageTypeBlocks {
+			continue
+		}
+
+		blocks := new(BlocksMessage)
+		assert.Nil(t, gob.NewDecoder(bytes.NewReader(message.Data)).Decode(blocks))
+
+		return blocks
+	}
+}
+
+func TestServer_GetBlocksPages(t *testing.T) {
+	server, err := NewServer(ServerOptions{ID: "A"})
+	assert.Nil(t, err)
+
+	// the blocks are signed with the key, without the validator loop of the server
+	privateKey := crypto.GeneratePrivateKey()
+	server.options.PrivateKey = &privateKey
+
+	for server.chain.Height() < maxBlocksPerMessage+5 {
+		assert.Nil(t, server.createNewBlock())
+	}
+
+	other, err := NewServer(ServerOptions{ID: "B"})
+	assert.Nil(t, err)
+
+	peer, remote := connectServers(t, server, other)
+	defer remote.Close()
+	assert.Eventually(t, func() bool { return peerCount(server) == 1 }, time.Second, 10*time.Millisecond)
+
+	// a request up to the head gets a full page
+	assert.Nil(t, server.processGetBlocksMessage(peer.conn.RemoteAddr(), &GetBlocksMessage{From: 1}))
+
+	blocks := readBlocksMessage(t, remote).Blocks
+	assert.Equal(t, maxBlocksPerMessage, len(blocks))
+	assert.Equal(t, uint32(1), blocks[0].Header.Height)
+
+	// the rest follows with the next page, To is honoured
+	assert.Nil(t, server.processGetBlocksMessage(peer.conn.RemoteAddr(), &GetBlocksMessage{From: maxBlocksPerMessage + 1}))
+	assert.Equal(t, 5, len(readBlocksMessage(t, remote).Blocks))
+
+	assert.Nil(t, server.processGetBlocksMessage(peer.conn.RemoteAddr(), &GetBlocksMessage{From: 2, To: 4}))
+	assert.Equal(t, 3, len(readBlocksMessage(t, remote).Blocks))
+
+	assert.Nil(t, server.processGetBlocksMessage(peer.conn.RemoteAddr(), &GetBlocksMessage{From: maxBlocksPerMessage + 6}))
+	assert.Empty(t, readBlocksMessage(t, remote).Blocks)
+}
@@ -17,6 +17,16 @@ const (
 	MessageTypeStatus      MessageType = 0x4
 	MessageTypeGetStatus   MessageType = 0x5
 	MessageTypeBlocks      MessageType = 0x6
+
+	// The handshake messages are only exchanged before the peer is added to the server
+	MessageTypeHandshake     MessageType = 0x7
+	MessageTypeHandshakeAuth MessageType = 0x8
+
+	// A sealed message carries another frame encrypted by the session of the peer
+	MessageTypeSealed MessageType = 0x9
+
+	MessageTypeGetPeers MessageType = 0xa
+	MessageTypePeers    MessageType = 0xb
 )
 
 func init() {
@@ -43,15 +53,9 @@ func NewMessage(messageType MessageType, data []byte) *Message {
 	return &Message{Type: messageType, Data: data}
 }
 
-// Bytes returns the message as a slice of bytes
-func (m *Message) Bytes() []byte {
-	buf := &bytes.Buffer{}
-
-	if err := gob.NewEncoder(buf).Encode(m); err != nil {
-		return nil
-	}
-
-	return buf.Bytes()
+// Bytes returns the message as a frame, it fails with ErrFrameTooLarge if the data does not fit into a frame
+func (m *Message) Bytes() ([]byte, error) {
+	return encodeFrame(m)
 }
 
 // DecodedMessage
@@ -65,10 +69,9 @@ type RPCDecodeFunc func(RPC) (*DecodedMessage, error)
 
 // DefaultRPCDecodeFunc returns a decoded message fetched from peers
 func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMessage, error) {
-	message := Message{}
-
-	if err := gob.NewDecoder(rpc.Payload).Decode(&message); err != nil {
-		return nil, fmt.Errorf("failed to decode message from %s: %s", rpc.From, err)
+	message, err := NewFrameReader(rpc.Payload).ReadMessage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode message from %s: %w", rpc.From, err)
 	}
 
 	//log.Info().Msgf("receives a new message from %s with %x type", rpc.From, message.Type)
@@ -77,7 +80,7 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMessage, error) {
 	case MessageTypeTransaction:
 		transaction := new(core.Transaction)
 
-		if err := transaction.Decode(core.NewGobTransactionDecoder(bytes.NewReader(message.Data))); err != nil {
+		if err := transaction.Decode(core.NewBinaryTransactionDecoder(bytes.NewReader(message.Data))); err != nil {
 			return nil, err
 		}
 
@@ -87,7 +90,7 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMessage, error) {
 		}, nil
 	case MessageTypeBlock:
 		block := new(core.Block)
-		if err := block.Decode(core.NewGobBlockDecoder(bytes.NewReader(message.Data))); err != nil {
+		if err := block.Decode(core.NewBinaryBlockDecoder(bytes.NewReader(message.Data))); err != nil {
 			return nil, err
 		}
 
@@ -133,6 +136,23 @@ func DefaultRPCDecodeFunc(rpc RPC) (*DecodedMessage, error) {
 			Data: blocks,
 		}, nil
 
+	case MessageTypeGetPeers:
+		return &DecodedMessage{
+			From: rpc.From,
+			Data: &GetPeersMessage{},
+		}, nil
+
+	case MessageTypePeers:
+		peers := new(PeersMessage)
+		if err := gob.NewDecoder(bytes.NewReader(message.Data)).Decode(peers); err != nil {
+			return nil, err
+		}
+
+		return &DecodedMessage{
+			From: rpc.From,
+			Data: peers,
+		}, nil
+
 	default:
 		return nil, fmt.Errorf("invalid message type %x", message.Type)
 	}
@@ -3,6 +3,7 @@ package network
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/evgeniy-dammer/blockchain/api"
 	"github.com/evgeniy-dammer/blockchain/core"
@@ -11,12 +12,25 @@ import (
 	"github.com/go-kit/log"
 	"net"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 )
 
 var defaultBlockTime = time.Second * 5
 
+const (
+	defaultMaxOutbound = 8
+	addressBookSize    = 1000
+	maxPeersPerMessage = 100              // the most addresses a PeersMessage shares
+	discoveryInterval  = 10 * time.Second // how often the node looks for new outbound peers
+	dialTimeout        = 5 * time.Second
+	dialRetryAfter     = 30 * time.Second // an address is not dialled again before
+)
+
+// maxBlocksPerMessage is the most blocks a BlocksMessage carries, a longer chain is synced with several of them
+const maxBlocksPerMessage = 64
+
 // ServerOptions
 type ServerOptions struct {
 	APIListenAddr string
@@ -29,6 +43,15 @@ type ServerOptions struct {
 	RPCProcessor  RPCProcessor
 	BlockTime     time.Duration
 	PrivateKey    *crypto.PrivateKey
+	NodeKey       *crypto.PrivateKey // Authenticates the node to its peers, the PrivateKey or a new key if not set
+	Encrypt       bool               // Encrypts the traffic with the peers, which have to encrypt it as well
+	DataDir       string             // If set blocks and state snapshots are persisted inside this directory, otherwise they are kept in memory
+	ForkChoice    core.ForkChoice
+	ChainID       uint32   // Transactions have to be signed for this chain
+	BlockReward   uint64   // Paid to the validator of every block on top of the transaction fees
+	GasPrice      uint64   // Paid by the sender for every unit of gas its transaction uses
+	MaxOutbound   int      // The number of outbound peers the node keeps dialling addresses for
+	StaticPeers   []string // Persistent peers, the node keeps reconnecting to them like to the seed nodes
 }
 
 // Server
@@ -37,6 +60,8 @@ type Server struct {
 	peerCh       chan *TCPPeer
 	mu           sync.RWMutex
 	peerMap      map[net.Addr]*TCPPeer
+	addressBook  *AddressBook
+	bans         map[string]time.Time // the hosts of banned peers and the end of their bans
 	options      ServerOptions
 	memoryPool   *TransactionPool
 	chain        *core.Blockchain
@@ -56,12 +81,48 @@ func NewServer(options ServerOptions) (*Server, error) {
 		options.RPCDecodeFunc = DefaultRPCDecodeFunc
 	}
 
+	if options.MaxOutbound == 0 {
+		options.MaxOutbound = defaultMaxOutbound
+	}
+
+	if options.NodeKey == nil {
+		options.NodeKey = options.PrivateKey
+	}
+
+	if options.NodeKey == nil {
+		nodeKey := crypto.GeneratePrivateKey()
+		options.NodeKey = &nodeKey
+	}
+
 	if options.Logger == nil {
 		options.Logger = log.NewLogfmtLogger(os.Stderr)
 		options.Logger = log.With(options.Logger, "addr", options.ID)
 	}
 
-	chain, err := core.NewBlockchain(options.Logger, genesisBlock())
+	chainOptions := core.BlockchainOptions{
+		Logger:      options.Logger,
+		ForkChoice:  options.ForkChoice,
+		ChainID:     options.ChainID,
+		BlockReward: options.BlockReward,
+		GasPrice:    options.GasPrice,
+	}
+
+	if len(options.DataDir) > 0 {
+		store, err := core.NewDiskStore(filepath.Join(options.DataDir, "blocks"))
+		if err != nil {
+			return nil, err
+		}
+
+		snapshots, err := core.NewDiskSnapshotStore(filepath.Join(options.DataDir, "state"), 0)
+		if err != nil {
+			return nil, err
+		}
+
+		chainOptions.Storage = store
+		chainOptions.Snapshots = snapshots
+	}
+
+	chain, err := core.NewBlockchainWithOptions(genesisBlock(options.ChainID), chainOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -89,6 +150,8 @@ func NewServer(options ServerOptions) (*Server, error) {
 		TCPTransport: tr,
 		peerCh:       peerCh,
 		peerMap:      make(map[net.Addr]*TCPPeer),
+		addressBook:  NewAddressBook(addressBookSize),
+		bans:         make(map[string]time.Time),
 		options:      options,
 		chain:        chain,
 		memoryPool:   NewTransactionPool(1000),
@@ -100,6 +163,12 @@ func NewServer(options ServerOptions) (*Server, error) {
 
 	server.TCPTransport.peerCh = peerCh
 
+	// Transactions of blocks dropped by a chain reorganisation have to be included again
+	chain.SetReorgHandler(server.memoryPool.Restore)
+	server.memoryPool.SetNonceSource(chain.NextNonce)
+	server.memoryPool.SetBalanceSource(chain.Balance)
+	server.memoryPool.SetGasPrice(chain.GasPrice())
+
 	if server.options.RPCProcessor == nil {
 		server.options.RPCProcessor = server
 	}
@@ -111,22 +180,102 @@ func NewServer(options ServerOptions) (*Server, error) {
 	return server, nil
 }
 
+// bootstrapNetwork keeps the node connected to the seed nodes and the persistent peers
+// and keeps looking for more peers
 func (s *Server) bootstrapNetwork() {
-	for _, addr := range s.options.SeedNodes {
+	for _, addr := range append(s.options.SeedNodes, s.options.StaticPeers...) {
 		fmt.Println("trying to connect to ", addr)
 
-		go func(addr string) {
-			conn, err := net.Dial("tcp", addr)
-			if err != nil {
-				fmt.Printf("could not connect to %+v\n", conn)
-				return
-			}
+		s.addressBook.Add(addr)
 
-			s.peerCh <- &TCPPeer{
-				conn: conn,
-			}
-		}(addr)
+		go s.maintainConnection(addr)
 	}
+
+	go s.discoveryLoop()
+}
+
+// dial connects to the node at the address, unless its host is banned
+func (s *Server) dial(addr string) (*TCPPeer, error) {
+	if s.isBannedAddress(addr) {
+		return nil, fmt.Errorf("%w: %s", ErrPeerBanned, addr)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		s.addressBook.MarkFailed(addr)
+		return nil, err
+	}
+
+	peer := newTCPPeer(conn, true)
+	peer.Address = addr
+
+	return peer, nil
+}
+
+// connect dials the address and hands the new peer to the server
+func (s *Server) connect(addr string) {
+	peer, err := s.dial(addr)
+	if err != nil {
+		s.options.Logger.Log("msg", "could not connect", "addr", addr, "err", err)
+		return
+	}
+
+	s.peerCh <- peer
+}
+
+// discoveryLoop dials addresses of the address book while the node has fewer outbound peers than
+// MaxOutbound, and asks its peers for more addresses meanwhile
+func (s *Server) discoveryLoop() {
+	ticker := time.NewTicker(discoveryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		missing := s.options.MaxOutbound - s.outboundCount()
+		if missing <= 0 {
+			continue
+		}
+
+		skip := func(addr string) bool {
+			return s.isConnected(addr) || s.isBannedAddress(addr)
+		}
+
+		for _, addr := range s.addressBook.Candidates(missing, dialRetryAfter, skip) {
+			go s.connect(addr)
+		}
+
+		if err := s.broadcastGetPeers(); err != nil {
+			s.options.Logger.Log("error", err)
+		}
+	}
+}
+
+// outboundCount returns the number of peers the node dialled
+func (s *Server) outboundCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, peer := range s.peerMap {
+		if peer.Outgoing {
+			count++
+		}
+	}
+
+	return count
+}
+
+// isConnected checks if the node has a peer which accepts connections at the address
+func (s *Server) isConnected(addr string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, peer := range s.peerMap {
+		if peer.Address == addr {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Start starts the Server
@@ -143,16 +292,7 @@ LOOP:
 	for {
 		select {
 		case peer := <-s.peerCh:
-			s.peerMap[peer.conn.RemoteAddr()] = peer
-
-			go peer.readLoop(s.rpcCh)
-
-			if err := s.sendGetStatusMessage(peer); err != nil {
-				s.options.Logger.Log("err", err)
-				continue
-			}
-
-			s.options.Logger.Log("msg", "peer added to the server", "outgoing", peer.Outgoing, "addr", peer.conn.RemoteAddr())
+			go s.handlePeer(peer)
 		case tx := <-s.txChan:
 			if err := s.processTransaction(tx); err != nil {
 				s.options.Logger.Log("process TX error", err)
@@ -161,6 +301,7 @@ LOOP:
 			message, err := s.options.RPCDecodeFunc(rpc)
 			if err != nil {
 				s.options.Logger.Log("RPC error", err)
+				s.misbehave(rpc.From, misbehaviourUndecodable, err)
 				continue
 			}
 
@@ -168,6 +309,10 @@ LOOP:
 				if err != core.ErrBlockKnown {
 					s.options.Logger.Log("error", err)
 				}
+
+				if isInvalidBlock(message, err) {
+					s.misbehave(message.From, misbehaviourInvalidBlock, err)
+				}
 			}
 		case <-s.quitCh:
 			break LOOP
@@ -177,6 +322,82 @@ LOOP:
 	s.options.Logger.Log("msg", "server shutdown...")
 }
 
+// handlePeer runs the handshake with a new peer which does not connect from a banned host. A peer which passes
+// the handshake is added to the server and asked for its status, then its messages are read until the connection
+// ends and the peer is removed again.
+func (s *Server) handlePeer(peer *TCPPeer) {
+	defer close(peer.done)
+
+	host, err := remoteHost(peer.conn.RemoteAddr())
+	if err == nil && s.isBanned(host) {
+		err = fmt.Errorf("%w: %s", ErrPeerBanned, host)
+	}
+
+	if err == nil {
+		var handshake *localHandshake
+		if handshake, err = s.localHandshake(); err == nil {
+			err = peer.handshake(handshake)
+		}
+	}
+
+	if err != nil {
+		s.options.Logger.Log("msg", "peer rejected", "addr", peer.conn.RemoteAddr(), "err", err)
+		peer.Close()
+
+		if peer.Outgoing {
+			s.addressBook.MarkFailed(peer.Address)
+		}
+
+		return
+	}
+
+	// an outgoing connection proves that the address works, the address of an incoming one is only announced
+	if peer.Outgoing {
+		s.addressBook.MarkGood(peer.Address)
+	} else if peer.Address != "" {
+		s.addressBook.Add(peer.Address)
+	}
+
+	s.mu.Lock()
+	s.peerMap[peer.conn.RemoteAddr()] = peer
+	peer.added = true
+	s.mu.Unlock()
+
+	defer s.removePeer(peer)
+
+	s.options.Logger.Log("msg", "peer added to the server", "outgoing", peer.Outgoing, "addr", peer.conn.RemoteAddr(), "id", peer.ID)
+
+	if err := s.sendGetStatusMessage(peer); err != nil {
+		s.options.Logger.Log("err", err)
+	}
+
+	if err := peer.SendMessage(NewMessage(MessageTypeGetPeers, nil)); err != nil {
+		s.options.Logger.Log("err", err)
+	}
+
+	if err := peer.readLoop(s.rpcCh); err != nil {
+		s.options.Logger.Log("msg", "peer connection failed", "addr", peer.conn.RemoteAddr(), "err", err)
+
+		if errors.Is(err, ErrInvalidFrame) || errors.Is(err, ErrFrameTooLarge) || errors.Is(err, ErrInvalidSealedFrame) {
+			s.misbehave(peer.conn.RemoteAddr(), misbehaviourInvalidFrame, err)
+		}
+
+		return
+	}
+
+	s.options.Logger.Log("msg", "peer closed the connection", "addr", peer.conn.RemoteAddr())
+}
+
+// localHandshake returns the handshake the node sends to a new peer
+func (s *Server) localHandshake() (*localHandshake, error) {
+	genesis, err := s.chain.GetHeader(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLocalHandshake(s.options.ID, s.options.ListenAddr, core.BlockHasher{}.Hash(genesis), *s.options.NodeKey, s.options.Encrypt)
+}
+
 // validatorLoop runs a creating new block loop if node is validator
 func (s *Server) validatorLoop() {
 	ticker := time.NewTicker(s.options.BlockTime)
@@ -209,69 +430,134 @@ func (s *Server) ProcessMessage(message *DecodedMessage) error {
 		return s.processGetBlocksMessage(message.From, t)
 	case *BlocksMessage:
 		return s.processBlocksMessage(message.From, t)
+	case *GetPeersMessage:
+		return s.processGetPeersMessage(message.From, t)
+	case *PeersMessage:
+		return s.processPeersMessage(message.From, t)
 	}
 
 	return nil
 }
 
-// processGetBlocksMessage
-func (s *Server) processGetBlocksMessage(from net.Addr, data *GetBlocksMessage) error {
-	s.options.Logger.Log("msg", "received getBlocks message", "from", from)
+// processGetPeersMessage answers with the best addresses of the address book
+func (s *Server) processGetPeersMessage(from net.Addr, data *GetPeersMessage) error {
+	s.mu.RLock()
+	peer, ok := s.peerMap[from]
+	s.mu.RUnlock()
 
-	var (
-		blocks    = []*core.Block{}
-		ourHeight = s.chain.Height()
-	)
+	if !ok {
+		return fmt.Errorf("peer %s not known", from)
+	}
 
-	if data.To == 0 {
-		for i := int(data.From); i <= int(ourHeight); i++ {
-			block, err := s.chain.GetBlock(uint32(i))
-			if err != nil {
-				return err
-			}
+	return peer.sendGob(MessageTypePeers, &PeersMessage{Addresses: s.addressBook.Best(maxPeersPerMessage)})
+}
+
+// processPeersMessage adds the shared addresses to the address book
+func (s *Server) processPeersMessage(from net.Addr, data *PeersMessage) error {
+	if len(data.Addresses) > maxPeersPerMessage {
+		return fmt.Errorf("peer %s shared %d addresses, at most %d are allowed", from, len(data.Addresses), maxPeersPerMessage)
+	}
+
+	source, err := remoteHost(from)
+	if err != nil {
+		return err
+	}
 
-			blocks = append(blocks, block)
+	added := 0
+	for _, addr := range data.Addresses {
+		if s.addressBook.AddFrom(addr, source) {
+			added++
 		}
 	}
 
-	blocksMsg := &BlocksMessage{
-		Blocks: blocks,
+	s.options.Logger.Log("msg", "received peers", "from", from, "shared", len(data.Addresses), "new", added)
+
+	return nil
+}
+
+// broadcastGetPeers asks every peer for the addresses it knows
+func (s *Server) broadcastGetPeers() error {
+	return s.broadcast(NewMessage(MessageTypeGetPeers, nil))
+}
+
+// processGetBlocksMessage answers with the blocks from From up to To, or up to the head if To is 0. A single
+// answer carries at most maxBlocksPerMessage blocks, and fewer if they do not fit into a frame,
+// the peer asks for the rest afterwards.
+func (s *Server) processGetBlocksMessage(from net.Addr, data *GetBlocksMessage) error {
+	s.options.Logger.Log("msg", "received getBlocks message", "from", from)
+
+	to := s.chain.Height()
+	if data.To != 0 && data.To < to {
+		to = data.To
+	}
+
+	if data.From <= to && to-data.From >= maxBlocksPerMessage {
+		to = data.From + maxBlocksPerMessage - 1
 	}
 
-	buf := new(bytes.Buffer)
-	if err := gob.NewEncoder(buf).Encode(blocksMsg); err != nil {
-		return err
+	blocks := []*core.Block{}
+
+	for height := data.From; height <= to; height++ {
+		block, err := s.chain.GetBlock(height)
+		if err != nil {
+			return err
+		}
+
+		blocks = append(blocks, block)
 	}
 
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	msg := NewMessage(MessageTypeBlocks, buf.Bytes())
-
 	peer, ok := s.peerMap[from]
 	if !ok {
-		return fmt.Errorf("peer %s not known", peer.conn.RemoteAddr())
+		return fmt.Errorf("peer %s not known", from)
 	}
 
-	return peer.Send(msg.Bytes())
+	for {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(&BlocksMessage{Blocks: blocks}); err != nil {
+			return err
+		}
+
+		err := peer.SendMessage(NewMessage(MessageTypeBlocks, buf.Bytes()))
+		if !errors.Is(err, ErrFrameTooLarge) || len(blocks) <= 1 {
+			return err
+		}
+
+		blocks = blocks[:len(blocks)/2]
+	}
 }
 
+// processBlocksMessage adds a page of synced blocks. A page which is not empty may be followed by
+// more blocks, so the next page is requested right away.
 func (s *Server) processBlocksMessage(from net.Addr, data *BlocksMessage) error {
 	s.options.Logger.Log("msg", "received BLOCKS!!!!!!!!", "from", from)
 
 	for _, block := range data.Blocks {
-		if err := s.chain.AddBlock(block); err != nil {
+		// pages requested by the sync loop and after the previous page may overlap
+		if err := s.chain.AddBlock(block); err != nil && !errors.Is(err, core.ErrBlockKnown) {
 			s.options.Logger.Log("error", err.Error())
 			return err
 		}
+
+		s.memoryPool.Refresh()
 	}
 
-	return nil
+	if len(data.Blocks) == 0 {
+		return nil
+	}
+
+	return s.requestBlocks(from)
 }
 
 func (s *Server) processStatusMessage(from net.Addr, data *StatusMessage) error {
 	s.options.Logger.Log("msg", "received STATUS message", "from", from)
 
+	if data.Version != ProtocolVersion {
+		return fmt.Errorf("peer %s speaks protocol version %d, not %d", from, data.Version, ProtocolVersion)
+	}
+
 	if data.CurrentHeight <= s.chain.Height() {
 		s.options.Logger.Log("msg", "cannot sync blockHeight to low", "ourHeight", s.chain.Height(), "theirHeight", data.CurrentHeight, "addr", from)
 		return nil
@@ -287,6 +573,7 @@ func (s *Server) processGetStatusMessage(from net.Addr, data *GetStatusMessage)
 	s.options.Logger.Log("msg", "received getStatus message", "from", from)
 
 	statusMessage := &StatusMessage{
+		Version:       ProtocolVersion,
 		CurrentHeight: s.chain.Height(),
 		ID:            s.options.ID,
 	}
@@ -301,12 +588,12 @@ func (s *Server) processGetStatusMessage(from net.Addr, data *GetStatusMessage)
 
 	peer, ok := s.peerMap[from]
 	if !ok {
-		return fmt.Errorf("peer %s not known", peer.conn.RemoteAddr())
+		return fmt.Errorf("peer %s not known", from)
 	}
 
 	msg := NewMessage(MessageTypeStatus, buf.Bytes())
 
-	return peer.Send(msg.Bytes())
+	return peer.SendMessage(msg)
 }
 
 // sendGetStatusMessage normally Transport which is our own transport should do the trick.
@@ -315,14 +602,14 @@ func (s *Server) sendGetStatusMessage(peer *TCPPeer) error {
 		getStatusMsg = new(GetStatusMessage)
 		buf          = new(bytes.Buffer)
 	)
-	
+
 	if err := gob.NewEncoder(buf).Encode(getStatusMsg); err != nil {
 		return err
 	}
 
 	msg := NewMessage(MessageTypeGetStatus, buf.Bytes())
 
-	return peer.Send(msg.Bytes())
+	return peer.SendMessage(msg)
 }
 
 // processTransaction handles new transaction from network and adds it into memory pool
@@ -333,20 +620,26 @@ func (s *Server) processTransaction(transaction *core.Transaction) error {
 		return nil
 	}
 
+	if transaction.ChainID != s.chain.ChainID() {
+		return fmt.Errorf("%w: transaction %s is signed for chain %d", core.ErrInvalidChainID, hash, transaction.ChainID)
+	}
+
 	if err := transaction.Verify(); err != nil {
 		return err
 	}
 
 	//s.options.Logger.Log("msg", "adding new transaction to mempool", "hash", hash, "mempoolPending", s.memoryPool.PendingCount())
 
+	if err := s.memoryPool.Add(transaction); err != nil {
+		return err
+	}
+
 	go func() {
 		if err := s.broadcastTransaction(transaction); err != nil {
 			s.options.Logger.Log("error", err)
 		}
 	}()
 
-	s.memoryPool.Add(transaction)
-
 	return nil
 }
 
@@ -354,38 +647,49 @@ func (s *Server) processTransaction(transaction *core.Transaction) error {
 // block height in the network.
 func (s *Server) requestBlocksLoop(peer net.Addr) error {
 	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
 
 	for {
-		ourHeight := s.chain.Height()
+		if err := s.requestBlocks(peer); err != nil {
+			return err
+		}
 
-		s.options.Logger.Log("msg", "requesting new blocks", "requesting height", ourHeight+1)
+		<-ticker.C
+	}
+}
 
-		// In this case we are 100% sure that the node has blocks heigher than us.
-		getBlocksMessage := &GetBlocksMessage{
-			From: ourHeight + 1,
-			To:   0,
-		}
+// requestBlocks asks the peer for the next page of blocks after our head
+func (s *Server) requestBlocks(peer net.Addr) error {
+	ourHeight := s.chain.Height()
 
-		buf := new(bytes.Buffer)
-		if err := gob.NewEncoder(buf).Encode(getBlocksMessage); err != nil {
-			return err
-		}
+	s.options.Logger.Log("msg", "requesting new blocks", "requesting height", ourHeight+1)
 
-		s.mu.RLock()
-		defer s.mu.RUnlock()
+	getBlocksMessage := &GetBlocksMessage{
+		From: ourHeight + 1,
+		To:   ourHeight + maxBlocksPerMessage,
+	}
 
-		msg := NewMessage(MessageTypeGetBlocks, buf.Bytes())
-		peer, ok := s.peerMap[peer]
-		if !ok {
-			return fmt.Errorf("peer %s not known", peer.conn.RemoteAddr())
-		}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(getBlocksMessage); err != nil {
+		return err
+	}
 
-		if err := peer.Send(msg.Bytes()); err != nil {
-			s.options.Logger.Log("error", "failed to send to peer", "err", err, "peer", peer)
-		}
+	msg := NewMessage(MessageTypeGetBlocks, buf.Bytes())
 
-		<-ticker.C
+	s.mu.RLock()
+	tcpPeer, ok := s.peerMap[peer]
+	s.mu.RUnlock()
+
+	// the peer is gone
+	if !ok {
+		return fmt.Errorf("peer %s not known", peer)
 	}
+
+	if err := tcpPeer.SendMessage(msg); err != nil {
+		s.options.Logger.Log("error", "failed to send to peer", "err", err, "peer", peer)
+	}
+
+	return nil
 }
 
 // processBlock adds block to servers chain and broadcasts the block
@@ -395,13 +699,21 @@ func (s *Server) processBlock(b *core.Block) error {
 		return err
 	}
 
+	// the transactions of the block are mined now
+	s.memoryPool.Refresh()
+
 	go s.broadcastBlock(b)
 
 	return nil
 }
 
-// broadcast broadcasts a payload to all transports
-func (s *Server) broadcast(payload []byte) error {
+// broadcast broadcasts a message to all transports
+func (s *Server) broadcast(message *Message) error {
+	payload, err := message.Bytes()
+	if err != nil {
+		return err
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -418,26 +730,26 @@ func (s *Server) broadcast(payload []byte) error {
 func (s *Server) broadcastBlock(block *core.Block) error {
 	buf := &bytes.Buffer{}
 
-	if err := block.Encode(core.NewGobBlockEncoder(buf)); err != nil {
+	if err := block.Encode(core.NewBinaryBlockEncoder(buf)); err != nil {
 		return err
 	}
 
 	message := NewMessage(MessageTypeBlock, buf.Bytes())
 
-	return s.broadcast(message.Bytes())
+	return s.broadcast(message)
 }
 
 // broadcastTransaction encodes a transaction and broadcasts the message
 func (s *Server) broadcastTransaction(transaction *core.Transaction) error {
 	buf := &bytes.Buffer{}
 
-	if err := transaction.Encode(core.NewGobTransactionEncoder(buf)); err != nil {
+	if err := transaction.Encode(core.NewBinaryTransactionEncoder(buf)); err != nil {
 		return err
 	}
 
 	message := NewMessage(MessageTypeTransaction, buf.Bytes())
 
-	return s.broadcast(message.Bytes())
+	return s.broadcast(message)
 }
 
 // createNewBlock creates a new block
@@ -447,17 +759,29 @@ func (s *Server) createNewBlock() error {
 		return err
 	}
 
-	// For now, we are going to use all transactions, that are in the memory pool.
-	// Later on when we know the internal structure of our transaction we will
-	// implement some kind of complexity function to determine how many transactions
-	// can be included to the block
-	transactions := s.memoryPool.Pending()
-
-	block, err := core.NewBlockFromPreviousHeader(currentHeader, transactions)
+	block, err := core.NewBlockFromPreviousHeader(currentHeader, nil)
 	if err != nil {
 		return err
 	}
 
+	// A transaction which fails would make the whole block invalid, so it is left out and dropped from the pool.
+	transactions, failed := s.chain.SelectTransactions(block.Header, s.memoryPool.Pending())
+	if len(failed) > 0 {
+		s.memoryPool.Remove(failed)
+	}
+
+	block.Transactions = transactions
+	if block.Header.DataHash, err = core.CalculateDataHash(transactions); err != nil {
+		return err
+	}
+
+	// The validator receives the fees of the block, so it is part of the state root
+	block.Validator = s.options.PrivateKey.PublicKey()
+
+	if block.Header.StateRoot, block.Header.ReceiptsRoot, err = s.chain.CalculateRoots(block); err != nil {
+		return err
+	}
+
 	if err = block.Sign(*s.options.PrivateKey); err != nil {
 		return err
 	}
@@ -466,7 +790,7 @@ func (s *Server) createNewBlock() error {
 		return err
 	}
 
-	s.memoryPool.ClearPending()
+	s.memoryPool.Refresh()
 
 	go s.broadcastBlock(block)
 
@@ -474,7 +798,7 @@ func (s *Server) createNewBlock() error {
 }
 
 // genesisBlock returns a genesis block
-func genesisBlock() *core.Block {
+func genesisBlock(chainID uint32) *core.Block {
 	header := &core.Header{
 		Version:   1,
 		DataHash:  types.Hash{},
@@ -486,6 +810,7 @@ func genesisBlock() *core.Block {
 
 	coinbase := crypto.PublicKey{}
 	tx := core.NewTransaction(nil)
+	tx.ChainID = chainID
 	tx.From = coinbase
 	tx.To = coinbase
 	tx.Value = 10_000_000
@@ -0,0 +1,89 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrInvalidSealedFrame = errors.New("invalid sealed frame")
+
+// session encrypts the frames of a connection once the handshake agreed on a shared secret. Every frame
+// is sealed with AES-256-GCM, each direction has its own key and counts its frames to build the nonces,
+// so a frame which is altered, dropped, replayed or reordered fails to open.
+type session struct {
+	sendLock       sync.Mutex // keeps the order of the nonces and of the written frames the same
+	sendCipher     cipher.AEAD
+	sendCounter    uint64
+	receiveCipher  cipher.AEAD
+	receiveCounter uint64
+}
+
+// newSession derives the keys of both directions from the shared secret and the transcript of the handshake.
+// The initiator is the peer which dialled the connection.
+func newSession(secret, transcript []byte, initiator bool) (*session, error) {
+	initiatorCipher, err := sessionCipher(secret, transcript, "initiator")
+	if err != nil {
+		return nil, err
+	}
+
+	responderCipher, err := sessionCipher(secret, transcript, "responder")
+	if err != nil {
+		return nil, err
+	}
+
+	if initiator {
+		return &session{sendCipher: initiatorCipher, receiveCipher: responderCipher}, nil
+	}
+
+	return &session{sendCipher: responderCipher, receiveCipher: initiatorCipher}, nil
+}
+
+// sessionCipher returns the cipher of the frames sent by the given side
+func sessionCipher(secret, transcript []byte, side string) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(side))
+	mac.Write(transcript)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the next frame. Must be called with sendLock held.
+func (s *session) seal(frame []byte) []byte {
+	nonce := sessionNonce(s.sendCipher, s.sendCounter)
+	s.sendCounter++
+
+	return s.sendCipher.Seal(nil, nonce, frame, nil)
+}
+
+// open decrypts the next frame
+func (s *session) open(sealed []byte) ([]byte, error) {
+	nonce := sessionNonce(s.receiveCipher, s.receiveCounter)
+
+	frame, err := s.receiveCipher.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: frame %d: %s", ErrInvalidSealedFrame, s.receiveCounter, err)
+	}
+
+	s.receiveCounter++
+
+	return frame, nil
+}
+
+// sessionNonce returns the nonce of the frame with the given number
+func sessionNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+
+	return nonce
+}
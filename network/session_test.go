@@ -0,0 +1,65 @@
+package network
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// sessionPair returns the sessions of both ends of a connection
+func sessionPair(t *testing.T) (*session, *session) {
+	initiator, err := newSession([]byte("secret"), []byte("transcript"), true)
+	assert.Nil(t, err)
+
+	responder, err := newSession([]byte("secret"), []byte("transcript"), false)
+	assert.Nil(t, err)
+
+	return initiator, responder
+}
+
+func TestSession_SealAndOpen(t *testing.T) {
+	initiator, responder := sessionPair(t)
+
+	for _, frame := range [][]byte{[]byte("first"), []byte("second")} {
+		sealed := initiator.seal(frame)
+		assert.NotContains(t, string(sealed), string(frame))
+
+		opened, err := responder.open(sealed)
+		assert.Nil(t, err)
+		assert.Equal(t, frame, opened)
+	}
+
+	// every direction has its own key
+	_, err := initiator.open(initiator.seal([]byte("own")))
+	assert.ErrorIs(t, err, ErrInvalidSealedFrame)
+}
+
+func TestSession_Invalid(t *testing.T) {
+	initiator, responder := sessionPair(t)
+
+	first := initiator.seal([]byte("first"))
+	second := initiator.seal([]byte("second"))
+
+	// altered
+	altered := append([]byte{}, first...)
+	altered[0] ^= 0x01
+	_, err := responder.open(altered)
+	assert.ErrorIs(t, err, ErrInvalidSealedFrame)
+
+	// reordered
+	_, err = responder.open(second)
+	assert.ErrorIs(t, err, ErrInvalidSealedFrame)
+
+	_, err = responder.open(first)
+	assert.Nil(t, err)
+
+	// replayed
+	_, err = responder.open(first)
+	assert.ErrorIs(t, err, ErrInvalidSealedFrame)
+
+	// another secret
+	other, err := newSession([]byte("other"), []byte("transcript"), false)
+	assert.Nil(t, err)
+
+	_, err = other.open(initiator.seal([]byte("third")))
+	assert.ErrorIs(t, err, ErrInvalidSealedFrame)
+}
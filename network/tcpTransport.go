@@ -2,42 +2,122 @@ package network
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"github.com/evgeniy-dammer/blockchain/crypto"
 	"io"
 	"net"
 )
 
 type TCPPeer struct {
-	conn     net.Conn
-	Outgoing bool
+	conn      net.Conn
+	reader    *FrameReader
+	Outgoing  bool
+	Address   string           // the address the peer accepts connections at, empty if it is not known
+	ID        string           // set by the handshake
+	PublicKey crypto.PublicKey // the node key of the peer, set by the handshake
+	session   *session         // encrypts the frames after the handshake, nil if the traffic is not encrypted
+
+	misbehaviour int           // grows with every misbehaviour, the peer is banned once it reaches banThreshold
+	added        bool          // set if the peer passed the handshake and was added to the server
+	done         chan struct{} // closed once the server is done with the peer
 }
 
+// newTCPPeer is a constructor for the TCPPeer
+func newTCPPeer(conn net.Conn, outgoing bool) *TCPPeer {
+	return &TCPPeer{
+		conn:     conn,
+		reader:   NewFrameReader(conn),
+		Outgoing: outgoing,
+		done:     make(chan struct{}),
+	}
+}
+
+// Send sends a frame made by Message.Bytes to the peer
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.conn.Write(b)
+	if len(b) == 0 {
+		return fmt.Errorf("%w: empty frame", ErrInvalidFrame)
+	}
+
+	if p.session == nil {
+		// a single write, so frames sent concurrently do not interleave
+		_, err := p.conn.Write(b)
+		return err
+	}
+
+	p.session.sendLock.Lock()
+	defer p.session.sendLock.Unlock()
+
+	sealed, err := NewMessage(MessageTypeSealed, p.session.seal(b)).Bytes()
+	if err != nil {
+		return fmt.Errorf("sealed frame of %d bytes: %w", len(b), err)
+	}
+
+	_, err = p.conn.Write(sealed)
 	return err
 }
 
-func (p *TCPPeer) readLoop(rpcCh chan RPC) {
-	buf := make([]byte, 4096)
+// SendMessage sends the message to the peer as a single frame
+func (p *TCPPeer) SendMessage(message *Message) error {
+	frame, err := message.Bytes()
+	if err != nil {
+		return err
+	}
+
+	return p.Send(frame)
+}
+
+// Close closes the connection to the peer
+func (p *TCPPeer) Close() error {
+	return p.conn.Close()
+}
+
+// readLoop passes every frame the peer sends to rpcCh until the peer closes the connection or sends
+// an invalid frame. The connection is closed when the loop ends, it returns nil if the peer closed it.
+func (p *TCPPeer) readLoop(rpcCh chan RPC) error {
+	defer p.conn.Close()
+
 	for {
-		n, err := p.conn.Read(buf)
+		message, err := p.readMessage()
 		if err == io.EOF {
-			continue
+			return nil
 		}
 
 		if err != nil {
-			fmt.Printf("read error: %s", err)
-			continue
+			return err
+		}
+
+		frame, err := message.Bytes()
+		if err != nil {
+			return err
 		}
 
-		msg := buf[:n]
 		rpcCh <- RPC{
 			From:    p.conn.RemoteAddr(),
-			Payload: bytes.NewReader(msg),
+			Payload: bytes.NewReader(frame),
 		}
 	}
 }
 
+// readMessage reads the next message of the peer and opens it if the traffic is encrypted
+func (p *TCPPeer) readMessage() (*Message, error) {
+	message, err := p.reader.ReadMessage()
+	if err != nil || p.session == nil {
+		return message, err
+	}
+
+	if message.Type != MessageTypeSealed {
+		return nil, fmt.Errorf("%w: message type %x is not sealed", ErrInvalidSealedFrame, message.Type)
+	}
+
+	frame, err := p.session.open(message.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFrameReader(bytes.NewReader(frame)).ReadMessage()
+}
+
 type TCPTransport struct {
 	peerCh     chan *TCPPeer
 	listenAddr string
@@ -67,15 +147,15 @@ func (t *TCPTransport) Start() error {
 func (t *TCPTransport) acceptLoop() {
 	for {
 		conn, err := t.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+
 		if err != nil {
 			fmt.Printf("accept error from %+v\n", conn)
 			continue
 		}
 
-		peer := &TCPPeer{
-			conn: conn,
-		}
-
-		t.peerCh <- peer
+		t.peerCh <- newTCPPeer(conn, false)
 	}
 }
@@ -1,39 +1,168 @@
 package network
 
 import (
+	"errors"
+	"fmt"
 	"github.com/evgeniy-dammer/blockchain/core"
 	"github.com/evgeniy-dammer/blockchain/types"
+	"sort"
 	"sync"
 )
 
-// TransactionPool
+const (
+	maxParkedPerAccount = 16 // parked transactions of an account, further ones are rejected until the gap is filled
+	maxNonceGap         = 64 // how far the nonce of a transaction may be ahead of the next nonce of its sender
+)
+
+var (
+	ErrNonceTooLow       = errors.New("transaction nonce too low")
+	ErrNonceTooHigh      = errors.New("transaction nonce too far ahead")
+	ErrTooManyParked     = errors.New("too many parked transactions")
+	ErrInsufficientFunds = errors.New("insufficient funds for fee and value")
+)
+
+// NonceSource returns the nonce the next transaction of the account has to use
+type NonceSource func(address types.Address) uint64
+
+// BalanceSource returns the balance of the account
+type BalanceSource func(address types.Address) uint64
+
+// TransactionPool keeps transactions until they are included into a block. Only transactions which use the
+// next nonce of their sender are pending, transactions after a nonce gap are parked until the gap is filled.
 type TransactionPool struct {
-	all       *TransactionSortedMap
-	pending   *TransactionSortedMap
-	maxLength int // The max length of the total pool of transactions. When the pool is full we will prune the oldest transaction
+	lock        sync.Mutex
+	all         *TransactionSortedMap
+	pending     *TransactionSortedMap
+	parked      map[types.Address]map[uint64]*core.Transaction
+	nonces      map[types.Address]uint64 // next nonce of the accounts with pending transactions
+	nonceSource NonceSource
+	balances    BalanceSource
+	gasPrice    uint64
+	maxLength   int // The max length of the total pool of transactions. When the pool is full we will prune the oldest transaction
 }
 
-// NewTransactionPool is a constructor for a TransactionPool
+// NewTransactionPool is a constructor for a TransactionPool. Until a nonce source is set every account starts with nonce 0.
 func NewTransactionPool(maxLength int) *TransactionPool {
 	return &TransactionPool{
-		all:       NewTransactionSortedMap(),
-		pending:   NewTransactionSortedMap(),
-		maxLength: maxLength,
+		all:         NewTransactionSortedMap(),
+		pending:     NewTransactionSortedMap(),
+		parked:      make(map[types.Address]map[uint64]*core.Transaction),
+		nonces:      make(map[types.Address]uint64),
+		nonceSource: func(types.Address) uint64 { return 0 },
+		gasPrice:    1,
+		maxLength:   maxLength,
 	}
 }
 
-// Add adds the transaction to the pool
-func (p *TransactionPool) Add(transaction *core.Transaction) {
+// SetNonceSource sets the source of the account nonces, usually the blockchain
+func (p *TransactionPool) SetNonceSource(source NonceSource) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.nonceSource = source
+}
+
+// SetBalanceSource sets the source of the account balances, usually the blockchain. Until it is set
+// the pool does not check if the sender of a transaction can pay its fee and value.
+func (p *TransactionPool) SetBalanceSource(source BalanceSource) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.balances = source
+}
+
+// SetGasPrice sets the gas price of the chain, the gas limit of a transaction at this price is part of its cost
+func (p *TransactionPool) SetGasPrice(price uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.gasPrice = price
+}
+
+// Add adds the transaction to the pool. A transaction whose gas limit is above core.MaxTxGas, whose nonce is already
+// used or too far ahead, whose sender cannot pay its fee and value or has too many parked transactions already is rejected.
+func (p *TransactionPool) Add(transaction *core.Transaction) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.all.Contains(transaction.Hash(core.TransactionHasher{})) {
+		return nil
+	}
+
+	if transaction.GasLimit > core.MaxTxGas {
+		return fmt.Errorf("%w: gas limit %d, at most %d is allowed", core.ErrGasLimitExceeded, transaction.GasLimit, core.MaxTxGas)
+	}
+
+	from := transaction.From.Address()
+	next := p.nextNonce(from)
+
+	if transaction.Nonce < next {
+		return fmt.Errorf("%w: account %s expects nonce %d, got %d", ErrNonceTooLow, from, next, transaction.Nonce)
+	}
+
+	if transaction.Nonce > next+maxNonceGap {
+		return fmt.Errorf("%w: account %s expects nonce %d, got %d", ErrNonceTooHigh, from, next, transaction.Nonce)
+	}
+
+	if transaction.Nonce != next && len(p.parked[from]) >= maxParkedPerAccount {
+		return fmt.Errorf("%w: account %s has %d parked transactions", ErrTooManyParked, from, len(p.parked[from]))
+	}
+
+	cost, err := transaction.Cost(p.gasPrice)
+	if err != nil {
+		return err
+	}
+
+	if p.balances != nil {
+		if balance := p.balances(from); balance < cost {
+			return fmt.Errorf("%w: account %s has %d, needs %d", ErrInsufficientFunds, from, balance, cost)
+		}
+	}
+
 	// prune the oldest transaction that is sitting in the all pool
 	if p.all.Count() == p.maxLength {
-		oldest := p.all.First()
-		p.all.Remove(oldest.Hash(core.TransactionHasher{}))
+		p.remove(p.all.First())
+		p.refresh(nil)
 	}
 
-	if !p.all.Contains(transaction.Hash(core.TransactionHasher{})) {
+	p.all.Add(transaction)
+	p.insert(transaction)
+
+	return nil
+}
+
+// Restore puts transactions which a chain reorganisation dropped from the chain back into the pool
+func (p *TransactionPool) Restore(transactions []*core.Transaction) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, transaction := range transactions {
 		p.all.Add(transaction)
-		p.pending.Add(transaction)
 	}
+
+	p.refresh(transactions)
+}
+
+// Refresh checks the pool against the current account nonces. Transactions whose nonce is used
+// by now are dropped, parked transactions whose nonce gap is filled become pending.
+func (p *TransactionPool) Refresh() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.refresh(nil)
+}
+
+// Remove drops the transactions from the pool, for example because they cannot be included into a block.
+// Later transactions of the same senders are parked until the nonce gap is filled again.
+func (p *TransactionPool) Remove(transactions []*core.Transaction) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, transaction := range transactions {
+		p.remove(transaction)
+	}
+
+	p.refresh(nil)
 }
 
 // Contains check if all pool contains hash
@@ -43,12 +172,19 @@ func (p *TransactionPool) Contains(hash types.Hash) bool {
 
 // Pending return transactions from pending pool
 func (p *TransactionPool) Pending() []*core.Transaction {
-	return p.pending.transactions.Data
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return append([]*core.Transaction{}, p.pending.transactions.Data...)
 }
 
 // ClearPending flushes pending pull
 func (p *TransactionPool) ClearPending() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
 	p.pending.Clear()
+	p.nonces = make(map[types.Address]uint64)
 }
 
 // PendingCount returns count of pending transactions
@@ -56,6 +192,109 @@ func (p *TransactionPool) PendingCount() int {
 	return p.pending.Count()
 }
 
+// ParkedCount returns count of transactions waiting for a nonce gap to be filled
+func (p *TransactionPool) ParkedCount() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	count := 0
+	for _, transactions := range p.parked {
+		count += len(transactions)
+	}
+
+	return count
+}
+
+// nextNonce returns the nonce of the next pending transaction of the account. Must be called with lock held.
+func (p *TransactionPool) nextNonce(address types.Address) uint64 {
+	if nonce, ok := p.nonces[address]; ok {
+		return nonce
+	}
+
+	return p.nonceSource(address)
+}
+
+// insert makes the transaction pending if it uses the next nonce of its sender, otherwise it is parked.
+// Must be called with lock held.
+func (p *TransactionPool) insert(transaction *core.Transaction) {
+	from := transaction.From.Address()
+
+	if transaction.Nonce != p.nextNonce(from) {
+		if p.parked[from] == nil {
+			p.parked[from] = make(map[uint64]*core.Transaction)
+		}
+
+		p.parked[from][transaction.Nonce] = transaction
+
+		return
+	}
+
+	p.pending.Add(transaction)
+	p.nonces[from] = transaction.Nonce + 1
+
+	for parked := p.parked[from]; parked != nil; {
+		next, ok := parked[p.nonces[from]]
+		if !ok {
+			break
+		}
+
+		delete(parked, next.Nonce)
+		p.pending.Add(next)
+		p.nonces[from] = next.Nonce + 1
+	}
+
+	if len(p.parked[from]) == 0 {
+		delete(p.parked, from)
+	}
+}
+
+// remove drops the transaction from every index of the pool. The pending transactions of its sender
+// have to be sorted again with refresh afterwards. Must be called with lock held.
+func (p *TransactionPool) remove(transaction *core.Transaction) {
+	hash := transaction.Hash(core.TransactionHasher{})
+
+	p.all.Remove(hash)
+	p.pending.Remove(hash)
+
+	from := transaction.From.Address()
+	if parked, ok := p.parked[from][transaction.Nonce]; ok && parked.Hash(core.TransactionHasher{}) == hash {
+		delete(p.parked[from], transaction.Nonce)
+
+		if len(p.parked[from]) == 0 {
+			delete(p.parked, from)
+		}
+	}
+}
+
+// refresh sorts the pending, parked and given transactions again and drops the ones whose nonce
+// is used by now. Must be called with lock held.
+func (p *TransactionPool) refresh(transactions []*core.Transaction) {
+	transactions = append(append([]*core.Transaction{}, transactions...), p.pending.transactions.Data...)
+
+	for _, parked := range p.parked {
+		for _, transaction := range parked {
+			transactions = append(transactions, transaction)
+		}
+	}
+
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].Nonce < transactions[j].Nonce
+	})
+
+	p.pending.Clear()
+	p.parked = make(map[types.Address]map[uint64]*core.Transaction)
+	p.nonces = make(map[types.Address]uint64)
+
+	for _, transaction := range transactions {
+		if transaction.Nonce < p.nextNonce(transaction.From.Address()) {
+			p.all.Remove(transaction.Hash(core.TransactionHasher{}))
+			continue
+		}
+
+		p.insert(transaction)
+	}
+}
+
 // TransactionSortedMap
 type TransactionSortedMap struct {
 	lock         sync.RWMutex
@@ -107,7 +346,12 @@ func (t *TransactionSortedMap) Remove(hash types.Hash) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
-	t.transactions.Remove(t.lookup[hash])
+	transaction, ok := t.lookup[hash]
+	if !ok {
+		return
+	}
+
+	t.transactions.Remove(transaction)
 	delete(t.lookup, hash)
 }
 
@@ -2,6 +2,8 @@ package network
 
 import (
 	"github.com/evgeniy-dammer/blockchain/core"
+	"github.com/evgeniy-dammer/blockchain/crypto"
+	"github.com/evgeniy-dammer/blockchain/types"
 	"github.com/evgeniy-dammer/blockchain/util"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -60,6 +62,54 @@ func TestTxPoolMaxLength(t *testing.T) {
 	}
 }
 
+func TestTxPoolMaxLengthPrunesEverywhere(t *testing.T) {
+	p := NewTransactionPool(2)
+	from := crypto.GeneratePrivateKey().PublicKey()
+
+	transactions := make([]*core.Transaction, 3)
+	for i := range transactions {
+		transactions[i] = util.NewRandomTransaction(10)
+		transactions[i].From = from
+		transactions[i].Nonce = uint64(i + 1)
+	}
+
+	assert.Nil(t, p.Add(transactions[0]))
+	assert.Nil(t, p.Add(transactions[1]))
+	assert.Equal(t, 2, p.ParkedCount())
+
+	// the pruned transaction is dropped from the parked ones as well
+	assert.Nil(t, p.Add(transactions[2]))
+	assert.Equal(t, 2, p.all.Count())
+	assert.Equal(t, 2, p.ParkedCount())
+	assert.False(t, p.Contains(transactions[0].Hash(core.TransactionHasher{})))
+}
+
+func TestTxPoolParkedLimits(t *testing.T) {
+	p := NewTransactionPool(100)
+	from := crypto.GeneratePrivateKey().PublicKey()
+
+	newTransaction := func(nonce uint64) *core.Transaction {
+		transaction := util.NewRandomTransaction(10)
+		transaction.From = from
+		transaction.Nonce = nonce
+
+		return transaction
+	}
+
+	assert.ErrorIs(t, p.Add(newTransaction(maxNonceGap+1)), ErrNonceTooHigh)
+
+	for i := 1; i <= maxParkedPerAccount; i++ {
+		assert.Nil(t, p.Add(newTransaction(uint64(i))))
+	}
+
+	assert.ErrorIs(t, p.Add(newTransaction(maxParkedPerAccount+1)), ErrTooManyParked)
+	assert.Equal(t, maxParkedPerAccount, p.ParkedCount())
+
+	// the transaction which fills the gap is still accepted
+	assert.Nil(t, p.Add(newTransaction(0)))
+	assert.Equal(t, maxParkedPerAccount+1, p.PendingCount())
+}
+
 func TestTxSortedMapFirst(t *testing.T) {
 	m := NewTransactionSortedMap()
 	first := util.NewRandomTransaction(100)
@@ -104,3 +154,137 @@ func TestTxSortedMapRemove(t *testing.T) {
 	assert.Equal(t, m.Count(), 0)
 	assert.False(t, m.Contains(tx.Hash(core.TransactionHasher{})))
 }
+
+func TestTxPoolRestore(t *testing.T) {
+	p := NewTransactionPool(10)
+	tx := util.NewRandomTransaction(100)
+
+	p.Add(tx)
+	p.ClearPending()
+	assert.Equal(t, 0, p.PendingCount())
+
+	// Add ignores transactions which were seen before, Restore brings them back
+	p.Add(tx)
+	assert.Equal(t, 0, p.PendingCount())
+
+	p.Restore([]*core.Transaction{tx})
+	assert.Equal(t, 1, p.PendingCount())
+	assert.Equal(t, 1, p.all.Count())
+}
+
+func TestTxPoolNonceGap(t *testing.T) {
+	p := NewTransactionPool(10)
+	from := crypto.GeneratePrivateKey().PublicKey()
+
+	transactions := make([]*core.Transaction, 3)
+	for i := range transactions {
+		transactions[i] = util.NewRandomTransaction(10)
+		transactions[i].From = from
+		transactions[i].Nonce = uint64(i)
+	}
+
+	// a nonce gap parks the transactions instead of rejecting them
+	assert.Nil(t, p.Add(transactions[2]))
+	assert.Nil(t, p.Add(transactions[1]))
+	assert.Equal(t, 0, p.PendingCount())
+	assert.Equal(t, 2, p.ParkedCount())
+
+	// filling the gap makes them pending in nonce order
+	assert.Nil(t, p.Add(transactions[0]))
+	assert.Equal(t, transactions, p.Pending())
+	assert.Equal(t, 0, p.ParkedCount())
+}
+
+func TestTxPoolNonceTooLow(t *testing.T) {
+	p := NewTransactionPool(10)
+	nonces := map[types.Address]uint64{}
+	p.SetNonceSource(func(address types.Address) uint64 { return nonces[address] })
+
+	first := util.NewRandomTransaction(10)
+	second := util.NewRandomTransaction(10)
+	second.From = first.From
+	second.Nonce = 1
+
+	assert.Nil(t, p.Add(first))
+	assert.Nil(t, p.Add(second))
+	assert.Equal(t, 2, p.PendingCount())
+
+	// the first transaction gets mined, the second one stays pending
+	nonces[first.From.Address()] = 1
+	p.Refresh()
+	assert.Equal(t, []*core.Transaction{second}, p.Pending())
+	assert.Equal(t, 1, p.all.Count())
+	assert.False(t, p.Contains(first.Hash(core.TransactionHasher{})))
+
+	// mined transactions leave the pool completely
+	nonces[first.From.Address()] = 2
+	p.Refresh()
+	assert.Equal(t, 0, p.PendingCount())
+	assert.Equal(t, 0, p.all.Count())
+
+	replay := util.NewRandomTransaction(10)
+	replay.From = first.From
+	assert.ErrorIs(t, p.Add(replay), ErrNonceTooLow)
+}
+
+func TestTxPoolInsufficientFunds(t *testing.T) {
+	p := NewTransactionPool(10)
+	balances := map[types.Address]uint64{}
+	p.SetBalanceSource(func(address types.Address) uint64 { return balances[address] })
+
+	tx := util.NewRandomTransaction(10)
+	tx.Value = 20
+	tx.Fee = 5
+	balances[tx.From.Address()] = 24
+
+	assert.ErrorIs(t, p.Add(tx), ErrInsufficientFunds)
+	assert.False(t, p.Contains(tx.Hash(core.TransactionHasher{})))
+
+	balances[tx.From.Address()] = 25
+	assert.Nil(t, p.Add(tx))
+	assert.Equal(t, 1, p.PendingCount())
+
+	// a call has to pay its gas limit at the gas price as well
+	p.SetGasPrice(2)
+
+	call := &core.Transaction{TxInner: core.CallTx{}, From: crypto.GeneratePrivateKey().PublicKey(), Fee: 5, GasLimit: 100}
+	balances[call.From.Address()] = 204
+
+	assert.ErrorIs(t, p.Add(call), ErrInsufficientFunds)
+
+	balances[call.From.Address()] = 205
+	assert.Nil(t, p.Add(call))
+}
+
+func TestTxPoolMaxTxGas(t *testing.T) {
+	p := NewTransactionPool(10)
+
+	tx := util.NewRandomTransaction(10)
+	tx.GasLimit = core.MaxTxGas + 1
+
+	assert.ErrorIs(t, p.Add(tx), core.ErrGasLimitExceeded)
+	assert.Equal(t, 0, p.PendingCount())
+
+	tx = util.NewRandomTransaction(10)
+	tx.GasLimit = core.MaxTxGas
+	assert.Nil(t, p.Add(tx))
+}
+
+func TestTxPoolRemove(t *testing.T) {
+	p := NewTransactionPool(10)
+	from := crypto.GeneratePrivateKey().PublicKey()
+
+	transactions := make([]*core.Transaction, 3)
+	for i := range transactions {
+		transactions[i] = util.NewRandomTransaction(10)
+		transactions[i].From = from
+		transactions[i].Nonce = uint64(i)
+		assert.Nil(t, p.Add(transactions[i]))
+	}
+
+	// the transactions after the removed one wait for its nonce again
+	p.Remove(transactions[1:2])
+	assert.False(t, p.Contains(transactions[1].Hash(core.TransactionHasher{})))
+	assert.Equal(t, transactions[:1], p.Pending())
+	assert.Equal(t, 1, p.ParkedCount())
+}
@@ -23,9 +23,13 @@ func RandomHash() types.Hash {
 	return types.HashFromBytes(RandomBytes(32))
 }
 
-// NewRandomTransaction returns a new random transaction without signature
+// NewRandomTransaction returns a new random transaction without signature.
+// It is sent from a random account, so its nonce 0 is always the next nonce.
 func NewRandomTransaction(size int) *core.Transaction {
-	return core.NewTransaction(RandomBytes(size))
+	tx := core.NewTransaction(RandomBytes(size))
+	tx.From = crypto.GeneratePrivateKey().PublicKey()
+
+	return tx
 }
 
 // NewRandomTransactionWithSignature returns a new random transaction with signature.